@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// accessTimesFile is the name of the file in the cache directory that the
+// index's access times are persisted to.
+const accessTimesFile = "access-times.json"
+
+// loadAccessTimes reads the access times persisted by a previous run, for the
+// index walk to use. A missing or unreadable file leaves the walk using
+// modification times.
+func (fc *FilesystemCache) loadAccessTimes() {
+	buf, err := ioutil.ReadFile(filepath.Join(fc.directory, accessTimesFile))
+	if err != nil {
+		return
+	}
+
+	var persisted map[string]int64
+	if err := json.Unmarshal(buf, &persisted); err != nil {
+		return
+	}
+
+	accessed := make(map[string]time.Time, len(persisted))
+	for key, unix := range persisted {
+		accessed[key] = time.Unix(unix, 0)
+	}
+	fc.index.accessed = accessed
+}
+
+// SaveAccessTimes persists the index's access times, so that the recency of
+// objects approximately survives a restart. It's called periodically when
+// the cache is created WithAccessTimesInterval, and otherwise does nothing.
+// Nothing is written until the startup index walk has finished, or if no
+// objects have been accessed, added or removed since the last save.
+func (fc *FilesystemCache) SaveAccessTimes() error {
+	if fc.saveInterval <= 0 || !fc.index.complete() {
+		return nil
+	}
+
+	accessed, changed := fc.index.accessTimes()
+	if !changed {
+		return nil
+	}
+
+	persisted := make(map[string]int64, len(accessed))
+	for key, t := range accessed {
+		persisted[key] = t.Unix()
+	}
+
+	buf, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+
+	return fc.writeFile(filepath.Join(fc.directory, accessTimesFile), buf)
+}
+
+// saveAccessTimes calls SaveAccessTimes every save interval.
+func (fc *FilesystemCache) saveAccessTimes() {
+	ticker := time.NewTicker(fc.saveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fc.SaveAccessTimes()
+	}
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeastRecentlyUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir, WithIndexMode(IndexModeEager))
+	require.NoError(t, err)
+
+	now := time.Now()
+	c.index.add("a", 1, now.Add(-3*time.Hour))
+	c.index.add("b", 2, now.Add(-2*time.Hour))
+	c.index.add("c", 3, now.Add(-time.Hour))
+	require.True(t, c.index.touch("a"))
+
+	keys := func(objects []ObjectInfo) (keys []string) {
+		for _, object := range objects {
+			keys = append(keys, object.Key)
+		}
+		return keys
+	}
+	require.Equal(t, []string{"b", "c", "a"}, keys(c.LeastRecentlyUsed(10)))
+	require.Equal(t, []string{"b"}, keys(c.LeastRecentlyUsed(1)))
+}
+
+func TestSaveAccessTimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// without an interval, access times aren't saved
+	c, err := NewFilesystemCache(dir, WithIndexMode(IndexModeEager))
+	require.NoError(t, err)
+	require.NoError(t, c.SaveAccessTimes())
+	_, err = os.Stat(filepath.Join(dir, accessTimesFile))
+	require.True(t, os.IsNotExist(err))
+
+	c, err = NewFilesystemCache(dir, WithIndexMode(IndexModeEager), WithAccessTimesInterval(time.Hour))
+	require.NoError(t, err)
+
+	for _, key := range []string{"foobar", "hello"} {
+		cr, cw, _, err := c.Get(key)
+		require.NoError(t, err)
+		_, err = cw.Write([]byte(key))
+		require.NoError(t, err)
+		require.NoError(t, cr.Close())
+		require.NoError(t, c.Done(key, nil))
+	}
+
+	// the modification times of both objects are older than their accesses
+	old := time.Now().Add(-24 * time.Hour)
+	for _, key := range []string{"foobar", "hello"} {
+		require.NoError(t, os.Chtimes(c.objectPath(key), old, old))
+	}
+	c.index.add("foobar", 6, old)
+	c.index.add("hello", 5, time.Unix(time.Now().Unix(), 0))
+	require.NoError(t, c.SaveAccessTimes())
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, accessTimesFile))
+	require.NoError(t, err)
+
+	// unchanged access times aren't saved again
+	require.NoError(t, os.Remove(filepath.Join(dir, accessTimesFile)))
+	require.NoError(t, c.SaveAccessTimes())
+	_, err = os.Stat(filepath.Join(dir, accessTimesFile))
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, accessTimesFile), buf, 0600))
+
+	// a restart uses the saved access times in place of modification times
+	c, err = NewFilesystemCache(dir, WithIndexMode(IndexModeEager), WithAccessTimesInterval(time.Hour))
+	require.NoError(t, err)
+	objects := c.LeastRecentlyUsed(10)
+	require.Len(t, objects, 2)
+	require.Equal(t, "foobar", objects[0].Key)
+	require.Equal(t, "hello", objects[1].Key)
+	require.True(t, objects[1].Accessed.After(old.Add(time.Hour)))
+	require.Nil(t, c.index.accessed)
+}
+
+func TestPin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir, WithIndexMode(IndexModeEager))
+	require.NoError(t, err)
+
+	require.Equal(t, ErrKeyNotFound, c.Pin("a", true))
+
+	for _, key := range []string{"a", "b"} {
+		cr, cw, _, err := c.Get(key)
+		require.NoError(t, err)
+		_, err = cw.Write([]byte(key))
+		require.NoError(t, err)
+		require.NoError(t, cr.Close())
+		require.NoError(t, c.Done(key, nil))
+	}
+	require.NoError(t, c.Pin("a", true))
+
+	// pinned objects are listed as pinned, and aren't evicted
+	objects := c.Objects("", 10)
+	require.Len(t, objects, 2)
+	require.True(t, objects[0].Pinned)
+	require.False(t, objects[1].Pinned)
+	require.Len(t, c.LeastRecentlyUsed(10), 1)
+	require.Equal(t, "b", c.LeastRecentlyUsed(10)[0].Key)
+
+	// pins survive a restart
+	c, err = NewFilesystemCache(dir, WithIndexMode(IndexModeEager))
+	require.NoError(t, err)
+	require.True(t, c.Objects("", 1)[0].Pinned)
+
+	require.NoError(t, c.Pin("a", false))
+	require.False(t, c.Objects("", 1)[0].Pinned)
+	require.Len(t, c.LeastRecentlyUsed(10), 2)
+}
@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ImportStats reports the outcome of an Import.
+type ImportStats struct {
+	Imported int
+	Rejected int
+}
+
+// Export writes the objects directory to w as a tar archive. Entries are
+// named by their path relative to the objects directory, without the object
+// extension, so the base name of each entry is its key. Objects can be
+// exported whilst the cache is in use, as they're only ever renamed into
+// place once complete.
+func (fc *FilesystemCache) Export(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	objects := filepath.Join(fc.directory, DirObjects)
+
+	err := filepath.Walk(objects, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") || !strings.HasSuffix(info.Name(), fc.extension) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(objects, name)
+		if err != nil {
+			return err
+		}
+		rel = strings.TrimSuffix(rel, fc.extension)
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// Import adds the objects in the tar archive r, as written by Export, to the
+// cache. Each entry's base name must be the SHA-256 hex digest of its
+// content; entries that aren't are rejected and not imported. Imported
+// objects are stored using the cache's filenamer, regardless of the layout
+// they were exported with.
+func (fc *FilesystemCache) Import(r io.Reader) (ImportStats, error) {
+	var stats ImportStats
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		key := path.Base(hdr.Name)
+		ok, err := fc.storeObject(key, key, tr)
+		if err != nil {
+			return stats, fmt.Errorf("importing %s: %v", hdr.Name, err)
+		}
+		if ok {
+			stats.Imported++
+		} else {
+			stats.Rejected++
+		}
+	}
+}
+
+// Replace atomically replaces the cached object for key with the content read
+// from r, or adds it if it isn't cached. oid must be the SHA-256 hex digest of
+// the content. The content is written to a temporary file that's only renamed
+// over the existing object once its digest has been verified, so the object
+// is never missing, and clients already reading the old object continue to do
+// so. ErrDigestMismatch is returned if the content doesn't match the oid.
+func (fc *FilesystemCache) Replace(oid, key string, r io.Reader) error {
+	ok, err := fc.storeObject(oid, key, r)
+	if err == nil && !ok {
+		return ErrDigestMismatch
+	}
+
+	return err
+}
+
+// storeObject copies r to a temporary file and moves it into place under
+// key if its digest matches oid. It returns false if the object was rejected.
+func (fc *FilesystemCache) storeObject(oid, key string, r io.Reader) (bool, error) {
+	if len(oid) != sha256.Size*2 || key == "" || strings.HasPrefix(key, ".") {
+		return false, nil
+	}
+
+	f, err := ioutil.TempFile(fc.tempDir, "store-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != oid {
+		return false, nil
+	}
+
+	dest := fc.objectPath(key)
+	if err := os.MkdirAll(filepath.Dir(dest), fc.dirMode); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(f.Name(), fc.fileMode); err != nil {
+		return false, err
+	}
+	if err := move(f.Name(), dest, fc.fileMode); err != nil {
+		return false, err
+	}
+	fc.index.add(key, size, time.Now())
+
+	return true, fc.cached(key, Metadata{Size: size})
+}
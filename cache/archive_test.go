@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	src, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+
+	dst, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dst)
+
+	content := []byte("exported content")
+	sum := sha256.Sum256(content)
+	key := hex.EncodeToString(sum[:])
+
+	// the object extension isn't part of the exported entry names
+	c, err := NewFilesystemCache(src, WithObjectExtension(".bin"))
+	require.NoError(t, err)
+
+	cr, cw, _, err := c.Get(key)
+	require.NoError(t, err)
+	_, err = cw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, cr.Close())
+	require.NoError(t, c.Done(key, nil))
+
+	var buf bytes.Buffer
+	require.NoError(t, c.Export(&buf))
+
+	// objects are stored with the importing cache's layout
+	imported, err := NewFilesystemCache(dst, WithFilenamer(ShardedFilenamer(0)))
+	require.NoError(t, err)
+
+	stats, err := imported.Import(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, ImportStats{Imported: 1}, stats)
+
+	data, err := ioutil.ReadFile(filepath.Join(dst, DirObjects, key))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, 1, imported.IndexStats().Objects)
+}
+
+func TestImportRejectsInvalidObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sum := sha256.Sum256([]byte("original content"))
+	key := hex.EncodeToString(sum[:])
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"ab/cd/" + key: "tampered content",
+		"not-an-oid":   "other content",
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content))}))
+		_, err = tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	c, err := NewFilesystemCache(dir)
+	require.NoError(t, err)
+
+	stats, err := c.Import(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, ImportStats{Rejected: 2}, stats)
+
+	_, err = os.Stat(filepath.Join(dir, DirObjects, DefaultFilenamer(key)))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReplace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	content := []byte("replaced content")
+	sum := sha256.Sum256(content)
+	key := hex.EncodeToString(sum[:])
+
+	c, err := NewFilesystemCache(dir)
+	require.NoError(t, err)
+
+	filename := filepath.Join(dir, DirObjects, DefaultFilenamer(key))
+	require.NoError(t, os.MkdirAll(filepath.Dir(filename), 0700))
+	require.NoError(t, ioutil.WriteFile(filename, []byte("stale"), 0600))
+
+	old, _, source, err := c.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, SourceDisk, source)
+	defer old.Close()
+
+	// content that doesn't match the oid leaves the object as is
+	require.Equal(t, ErrDigestMismatch, c.Replace(key, key, bytes.NewReader([]byte("wrong"))))
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("stale"), data)
+
+	require.NoError(t, c.Replace(key, key, bytes.NewReader(content)))
+	data, err = ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	// readers of the old object are unaffected
+	data, err = ioutil.ReadAll(old)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("stale"), data)
+}
@@ -3,14 +3,34 @@ package cache
 import (
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 // ErrKeyNotFound is returned when a cache key cannot be found.
 var ErrKeyNotFound = errors.New("key not found")
 
+// ErrTooManyReaders is returned by Get when an inflight key already has the
+// maximum number of readers.
+var ErrTooManyReaders = errors.New("too many readers")
+
+// ErrInflightExpired is returned to the readers of an inflight key whose
+// fetch exceeded the maximum inflight duration.
+var ErrInflightExpired = errors.New("inflight duration exceeded")
+
+// ErrInvalidFilenamer is returned by NewFilesystemCache when the filenamer
+// doesn't return a relative path whose base name is the key.
+var ErrInvalidFilenamer = errors.New("filenamer must return a relative path whose base name is the key")
+
+// ErrDigestMismatch is returned by Replace when the content's digest doesn't
+// match the key.
+var ErrDigestMismatch = errors.New("content digest mismatch")
+
 // Source indicates the source of the cached content.
 type Source string
 
@@ -26,49 +46,158 @@ const (
 
 // Subdirectories for storing objects.
 const (
-	DirObjects = "objects"
-	DirTemp    = "tmp"
+	DirObjects    = "objects"
+	DirTemp       = "tmp"
+	DirQuarantine = "quarantine"
+	DirMetadata   = "metadata"
 )
 
+// DirPartials is the subdirectory of the temp directory that partial files
+// kept for resuming are moved to. Only files in it are treated as partials,
+// so that the temp directory can be shared with other programs.
+const DirPartials = "partials"
+
 // FilesystemCache caches files to disk.
 type FilesystemCache struct {
 	lock         sync.RWMutex
+	metadataLock sync.Mutex
+	pinLock      sync.Mutex
 	singleflight map[string]fileConcurrentReadWriter
 	directory    string
+	tempDir      string
+	dirMode      os.FileMode
+	fileMode     os.FileMode
+	index        *index
+	indexMode    IndexMode
+	indexWorkers int
+	partialTTL   time.Duration
+	partials     map[string]partial
+	shared       bool
+	maxReaders   int
+	maxInflight  time.Duration
+	saveInterval time.Duration
+	extension    string
+	promoted     func(key string, took time.Duration, err error)
 
+	// Filenamer maps a cache key to a path relative to the objects directory.
+	// It's the extension point for custom on-disk layouts, such as a
+	// different sharding scheme suited to a filesystem's limits on entries
+	// per directory. The path's base name must be the key itself, as the
+	// index and Export recover keys from the base names of files on disk, so
+	// keys can't be shortened or hashed; only the directories the file is
+	// nested under can be chosen. It must return the same path for a key
+	// every time, including across restarts.
 	Filenamer func(key string) string
 }
 
 type fileConcurrentReadWriter struct {
-	f    *os.File
-	crw  *ConcurrentReadWriter
-	dest string
+	f      *os.File
+	crw    *ConcurrentReadWriter
+	temp   string
+	dest   string
+	expiry *time.Timer
 }
 
 // DefaultFilenamer is the default filenamer used when naming a cached file on
 // disk.
 func DefaultFilenamer(key string) string {
-	if len(key) < 4 {
-		return key
-	}
+	return ShardedFilenamer(2)(key)
+}
+
+// ShardedFilenamer returns a filenamer that nests cached files under depth
+// levels of two character key prefix directories. A depth of 0 stores files
+// flat in the objects directory.
+func ShardedFilenamer(depth int) func(key string) string {
+	return func(key string) string {
+		if len(key) < depth*2 {
+			return key
+		}
 
-	return filepath.Join(key[0:2], key[2:4], key)
+		parts := make([]string, 0, depth+1)
+		for i := 0; i < depth; i++ {
+			parts = append(parts, key[i*2:i*2+2])
+		}
+
+		return filepath.Join(append(parts, key)...)
+	}
 }
 
 // NewFilesystemCache returns a new FilesystemCache.
-func NewFilesystemCache(directory string) (*FilesystemCache, error) {
-	if err := os.MkdirAll(filepath.Join(directory, DirObjects), 0700); err != nil {
+func NewFilesystemCache(directory string, options ...Option) (*FilesystemCache, error) {
+	fc := &FilesystemCache{
+		singleflight: make(map[string]fileConcurrentReadWriter),
+		partials:     make(map[string]partial),
+		directory:    directory,
+		dirMode:      DefaultDirMode,
+		fileMode:     DefaultFileMode,
+		index:        newIndex(),
+		indexMode:    IndexModeLazy,
+		indexWorkers: 1,
+		Filenamer:    DefaultFilenamer,
+	}
+
+	for _, option := range options {
+		option(fc)
+	}
+
+	if !validFilenamer(fc.Filenamer) {
+		return nil, ErrInvalidFilenamer
+	}
+
+	if fc.tempDir == "" {
+		fc.tempDir = filepath.Join(directory, DirTemp)
+	}
+	fc.index.extension = fc.extension
+
+	if err := os.MkdirAll(filepath.Join(directory, DirObjects), fc.dirMode); err != nil {
 		return nil, err
 	}
-	if err := os.MkdirAll(filepath.Join(directory, DirTemp), 0700); err != nil {
+	if err := os.MkdirAll(fc.tempDir, fc.dirMode); err != nil {
 		return nil, err
 	}
+	if fc.partialTTL > 0 {
+		if err := os.MkdirAll(filepath.Join(fc.tempDir, DirPartials), fc.dirMode); err != nil {
+			return nil, err
+		}
+	}
 
-	return &FilesystemCache{
-		singleflight: make(map[string]fileConcurrentReadWriter),
-		directory:    directory,
-		Filenamer:    DefaultFilenamer,
-	}, nil
+	if fc.partialTTL > 0 {
+		// the temp files of a shared directory may belong to fetches of
+		// other processes that are still in progress
+		if !fc.shared {
+			fc.loadPartials()
+		}
+		go fc.sweepPartials()
+	}
+
+	fc.loadPins()
+
+	if fc.saveInterval > 0 {
+		fc.loadAccessTimes()
+		go fc.saveAccessTimes()
+	}
+
+	switch fc.indexMode {
+	case IndexModeEager:
+		fc.index.walk(filepath.Join(directory, DirObjects), fc.indexWorkers)
+	default:
+		go fc.index.walk(filepath.Join(directory, DirObjects), fc.indexWorkers)
+	}
+
+	return fc, nil
+}
+
+// validFilenamer returns whether filenamer maps a key, in the form of an
+// object's OID, to a path within the objects directory named by the key.
+func validFilenamer(filenamer func(key string) string) bool {
+	const key = "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+
+	name := filenamer(key)
+	if filepath.IsAbs(name) || filepath.Base(name) != key {
+		return false
+	}
+
+	return !strings.HasPrefix(filepath.Clean(name), "..")
 }
 
 // Directory returns the cache directory.
@@ -76,6 +205,22 @@ func (fc *FilesystemCache) Directory() string {
 	return fc.directory
 }
 
+// ObjectName returns the path of the cached file for key, relative to the
+// objects directory: the filenamer's path with the object extension.
+func (fc *FilesystemCache) ObjectName(key string) string {
+	return fc.Filenamer(key) + fc.extension
+}
+
+// objectPath returns the path of the cached file for key.
+func (fc *FilesystemCache) objectPath(key string) string {
+	return filepath.Join(fc.directory, DirObjects, fc.ObjectName(key))
+}
+
+// TempDirectory returns the directory in-progress downloads are written to.
+func (fc *FilesystemCache) TempDirectory() string {
+	return fc.tempDir
+}
+
 // Get returns:
 // - A reader so that data can be read from the cache.
 // - A writer if the cache doesn't yet exist so that it can be populated.
@@ -85,10 +230,43 @@ func (fc *FilesystemCache) Directory() string {
 // will only EOF if the writer or reader is closed.
 //
 // A writer can only be closed if all readers have been closed.
+//
+// The writer is a *ConcurrentReadWriter. If a partial file was kept for the
+// key, the fetch resumes from it: the data kept is available to readers and
+// the writer's Offset is its size.
 func (fc *FilesystemCache) Get(key string) (ReadAtReadCloser, io.WriteCloser, Source, error) {
-	filename := filepath.Join(fc.directory, DirObjects, fc.Filenamer(key))
+	return fc.get(key, true)
+}
+
+// Lookup is like Get, but returns ErrKeyNotFound rather than a writer if the
+// key is neither on disk nor inflight.
+func (fc *FilesystemCache) Lookup(key string) (ReadAtReadCloser, Source, error) {
+	r, _, source, err := fc.get(key, false)
+	return r, source, err
+}
+
+// Stat returns the file info of the object on disk for key, without opening
+// it or recording an access. ErrKeyNotFound is returned if the object isn't
+// on disk, even if it's inflight.
+func (fc *FilesystemCache) Stat(key string) (os.FileInfo, error) {
+	fi, err := os.Stat(fc.objectPath(key))
+	if os.IsNotExist(err) {
+		return nil, ErrKeyNotFound
+	}
+	return fi, err
+}
+
+func (fc *FilesystemCache) get(key string, create bool) (ReadAtReadCloser, io.WriteCloser, Source, error) {
+	filename := fc.objectPath(key)
 	f, err := os.Open(filename)
 	if err == nil {
+		// index disk hits the startup walk hasn't reached yet
+		if !fc.index.touch(key) {
+			if fi, err := f.Stat(); err == nil {
+				fc.index.add(key, fi.Size(), time.Now())
+				fc.index.touch(key)
+			}
+		}
 		return f, nil, SourceDisk, nil
 	}
 
@@ -97,52 +275,202 @@ func (fc *FilesystemCache) Get(key string) (ReadAtReadCloser, io.WriteCloser, So
 
 	singleflight, ok := fc.singleflight[key]
 	if ok {
+		if fc.maxReaders > 0 && singleflight.crw.Readers() >= fc.maxReaders {
+			return nil, nil, SourceInflight, ErrTooManyReaders
+		}
 		return singleflight.crw.Reader(), nil, SourceInflight, nil
 	}
+	if !create {
+		return nil, nil, SourceFresh, ErrKeyNotFound
+	}
+
+	// a fetch resumes from a partial that was kept, the writer's Offset
+	// reports where the data written so far ends
+	kept := fc.partials[key]
+	delete(fc.partials, key)
 
-	f, err = os.Create(filepath.Join(fc.directory, DirTemp, key))
+	f, crw, err := fc.openTemp(key, kept.name)
 	if err != nil {
 		return nil, nil, SourceFresh, err
 	}
 
-	crw := NewConcurrentReadWriter(f)
-	fc.singleflight[key] = fileConcurrentReadWriter{
+	singleflight = fileConcurrentReadWriter{
 		f:    f,
 		crw:  crw,
+		temp: f.Name(),
 		dest: filename,
 	}
+	if fc.maxInflight > 0 {
+		singleflight.expiry = time.AfterFunc(fc.maxInflight, func() {
+			fc.expire(key, crw)
+		})
+	}
+	fc.singleflight[key] = singleflight
 
 	return crw.Reader(), crw, SourceFresh, nil
 }
 
+// openTemp opens the temporary file for key. If resume is set, it is the name
+// of a kept partial file, whose data is kept and appended to. Otherwise, each
+// fetch's temporary file has a unique name, <key>.<token>, so that a retry
+// of a key whose failed fetch's file hasn't been removed yet, or a fetch of
+// the same key by another process sharing the directory, never writes to the
+// same file.
+func (fc *FilesystemCache) openTemp(key string, resume string) (*os.File, *ConcurrentReadWriter, error) {
+	var f *os.File
+	var err error
+	if resume != "" {
+		f, err = os.OpenFile(resume, os.O_RDWR|os.O_CREATE, fc.fileMode)
+	} else if f, err = ioutil.TempFile(fc.tempDir, key+"."); err == nil {
+		if err = f.Chmod(fc.fileMode); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return f, newConcurrentReadWriterAt(f, offset), nil
+}
+
 // Done indicates that we're done with a certain cache key.
 //
 // If an error is passed, the cache is deleted, otherwise the cache file is
-// moved to the cache directory.
+// moved to the cache directory. If partials are kept and the error was
+// marked with Retryable, the partial file is kept instead.
+//
+// If the key exceeded the maximum inflight duration, it has already been
+// failed, and its writer is closed. Done must not be called for it, as the
+// key may have since been fetched again.
 func (fc *FilesystemCache) Done(key string, err error) error {
-	fc.lock.Lock()
-	defer fc.lock.Unlock()
+	return fc.DoneWithMetadata(key, err, Metadata{})
+}
 
+// DoneWithMetadata is like Done, but records md as the metadata of the object
+// if it was cached, such as details of the fetch that are only known to the
+// writer. Its fetch time and size are set by the cache.
+func (fc *FilesystemCache) DoneWithMetadata(key string, err error, md Metadata) error {
+	fc.lock.Lock()
 	singleflight, ok := fc.singleflight[key]
-
 	if !ok {
+		fc.lock.Unlock()
 		return ErrKeyNotFound
 	}
-	delete(fc.singleflight, key)
+	fi, err := fc.done(key, singleflight, err)
+	fc.lock.Unlock()
 
-	// ensure crw is closed
-	if err := singleflight.crw.Close(); err != nil {
+	// the metadata is written once the lock is released, so that Gets
+	// aren't held up by the write
+	if err != nil || fi == nil {
 		return err
 	}
+	md.Size = fi.Size()
+
+	return fc.cached(key, md)
+}
+
+// expire fails the inflight key if crw is still its writer, once it has
+// exceeded the maximum inflight duration. This frees the key for a new fetch
+// even if the writer never calls Done, such as when its fetch hangs.
+func (fc *FilesystemCache) expire(key string, crw *ConcurrentReadWriter) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	singleflight, ok := fc.singleflight[key]
+	if !ok || singleflight.crw != crw {
+		return
+	}
+
+	fc.done(key, singleflight, ErrInflightExpired)
+}
+
+// done finishes the inflight key, returning the file info of the object if
+// it was cached. It must be called with the lock held.
+func (fc *FilesystemCache) done(key string, singleflight fileConcurrentReadWriter, err error) (os.FileInfo, error) {
+	delete(fc.singleflight, key)
+	if singleflight.expiry != nil {
+		singleflight.expiry.Stop()
+	}
+
+	// ensure crw is closed, readers of a failed write are passed the error
+	if err := singleflight.crw.CloseWithError(err); err != nil {
+		return nil, err
+	}
 
 	// remove backing file if there was an error
 	if err != nil {
-		return os.Remove(singleflight.f.Name())
+		if fc.partialTTL > 0 && IsRetryable(err) {
+			return nil, fc.keepPartial(key, singleflight.temp)
+		}
+		return nil, os.Remove(singleflight.temp)
 	}
 
 	// rename backing file on success
-	if err := os.MkdirAll(filepath.Dir(singleflight.dest), 0700); err != nil {
+	begin := time.Now()
+	err = os.MkdirAll(filepath.Dir(singleflight.dest), fc.dirMode)
+	if err == nil {
+		err = move(singleflight.temp, singleflight.dest, fc.fileMode)
+	}
+	if fc.promoted != nil {
+		fc.promoted(key, time.Since(begin), err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(singleflight.dest)
+	if err != nil {
+		return nil, err
+	}
+	fc.index.add(key, fi.Size(), time.Now())
+
+	return fi, nil
+}
+
+// move renames src to dst. If they're on different filesystems, src is
+// copied alongside dst, renamed into place and then removed.
+func move(src, dst string, mode os.FileMode) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
 		return err
 	}
-	return os.Rename(singleflight.f.Name(), singleflight.dest)
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// dot prefixed files are ignored by the index walk
+	out, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+"-")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Chmod(mode)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+
+	return os.Remove(src)
 }
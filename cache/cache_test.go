@@ -1,11 +1,13 @@
 package cache
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -76,3 +78,383 @@ func TestCache(t *testing.T) {
 	_, err = os.Stat(filepath.Join(dir, DirObjects, DefaultFilenamer("hello")))
 	require.Error(t, err)
 }
+
+func TestLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir)
+	require.NoError(t, err)
+
+	// a lookup of a missing key doesn't start a fetch
+	_, _, err = c.Lookup("foobar")
+	require.Equal(t, ErrKeyNotFound, err)
+	_, _, source, err := c.Get("foobar")
+	require.NoError(t, err)
+	require.Equal(t, SourceFresh, source)
+
+	cr, source, err := c.Lookup("foobar")
+	require.NoError(t, err)
+	require.Equal(t, SourceInflight, source)
+	require.NoError(t, cr.Close())
+}
+
+func TestCacheModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir, WithDirMode(0750), WithFileMode(0640))
+	require.NoError(t, err)
+
+	fi, err := os.Stat(filepath.Join(dir, DirObjects))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0750), fi.Mode().Perm())
+
+	cr, _, _, err := c.Get("foobar")
+	require.NoError(t, err)
+	require.NoError(t, cr.Close())
+	require.NoError(t, c.Done("foobar", nil))
+
+	fi, err = os.Stat(filepath.Join(dir, DirObjects, DefaultFilenamer("foobar")))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+}
+
+func TestCacheTempDirectory(t *testing.T) {
+	// /dev/shm is typically a separate filesystem, exercising the
+	// cross-device copy fallback
+	for _, parent := range []string{"", "/dev/shm"} {
+		if _, err := os.Stat(parent); parent != "" && err != nil {
+			continue
+		}
+
+		dir, err := ioutil.TempDir("", "")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		tmp, err := ioutil.TempDir(parent, "")
+		require.NoError(t, err)
+		defer os.RemoveAll(tmp)
+
+		c, err := NewFilesystemCache(dir, WithTempDirectory(tmp), WithFileMode(0640))
+		require.NoError(t, err)
+		require.Equal(t, tmp, c.TempDirectory())
+
+		cr, cw, _, err := c.Get("foobar")
+		require.NoError(t, err)
+		require.Len(t, tempFiles(t, tmp, "foobar"), 1)
+
+		_, err = cw.Write([]byte("foobar"))
+		require.NoError(t, err)
+		require.NoError(t, cr.Close())
+		require.NoError(t, c.Done("foobar", nil))
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, DirObjects, DefaultFilenamer("foobar")))
+		require.NoError(t, err)
+		require.Equal(t, []byte("foobar"), data)
+
+		fi, err := os.Stat(filepath.Join(dir, DirObjects, DefaultFilenamer("foobar")))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+
+		require.Empty(t, tempFiles(t, tmp, "foobar"))
+	}
+}
+
+// tempFiles returns the temporary files for key in the temp directory dir.
+func tempFiles(t *testing.T, dir, key string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, key+".*"))
+	require.NoError(t, err)
+	return matches
+}
+
+func TestPromotionHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var promoted []string
+	c, err := NewFilesystemCache(dir, WithPromotionHook(func(key string, took time.Duration, err error) {
+		require.NoError(t, err)
+		promoted = append(promoted, key)
+	}))
+	require.NoError(t, err)
+
+	for _, key := range []string{"foo", "bar"} {
+		cr, _, _, err := c.Get(key)
+		require.NoError(t, err)
+		require.NoError(t, cr.Close())
+	}
+	require.NoError(t, c.Done("foo", nil))
+	require.NoError(t, c.Done("bar", errors.New("failed")))
+
+	// failed downloads aren't promoted
+	require.Equal(t, []string{"foo"}, promoted)
+}
+
+func TestShardedFilenamer(t *testing.T) {
+	key := "abcdef0123"
+
+	require.Equal(t, key, ShardedFilenamer(0)(key))
+	require.Equal(t, filepath.Join("ab", key), ShardedFilenamer(1)(key))
+	require.Equal(t, filepath.Join("ab", "cd", key), ShardedFilenamer(2)(key))
+	require.Equal(t, filepath.Join("ab", "cd", "ef", key), ShardedFilenamer(3)(key))
+	require.Equal(t, DefaultFilenamer(key), ShardedFilenamer(2)(key))
+	require.Equal(t, "abc", ShardedFilenamer(2)("abc"))
+}
+
+func TestIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir, WithIndexMode(IndexModeEager))
+	require.NoError(t, err)
+	require.Equal(t, IndexStats{Complete: true}, c.IndexStats())
+
+	for _, key := range []string{"foobar", "hello"} {
+		cr, cw, _, err := c.Get(key)
+		require.NoError(t, err)
+		_, err = cw.Write([]byte(key))
+		require.NoError(t, err)
+		require.NoError(t, cr.Close())
+		require.NoError(t, c.Done(key, nil))
+	}
+	require.Equal(t, IndexStats{Objects: 2, Bytes: 11, Complete: true}, c.IndexStats())
+
+	// eager index of existing cache
+	c, err = NewFilesystemCache(dir, WithIndexMode(IndexModeEager))
+	require.NoError(t, err)
+	require.Equal(t, IndexStats{Objects: 2, Bytes: 11, Complete: true}, c.IndexStats())
+
+	// lazy index of existing cache
+	c, err = NewFilesystemCache(dir, WithIndexMode(IndexModeLazy))
+	require.NoError(t, err)
+	<-c.Indexed()
+	require.NoError(t, c.IndexErr())
+	require.Equal(t, IndexStats{Objects: 2, Bytes: 11, Complete: true}, c.IndexStats())
+
+	// concurrent walk of shards, alongside flat objects
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, DirObjects, "flat"), []byte("flat"), 0600))
+	c, err = NewFilesystemCache(dir, WithIndexMode(IndexModeEager), WithIndexWorkers(4))
+	require.NoError(t, err)
+	require.NoError(t, c.IndexErr())
+	require.Equal(t, IndexStats{Objects: 3, Bytes: 15, Complete: true}, c.IndexStats())
+}
+
+func TestRetryFailedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir)
+	require.NoError(t, err)
+
+	cr, cw, _, err := c.Get("foobar")
+	require.NoError(t, err)
+	_, err = cw.Write([]byte("foo"))
+	require.NoError(t, err)
+	failed := c.singleflight["foobar"].temp
+
+	done := make(chan error)
+	go func() {
+		done <- c.Done("foobar", errors.New("failed"))
+	}()
+
+	// the failed fetch's reader gets its data and error
+	data, err := ioutil.ReadAll(cr)
+	require.EqualError(t, err, "failed")
+	require.Equal(t, []byte("foo"), data)
+	require.NoError(t, cr.Close())
+	require.NoError(t, <-done)
+
+	// and an immediate retry writes to a new file
+	rcr, rcw, source, err := c.Get("foobar")
+	require.NoError(t, err)
+	require.Equal(t, SourceFresh, source)
+	require.NotEqual(t, failed, c.singleflight["foobar"].temp)
+	_, err = os.Stat(failed)
+	require.True(t, os.IsNotExist(err))
+
+	_, err = rcw.Write([]byte("barbaz"))
+	require.NoError(t, err)
+	require.NoError(t, rcr.Close())
+	require.NoError(t, c.Done("foobar", nil))
+
+	data, err = ioutil.ReadFile(filepath.Join(dir, DirObjects, DefaultFilenamer("foobar")))
+	require.NoError(t, err)
+	require.Equal(t, []byte("barbaz"), data)
+}
+
+func TestMaxInflightReaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir, WithMaxInflightReaders(2))
+	require.NoError(t, err)
+
+	cr, cw, _, err := c.Get("foobar")
+	require.NoError(t, err)
+
+	inflight, _, _, err := c.Get("foobar")
+	require.NoError(t, err)
+
+	_, _, source, err := c.Get("foobar")
+	require.Equal(t, ErrTooManyReaders, err)
+	require.Equal(t, SourceInflight, source)
+
+	// closing a reader frees a slot
+	require.NoError(t, inflight.Close())
+	inflight, _, _, err = c.Get("foobar")
+	require.NoError(t, err)
+	require.NoError(t, inflight.Close())
+
+	_, err = cw.Write([]byte("foobar"))
+	require.NoError(t, err)
+	require.NoError(t, cr.Close())
+	require.NoError(t, c.Done("foobar", nil))
+
+	// and objects on disk have no limit
+	for i := 0; i < 3; i++ {
+		r, _, source, err := c.Get("foobar")
+		require.NoError(t, err)
+		require.Equal(t, SourceDisk, source)
+		defer r.Close()
+	}
+}
+
+func TestMaxInflightDuration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir, WithMaxInflightDuration(50*time.Millisecond))
+	require.NoError(t, err)
+
+	// a hung fetch writes some data but never calls Done
+	cr, cw, _, err := c.Get("foobar")
+	require.NoError(t, err)
+	_, err = cw.Write([]byte("foo"))
+	require.NoError(t, err)
+
+	// its reader is failed once the inflight duration is exceeded
+	buf, err := ioutil.ReadAll(cr)
+	require.Equal(t, "foo", string(buf))
+	require.Equal(t, ErrInflightExpired, err)
+	require.NoError(t, cr.Close())
+
+	// the temp file is removed and the key can be fetched again
+	require.Eventually(t, func() bool {
+		return len(tempFiles(t, c.TempDirectory(), "foobar")) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = cw.Write([]byte("bar"))
+	require.Error(t, err)
+
+	cr, cw, source, err := c.Get("foobar")
+	require.NoError(t, err)
+	require.Equal(t, SourceFresh, source)
+	_, err = cw.Write([]byte("foobar"))
+	require.NoError(t, err)
+	require.NoError(t, cr.Close())
+	require.NoError(t, c.Done("foobar", nil))
+}
+
+func TestFilenamer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, filenamer := range []func(string) string{
+		func(key string) string { return key[:8] },
+		func(key string) string { return filepath.Join("/", key) },
+		func(key string) string { return filepath.Join("..", key) },
+	} {
+		_, err := NewFilesystemCache(dir, WithFilenamer(filenamer))
+		require.Equal(t, ErrInvalidFilenamer, err)
+	}
+
+	c, err := NewFilesystemCache(dir, WithFilenamer(func(key string) string {
+		return filepath.Join(key[len(key)-2:], key)
+	}))
+	require.NoError(t, err)
+
+	cr, cw, _, err := c.Get("foobar")
+	require.NoError(t, err)
+	_, err = cw.Write([]byte("foobar"))
+	require.NoError(t, err)
+	require.NoError(t, cr.Close())
+	require.NoError(t, c.Done("foobar", nil))
+
+	_, err = os.Stat(filepath.Join(dir, DirObjects, "ar", "foobar"))
+	require.NoError(t, err)
+}
+
+func TestObjectExtension(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir, WithObjectExtension(".bin"))
+	require.NoError(t, err)
+
+	cr, cw, _, err := c.Get("foobar")
+	require.NoError(t, err)
+	_, err = cw.Write([]byte("foobar"))
+	require.NoError(t, err)
+	require.NoError(t, cr.Close())
+	require.NoError(t, c.Done("foobar", nil))
+
+	require.Equal(t, filepath.Join("fo", "ob", "foobar.bin"), c.ObjectName("foobar"))
+	_, err = os.Stat(filepath.Join(dir, DirObjects, c.ObjectName("foobar")))
+	require.NoError(t, err)
+
+	cr, _, source, err := c.Get("foobar")
+	require.NoError(t, err)
+	require.Equal(t, SourceDisk, source)
+	require.NoError(t, cr.Close())
+
+	// files without the extension aren't objects
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, DirObjects, "other"), []byte("other"), 0600))
+
+	// the index recovers the key without the extension
+	c, err = NewFilesystemCache(dir, WithObjectExtension(".bin"), WithIndexMode(IndexModeEager))
+	require.NoError(t, err)
+	require.Equal(t, IndexStats{Objects: 1, Bytes: 6, Complete: true}, c.IndexStats())
+	require.Equal(t, "foobar", c.Objects("", 10)[0].Key)
+}
+
+func TestObjectsPagination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir, WithIndexMode(IndexModeEager))
+	require.NoError(t, err)
+
+	keys := func(objects []ObjectInfo) (keys []string) {
+		for _, object := range objects {
+			keys = append(keys, object.Key)
+		}
+		return keys
+	}
+
+	now := time.Now()
+	for _, key := range []string{"d", "b", "a", "c"} {
+		c.index.add(key, 1, now)
+	}
+	require.Equal(t, []string{"a", "b"}, keys(c.Objects("", 2)))
+	require.Equal(t, []string{"c", "d"}, keys(c.Objects("b", 2)))
+	require.Empty(t, c.Objects("d", 2))
+
+	// keys added and removed between pages are merged in order
+	c.index.remove("c")
+	c.index.add("bb", 1, now)
+	c.index.remove("a")
+	c.index.add("a", 1, now)
+	require.Equal(t, []string{"a", "b", "bb", "d"}, keys(c.Objects("", 10)))
+	require.Equal(t, []string{"bb", "d"}, keys(c.Objects("ba", 10)))
+}
@@ -1,10 +1,24 @@
 package cache
 
 import (
+	"errors"
 	"io"
+	"sort"
 	"sync"
 )
 
+// ErrWriteAtUnsupported is returned by WriteAt when the underlying
+// read/writer doesn't implement io.WriterAt.
+var ErrWriteAtUnsupported = errors.New("underlying writer doesn't support WriteAt")
+
+// ErrRewindUnsupported is returned by Rewind when the underlying read/writer
+// can't be truncated and seeked.
+var ErrRewindUnsupported = errors.New("underlying writer doesn't support truncating")
+
+// ErrRewound is returned by readers that had read data that was discarded by
+// Rewind, when Rewind isn't given another error.
+var ErrRewound = errors.New("data read was discarded by a rewind")
+
 // ReadAtWriteCloser is the interface that groups the basic ReadAt, Write and
 // Close methods.
 type ReadAtWriteCloser interface {
@@ -19,29 +33,66 @@ type ReadAtReadCloser interface {
 	io.ReadCloser
 }
 
+// Range is a contiguous range of bytes, from Start up to but excluding End.
+type Range struct {
+	Start int64
+	End   int64
+}
+
 // ConcurrentReadWriter wraps a ReadAtWriteCloser (such as os.File) and allows
 // multiple readers to stream data as it is being written.
+//
+// Writes don't need to be sequential: data written with WriteAt is available
+// to readers as soon as it has been written, regardless of write order.
 type ConcurrentReadWriter struct {
 	r ReadAtWriteCloser
 
-	lock   sync.Mutex
-	wake   *sync.Cond
-	wg     sync.WaitGroup
-	closed bool
+	lock      sync.Mutex
+	wake      *sync.Cond
+	wg        sync.WaitGroup
+	closed    bool
+	done      chan struct{}
+	err       error
+	offset    int64
+	available []Range
+	readers   int
+
+	// generation is incremented by each Rewind, readers that have read data
+	// of an earlier generation fail with rewindErr
+	generation uint64
+	rewindErr  error
 }
 
 // NewConcurrentReadWriter returns a new ConcurrentReadWriter.
 func NewConcurrentReadWriter(r ReadAtWriteCloser) *ConcurrentReadWriter {
-	crw := &ConcurrentReadWriter{r: r}
+	return newConcurrentReadWriterAt(r, 0)
+}
+
+// newConcurrentReadWriterAt returns a ConcurrentReadWriter for r, which
+// already holds offset bytes of data. r's write position must be at offset.
+func newConcurrentReadWriterAt(r ReadAtWriteCloser, offset int64) *ConcurrentReadWriter {
+	crw := &ConcurrentReadWriter{r: r, offset: offset, done: make(chan struct{})}
 	crw.wake = sync.NewCond(&crw.lock)
+	crw.markAvailable(0, offset)
 	return crw
 }
 
 // Close closes the underlying read/writer, but blocks until all readers
 // have been closed.
 func (crw *ConcurrentReadWriter) Close() error {
+	return crw.CloseWithError(nil)
+}
+
+// CloseWithError closes the ConcurrentReadWriter like Close, but readers
+// that have read all available data return err rather than io.EOF. This
+// lets readers tell a write that failed short apart from complete data.
+func (crw *ConcurrentReadWriter) CloseWithError(err error) error {
 	crw.lock.Lock()
+	if !crw.closed {
+		close(crw.done)
+	}
 	crw.closed = true
+	crw.err = err
 	crw.lock.Unlock()
 
 	// wake readers
@@ -61,19 +112,194 @@ func (crw *ConcurrentReadWriter) Closed() bool {
 	return crw.closed
 }
 
-// Write implements the standard Write interface.
+// Done returns a channel that's closed once the ConcurrentReadWriter has been
+// closed, so that a writer can stop when it's closed by someone else, such as
+// the cache failing a key that exceeded the maximum inflight duration.
+func (crw *ConcurrentReadWriter) Done() <-chan struct{} {
+	return crw.done
+}
+
+// Write implements the standard Write interface. Data is appended after the
+// last sequentially written byte.
 func (crw *ConcurrentReadWriter) Write(p []byte) (n int, err error) {
 	n, err = crw.r.Write(p)
+
+	crw.lock.Lock()
+	crw.markAvailable(crw.offset, int64(n))
+	crw.offset += int64(n)
+	crw.lock.Unlock()
+
+	crw.wake.Broadcast()
+
+	return
+}
+
+// WriteAt implements the standard WriteAt interface, allowing data to be
+// written out of order. The underlying read/writer must implement
+// io.WriterAt.
+func (crw *ConcurrentReadWriter) WriteAt(p []byte, off int64) (n int, err error) {
+	w, ok := crw.r.(io.WriterAt)
+	if !ok {
+		return 0, ErrWriteAtUnsupported
+	}
+
+	n, err = w.WriteAt(p, off)
+
+	crw.lock.Lock()
+	crw.markAvailable(off, int64(n))
+	crw.lock.Unlock()
+
 	crw.wake.Broadcast()
 
 	return
 }
 
-func (crw *ConcurrentReadWriter) wait() {
+// Rewind discards the data written so far, truncating the underlying
+// read/writer, so that it can be written again from the start, such as when
+// it turned out to be corrupt. Readers that haven't read anything yet wait
+// for data to be written again. Readers that have already read data can't
+// take it back, so they fail with err, or ErrRewound if err is nil, rather
+// than joining the discarded data to what's written next.
+func (crw *ConcurrentReadWriter) Rewind(err error) error {
+	f, ok := crw.r.(interface {
+		io.Seeker
+		Truncate(size int64) error
+	})
+	if !ok {
+		return ErrRewindUnsupported
+	}
+
 	crw.lock.Lock()
 	defer crw.lock.Unlock()
 
-	crw.wake.Wait()
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err == nil {
+		err = ErrRewound
+	}
+	crw.available = nil
+	crw.offset = 0
+	crw.generation++
+	crw.rewindErr = err
+
+	// wake readers, so those that have read discarded data fail
+	crw.wake.Broadcast()
+
+	return nil
+}
+
+// Offset returns the offset that the next Write appends data at.
+func (crw *ConcurrentReadWriter) Offset() int64 {
+	crw.lock.Lock()
+	defer crw.lock.Unlock()
+
+	return crw.offset
+}
+
+// Available returns the ranges of bytes that have been written.
+func (crw *ConcurrentReadWriter) Available() []Range {
+	crw.lock.Lock()
+	defer crw.lock.Unlock()
+
+	available := make([]Range, len(crw.available))
+	copy(available, crw.available)
+
+	return available
+}
+
+// markAvailable records that n bytes from off have been written, merging
+// overlapping and adjacent ranges. The lock must be held.
+func (crw *ConcurrentReadWriter) markAvailable(off, n int64) {
+	if n <= 0 {
+		return
+	}
+
+	added := Range{Start: off, End: off + n}
+
+	// find the first range that ends at or after the added range's start
+	idx := sort.Search(len(crw.available), func(i int) bool {
+		return crw.available[i].End >= added.Start
+	})
+
+	// merge all ranges that overlap or touch the added range
+	end := idx
+	for end < len(crw.available) && crw.available[end].Start <= added.End {
+		if crw.available[end].Start < added.Start {
+			added.Start = crw.available[end].Start
+		}
+		if crw.available[end].End > added.End {
+			added.End = crw.available[end].End
+		}
+		end++
+	}
+
+	available := append(crw.available[:idx:idx], added)
+	crw.available = append(available, crw.available[end:]...)
+}
+
+// availableAt returns the number of contiguous bytes available from off. The
+// lock must be held.
+func (crw *ConcurrentReadWriter) availableAt(off int64) int64 {
+	idx := sort.Search(len(crw.available), func(i int) bool {
+		return crw.available[i].End > off
+	})
+	if idx < len(crw.available) && crw.available[idx].Start <= off {
+		return crw.available[idx].End - off
+	}
+
+	return 0
+}
+
+// wait blocks until data is available from off, the reader has been closed,
+// or the ConcurrentReadWriter has been closed. It returns the number of
+// contiguous bytes available from off and the generation of the data, or the
+// error readers should return if no more data will be written, or the data
+// they've read has been discarded.
+func (crw *ConcurrentReadWriter) wait(r *reader, off int64) (int64, uint64, error) {
+	crw.lock.Lock()
+	defer crw.lock.Unlock()
+
+	for {
+		if r.read && r.generation != crw.generation {
+			return 0, 0, crw.rewindErr
+		}
+		if available := crw.availableAt(off); available > 0 {
+			return available, crw.generation, nil
+		}
+		if r.isClosed() {
+			return 0, 0, io.EOF
+		}
+		if crw.closed {
+			if crw.err != nil {
+				return 0, 0, crw.err
+			}
+			return 0, 0, io.EOF
+		}
+
+		crw.wake.Wait()
+	}
+}
+
+// rewound returns whether data of the given generation has been discarded.
+func (crw *ConcurrentReadWriter) rewound(generation uint64) bool {
+	crw.lock.Lock()
+	defer crw.lock.Unlock()
+
+	return crw.generation != generation
+}
+
+// markRead records that r has returned data of the given generation, so that
+// it fails if the data is rewound.
+func (crw *ConcurrentReadWriter) markRead(r *reader, generation uint64) {
+	crw.lock.Lock()
+	defer crw.lock.Unlock()
+
+	r.read, r.generation = true, generation
 }
 
 // Reader returns an io.Reader that can be used to read data as it is being
@@ -86,15 +312,39 @@ func (crw *ConcurrentReadWriter) Reader() ReadAtReadCloser {
 		return nil
 	}
 
+	crw.lock.Lock()
+	crw.readers++
+	crw.lock.Unlock()
+
 	crw.wg.Add(1)
 	return &reader{crw: crw}
 }
 
+// Readers returns the number of readers that haven't been closed.
+func (crw *ConcurrentReadWriter) Readers() int {
+	crw.lock.Lock()
+	defer crw.lock.Unlock()
+
+	return crw.readers
+}
+
 type reader struct {
 	lock   sync.RWMutex
 	crw    *ConcurrentReadWriter
 	offset int64
 	closed bool
+
+	// read is set once the reader has returned data, of the given
+	// generation. They're guarded by the ConcurrentReadWriter's lock.
+	read       bool
+	generation uint64
+}
+
+func (r *reader) isClosed() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.closed
 }
 
 func (r *reader) Read(p []byte) (n int, err error) {
@@ -112,35 +362,83 @@ func (r *reader) Read(p []byte) (n int, err error) {
 }
 
 func (r *reader) ReadAt(p []byte, off int64) (n int, err error) {
-	var read int
-	for {
-		r.lock.RLock()
-		readerClosed := r.closed
-		r.lock.RUnlock()
+	return r.readAt(p, off, false)
+}
+
+// ReadAvailableAt is like ReadAt, but returns as soon as some data at off has
+// been written, rather than waiting for all of p to be. n is less than len(p)
+// without an error if no more data has been written yet.
+func (r *reader) ReadAvailableAt(p []byte, off int64) (n int, err error) {
+	return r.readAt(p, off, true)
+}
+
+// readAt reads into p from off, returning once p is filled or, if some is
+// set, once anything has been read.
+func (r *reader) readAt(p []byte, off int64, some bool) (n int, err error) {
+	buf := p
+
+	// generation is that of the data read into p so far
+	var generation uint64
+	defer func() {
+		if n > 0 {
+			r.crw.markRead(r, generation)
+		}
+	}()
 
-		if readerClosed {
+	for len(p) > 0 {
+		if some && n > 0 {
+			return n, nil
+		}
+
+		if r.isClosed() {
 			return 0, io.EOF
 		}
 
-		read, err = r.crw.r.ReadAt(p, off+int64(n))
-		n += read
-		s := len(p)
-		p = p[read:]
+		// wait for data to be written at the offset, only reading what has
+		// been marked as available
+		var available int64
+		var current uint64
+		available, current, err = r.crw.wait(r, off+int64(n))
+		if err != nil {
+			if r.isClosed() {
+				return 0, io.EOF
+			}
+			return n, err
+		}
 
-		// fill scratch buffer until we EOF
-		if err == nil && len(p) != s {
+		// the data read into p so far has been discarded, start again
+		if n > 0 && current != generation {
+			n, p = 0, buf
 			continue
 		}
+		generation = current
 
-		// on EOF wait to for additional data if read/writer hasn't been closed
-		if err == io.EOF {
-			if !r.crw.Closed() {
-				r.crw.wait()
-				continue
-			}
+		next := p
+		if int64(len(next)) > available {
+			next = next[:available]
+		}
+
+		var read int
+		read, err = r.crw.r.ReadAt(next, off+int64(n))
+
+		// data read whilst it was being rewound may be from either side of
+		// the rewind, so it's read again
+		if r.crw.rewound(generation) {
+			continue
+		}
+
+		n += read
+		p = p[read:]
+
+		if err != nil && err != io.EOF {
+			return
+		}
+		if read == 0 {
+			return n, io.ErrUnexpectedEOF
 		}
-		return
 	}
+
+	return n, nil
 }
 
 func (r *reader) Close() error {
@@ -152,6 +450,12 @@ func (r *reader) Close() error {
 	r.closed = true
 	r.lock.Unlock()
 
+	// wake the reader if it is waiting for data
+	r.crw.lock.Lock()
+	r.crw.readers--
+	r.crw.wake.Broadcast()
+	r.crw.lock.Unlock()
+
 	r.crw.wg.Done()
 	return nil
 }
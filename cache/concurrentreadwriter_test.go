@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
@@ -59,3 +60,189 @@ func TestConcurrentReadWriter(t *testing.T) {
 	}
 	crw.Close()
 }
+
+func TestConcurrentReadWriterWriteAt(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	crw := NewConcurrentReadWriter(f)
+
+	done := make(chan []byte)
+	go func() {
+		r := crw.Reader()
+		defer r.Close()
+
+		p := make([]byte, 4)
+		n, _ := r.ReadAt(p, 2)
+		done <- p[:n]
+	}()
+
+	// write out of order, the reader must only return once the hole is filled
+	_, err = crw.WriteAt([]byte{4, 5, 6, 7}, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []Range{{4, 8}}, crw.Available())
+
+	select {
+	case <-done:
+		t.Fatal("read returned before data was available")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	_, err = crw.WriteAt([]byte{0, 1, 2, 3}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []Range{{0, 8}}, crw.Available())
+	assert.Equal(t, []byte{2, 3, 4, 5}, <-done)
+
+	require.NoError(t, crw.Close())
+}
+
+func TestConcurrentReadWriterAvailable(t *testing.T) {
+	crw := NewConcurrentReadWriter(nil)
+
+	crw.markAvailable(10, 5)
+	crw.markAvailable(30, 5)
+	crw.markAvailable(0, 2)
+	assert.Equal(t, []Range{{0, 2}, {10, 15}, {30, 35}}, crw.Available())
+
+	crw.markAvailable(15, 5)
+	assert.Equal(t, []Range{{0, 2}, {10, 20}, {30, 35}}, crw.Available())
+
+	crw.markAvailable(1, 32)
+	assert.Equal(t, []Range{{0, 35}}, crw.Available())
+
+	assert.Equal(t, int64(25), crw.availableAt(10))
+	assert.Equal(t, int64(0), crw.availableAt(35))
+}
+
+func TestConcurrentReadWriterReadAvailableAt(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	crw := NewConcurrentReadWriter(f)
+	r := crw.Reader().(*reader)
+	defer r.Close()
+
+	_, err = crw.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	// only the data written so far is read
+	p := make([]byte, 10)
+	n, err := r.ReadAvailableAt(p, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "ello", string(p[:n]))
+
+	// reading past the data written waits for more
+	read := make(chan string)
+	go func() {
+		n, _ := r.ReadAvailableAt(p, 5)
+		read <- string(p[:n])
+	}()
+	select {
+	case <-read:
+		t.Fatal("read returned before data was written")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = crw.Write([]byte(" world"))
+	require.NoError(t, err)
+	assert.Equal(t, " world", <-read)
+
+	// close waits for the reader, which reads to the end of the data
+	closed := make(chan error)
+	go func() {
+		closed <- crw.Close()
+	}()
+	_, err = r.ReadAvailableAt(p, 11)
+	assert.Equal(t, io.EOF, err)
+	require.NoError(t, r.Close())
+	require.NoError(t, <-closed)
+}
+
+func TestConcurrentReadWriterRewind(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	crw := NewConcurrentReadWriter(f)
+	_, err = crw.Write([]byte("hello world"))
+	require.NoError(t, err)
+
+	// a reader that has read data before the rewind can't take it back
+	discarded := crw.Reader()
+	p := make([]byte, 5)
+	_, err = discarded.Read(p)
+	require.NoError(t, err)
+
+	failed := errors.New("failed")
+	require.NoError(t, crw.Rewind(failed))
+	assert.Empty(t, crw.Available())
+	assert.Equal(t, int64(0), crw.Offset())
+
+	// the discarded data is truncated
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), fi.Size())
+
+	// readers wait for the data to be written again
+	r := crw.Reader()
+	read := make(chan string)
+	go func() {
+		p := make([]byte, 5)
+		n, _ := r.ReadAt(p, 0)
+		read <- string(p[:n])
+	}()
+	select {
+	case <-read:
+		t.Fatal("read returned discarded data")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, err = crw.Write([]byte("world"))
+	require.NoError(t, err)
+	assert.Equal(t, "world", <-read)
+	require.NoError(t, r.Close())
+
+	// rather than reading the data written since, it fails
+	_, err = discarded.Read(p)
+	assert.Equal(t, failed, err)
+	require.NoError(t, discarded.Close())
+
+	// without an error, it fails with ErrRewound
+	r = crw.Reader()
+	_, err = r.Read(p)
+	require.NoError(t, err)
+	require.NoError(t, crw.Rewind(nil))
+	_, err = r.Read(p)
+	assert.Equal(t, ErrRewound, err)
+	require.NoError(t, r.Close())
+}
+
+func TestConcurrentReadWriterCloseWithError(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	crw := NewConcurrentReadWriter(f)
+	r := crw.Reader()
+
+	done := make(chan error)
+	go func() {
+		defer r.Close()
+
+		data, err := ioutil.ReadAll(r)
+		assert.Equal(t, []byte("foo"), data)
+		done <- err
+	}()
+
+	_, err = crw.Write([]byte("foo"))
+	require.NoError(t, err)
+
+	// a reader of a failed write gets the error rather than EOF
+	failed := errors.New("failed")
+	go crw.CloseWithError(failed)
+	assert.Equal(t, failed, <-done)
+}
@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ErrDiskUsageUnsupported is returned by DiskUsage on platforms where the
+// filesystem usage can't be determined.
+var ErrDiskUsageUnsupported = errors.New("disk usage is unsupported on this platform")
+
+// DiskUsage reports the size and usage, in bytes, of the filesystem holding
+// the cache directory. Free is the space available to unprivileged users.
+type DiskUsage struct {
+	Total uint64
+	Used  uint64
+	Free  uint64
+}
+
+// DiskUsage returns the usage of the filesystem holding the cache directory.
+func (fc *FilesystemCache) DiskUsage() (DiskUsage, error) {
+	return diskUsage(fc.directory)
+}
+
+// Probe checks that the cache can still be written to, by writing and
+// removing a small file in both the temp and objects directories, such as to
+// detect a network mount that has become read-only or gone away. The probe
+// files are dot prefixed, so they're ignored by the index.
+func (fc *FilesystemCache) Probe() error {
+	for _, dir := range []string{fc.tempDir, filepath.Join(fc.directory, DirObjects)} {
+		if err := probe(dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func probe(dir string) error {
+	f, err := ioutil.TempFile(dir, ".probe-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("probe")
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(f.Name())
+}
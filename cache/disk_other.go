@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package cache
+
+func diskUsage(path string) (DiskUsage, error) {
+	return DiskUsage{}, ErrDiskUsageUnsupported
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package cache
+
+import "syscall"
+
+func diskUsage(path string) (DiskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return DiskUsage{}, err
+	}
+
+	bsize := uint64(st.Bsize)
+	return DiskUsage{
+		Total: uint64(st.Blocks) * bsize,
+		Used:  (uint64(st.Blocks) - uint64(st.Bfree)) * bsize,
+		Free:  uint64(st.Bavail) * bsize,
+	}, nil
+}
@@ -0,0 +1,29 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir)
+	require.NoError(t, err)
+
+	usage, err := c.DiskUsage()
+	if err == ErrDiskUsageUnsupported {
+		t.Skip(err)
+	}
+	require.NoError(t, err)
+
+	assert.NotZero(t, usage.Total)
+	assert.True(t, usage.Used <= usage.Total)
+	assert.True(t, usage.Free <= usage.Total)
+}
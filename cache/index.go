@@ -0,0 +1,403 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IndexMode controls how the object index is built at startup.
+type IndexMode string
+
+// Index modes:
+// - IndexModeEager (walk the cache directory before returning the cache)
+// - IndexModeLazy (walk the cache directory in the background)
+const (
+	IndexModeEager IndexMode = "eager"
+	IndexModeLazy  IndexMode = "lazy"
+)
+
+// IndexStats reports the number and total size of indexed objects.
+type IndexStats struct {
+	Objects  int
+	Bytes    int64
+	Complete bool
+}
+
+// ObjectInfo describes a cached object.
+type ObjectInfo struct {
+	Key      string
+	Size     int64
+	Accessed time.Time
+	Pinned   bool
+}
+
+type indexEntry struct {
+	size     int64
+	accessed time.Time
+	accesses int64
+}
+
+// index is an in-memory record of the objects stored on disk.
+type index struct {
+	lock    sync.RWMutex
+	entries map[string]indexEntry
+	bytes   int64
+
+	// keys holds the keys in sorted order for listing. Keys added since
+	// the last listing are held in added until they're merged in, and
+	// removed keys are dropped once removed is set.
+	keys    []string
+	added   []string
+	removed bool
+
+	// pinned holds the keys of pinned objects, which may not have been
+	// indexed yet
+	pinned map[string]bool
+
+	// extension is the file extension of objects, which isn't part of
+	// their key
+	extension string
+
+	// accessed holds the access times persisted by a previous run, used in
+	// place of modification times whilst walking
+	accessed map[string]time.Time
+
+	// changed is set when entries change, and reset when access times are
+	// persisted
+	changed bool
+
+	done chan struct{}
+	err  error
+}
+
+func newIndex() *index {
+	return &index{
+		entries: make(map[string]indexEntry),
+		pinned:  make(map[string]bool),
+		done:    make(chan struct{}),
+	}
+}
+
+func (idx *index) add(key string, size int64, accessed time.Time) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	if entry, ok := idx.entries[key]; ok {
+		idx.bytes -= entry.size
+	} else {
+		idx.added = append(idx.added, key)
+	}
+	idx.entries[key] = indexEntry{size: size, accessed: accessed}
+	idx.bytes += size
+	idx.changed = true
+}
+
+// touch records an access of an indexed object, returning false if the object
+// isn't indexed.
+func (idx *index) touch(key string) bool {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	entry, ok := idx.entries[key]
+	if ok {
+		entry.accessed = time.Now()
+		entry.accesses++
+		idx.entries[key] = entry
+		idx.changed = true
+	}
+	return ok
+}
+
+// accesses returns the number of times an indexed object has been touched.
+func (idx *index) accesses(key string) int64 {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	return idx.entries[key].accesses
+}
+
+// list returns up to limit objects with keys after the given key, in key
+// order.
+func (idx *index) list(after string, limit int) []ObjectInfo {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	idx.sortKeys()
+
+	start := sort.SearchStrings(idx.keys, after)
+	if start < len(idx.keys) && idx.keys[start] == after {
+		start++
+	}
+	end := start + limit
+	if end > len(idx.keys) {
+		end = len(idx.keys)
+	}
+
+	objects := make([]ObjectInfo, 0, end-start)
+	for _, key := range idx.keys[start:end] {
+		entry := idx.entries[key]
+		objects = append(objects, ObjectInfo{Key: key, Size: entry.size, Accessed: entry.accessed, Pinned: idx.pinned[key]})
+	}
+
+	return objects
+}
+
+// sortKeys merges the keys added since the last listing into the sorted keys,
+// dropping those that have since been removed, so that listing a page only
+// costs a search rather than sorting every key. The lock must be held.
+func (idx *index) sortKeys() {
+	if len(idx.added) == 0 && !idx.removed {
+		return
+	}
+	sort.Strings(idx.added)
+
+	keys := make([]string, 0, len(idx.entries))
+	for i, j := 0, 0; i < len(idx.keys) || j < len(idx.added); {
+		var key string
+		if j == len(idx.added) || (i < len(idx.keys) && idx.keys[i] < idx.added[j]) {
+			key = idx.keys[i]
+			i++
+		} else {
+			key = idx.added[j]
+			j++
+		}
+
+		// a key removed and added again is in both
+		if _, ok := idx.entries[key]; !ok || (len(keys) > 0 && keys[len(keys)-1] == key) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	idx.keys, idx.added, idx.removed = keys, nil, false
+}
+
+func (idx *index) remove(key string) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	if entry, ok := idx.entries[key]; ok {
+		idx.bytes -= entry.size
+		delete(idx.entries, key)
+		delete(idx.pinned, key)
+		idx.changed = true
+		idx.removed = true
+	}
+}
+
+// pin marks key as pinned or unpinned, returning the pinned keys.
+func (idx *index) pin(key string, pinned bool) []string {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	if pinned {
+		idx.pinned[key] = true
+	} else {
+		delete(idx.pinned, key)
+	}
+
+	keys := make([]string, 0, len(idx.pinned))
+	for key := range idx.pinned {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// leastRecent returns up to limit unpinned objects, least recently accessed
+// first.
+func (idx *index) leastRecent(limit int) []ObjectInfo {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	objects := make([]ObjectInfo, 0, len(idx.entries))
+	for key, entry := range idx.entries {
+		if idx.pinned[key] {
+			continue
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: entry.size, Accessed: entry.accessed})
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if !objects[i].Accessed.Equal(objects[j].Accessed) {
+			return objects[i].Accessed.Before(objects[j].Accessed)
+		}
+		return objects[i].Key < objects[j].Key
+	})
+
+	if len(objects) > limit {
+		objects = objects[:limit]
+	}
+	return objects
+}
+
+// accessTimes returns the access time of every object if entries have
+// changed since the last call, marking them unchanged.
+func (idx *index) accessTimes() (map[string]time.Time, bool) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	if !idx.changed {
+		return nil, false
+	}
+	idx.changed = false
+
+	accessed := make(map[string]time.Time, len(idx.entries))
+	for key, entry := range idx.entries {
+		accessed[key] = entry.accessed
+	}
+	return accessed, true
+}
+
+func (idx *index) has(key string) bool {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	_, ok := idx.entries[key]
+	return ok
+}
+
+func (idx *index) complete() bool {
+	select {
+	case <-idx.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (idx *index) stats() IndexStats {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	return IndexStats{
+		Objects:  len(idx.entries),
+		Bytes:    idx.bytes,
+		Complete: idx.complete(),
+	}
+}
+
+// walk indexes all objects found in the objects directory. Objects added
+// whilst walking are preserved.
+//
+// The directory's top-level subdirectories, the key prefix shards of the
+// sharded filenamer, are walked concurrently by the given number of workers.
+func (idx *index) walk(directory string, workers int) {
+	defer func() {
+		idx.accessed = nil
+		close(idx.done)
+	}()
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		idx.err = err
+		return
+	}
+
+	var (
+		wg     sync.WaitGroup
+		errs   = make(chan error, workers)
+		shards = make(chan string)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var err error
+			for shard := range shards {
+				if err == nil {
+					err = filepath.Walk(shard, idx.visit)
+				}
+			}
+			errs <- err
+		}()
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(directory, entry.Name())
+		if entry.IsDir() {
+			shards <- path
+			continue
+		}
+
+		// objects stored flat in the objects directory
+		if err := idx.visit(path, entry, nil); err != nil && idx.err == nil {
+			idx.err = err
+		}
+	}
+	close(shards)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil && idx.err == nil {
+			idx.err = err
+		}
+	}
+}
+
+// visit indexes the file at path, it is a filepath.WalkFunc.
+func (idx *index) visit(path string, info os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") || !strings.HasSuffix(info.Name(), idx.extension) {
+		return nil
+	}
+
+	// filesystem access times aren't reliable, as they're often disabled
+	// by noatime mounts, so the access time persisted by a previous run is
+	// used, or the modification time until the object is next accessed
+	key := strings.TrimSuffix(filepath.Base(path), idx.extension)
+	accessed := info.ModTime()
+	if persisted, ok := idx.accessed[key]; ok && persisted.After(accessed) {
+		accessed = persisted
+	}
+	if !idx.has(key) {
+		idx.add(key, info.Size(), accessed)
+	}
+	return nil
+}
+
+// IndexStats returns the number and total size of objects in the cache. The
+// stats are incomplete until the startup index walk has finished.
+func (fc *FilesystemCache) IndexStats() IndexStats {
+	return fc.index.stats()
+}
+
+// Indexed returns a channel that is closed once the startup index walk has
+// finished.
+func (fc *FilesystemCache) Indexed() <-chan struct{} {
+	return fc.index.done
+}
+
+// IndexErr returns the error, if any, encountered by the startup index walk.
+// It must only be called once the walk has finished.
+func (fc *FilesystemCache) IndexErr() error {
+	return fc.index.err
+}
+
+// Objects returns up to limit cached objects with keys after the given key,
+// in key order, for paginating through the cache, along with whether they're
+// pinned. Objects are missing until the startup index walk has reached them.
+func (fc *FilesystemCache) Objects(after string, limit int) []ObjectInfo {
+	return fc.index.list(after, limit)
+}
+
+// LeastRecentlyUsed returns up to limit cached objects, least recently
+// accessed first, which is the order to evict them in. Pinned objects are
+// never evicted, and aren't returned. Access times are recorded in memory on
+// each disk hit, rather than relying on the filesystem's access times.
+func (fc *FilesystemCache) LeastRecentlyUsed(limit int) []ObjectInfo {
+	return fc.index.leastRecent(limit)
+}
@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Metadata describes a cached object beyond what the filesystem records. It
+// is stored alongside the object, as a JSON file in the metadata directory.
+type Metadata struct {
+	// FetchedAt is when the object was cached.
+	FetchedAt time.Time `json:"fetched_at"`
+
+	// Upstream is the URL the object was fetched from, without its query,
+	// which may hold credentials for presigned URLs.
+	Upstream string `json:"upstream,omitempty"`
+
+	// ETag is the upstream's entity tag for the object, if it sent one.
+	ETag string `json:"etag,omitempty"`
+
+	// Size is the object's size in bytes.
+	Size int64 `json:"size"`
+
+	// Accesses is the number of times the object has been read from disk
+	// since the cache was opened. It isn't stored.
+	Accesses int64 `json:"-"`
+}
+
+// Metadata returns the metadata of the cached object for key. Objects cached
+// before metadata was recorded only report their size. ErrKeyNotFound is
+// returned if the object isn't cached.
+func (fc *FilesystemCache) Metadata(key string) (Metadata, error) {
+	fi, err := os.Stat(fc.objectPath(key))
+	if os.IsNotExist(err) {
+		return Metadata{}, ErrKeyNotFound
+	}
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	md, err := fc.readMetadata(key)
+	if err != nil {
+		return Metadata{}, err
+	}
+	md.Size = fi.Size()
+	md.Accesses = fc.index.accesses(key)
+
+	return md, nil
+}
+
+// UpdateMetadata records changes made by update to the metadata of the cached
+// object for key, such as details of the fetch that are only known to the
+// writer. ErrKeyNotFound is returned if the object isn't cached.
+func (fc *FilesystemCache) UpdateMetadata(key string, update func(md *Metadata)) error {
+	fc.metadataLock.Lock()
+	defer fc.metadataLock.Unlock()
+
+	if _, err := os.Stat(fc.objectPath(key)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrKeyNotFound
+		}
+		return err
+	}
+
+	md, err := fc.readMetadata(key)
+	if err != nil {
+		return err
+	}
+	update(&md)
+
+	return fc.writeMetadata(key, md)
+}
+
+// metadataPath returns the path of the metadata file for key, which mirrors
+// the object's path under the metadata directory.
+func (fc *FilesystemCache) metadataPath(key string) string {
+	return filepath.Join(fc.directory, DirMetadata, fc.ObjectName(key)+".json")
+}
+
+// readMetadata reads the metadata file for key, returning empty metadata if
+// there isn't one.
+func (fc *FilesystemCache) readMetadata(key string) (Metadata, error) {
+	var md Metadata
+
+	buf, err := ioutil.ReadFile(fc.metadataPath(key))
+	if os.IsNotExist(err) {
+		return md, nil
+	}
+	if err != nil {
+		return md, err
+	}
+
+	return md, json.Unmarshal(buf, &md)
+}
+
+// writeMetadata replaces the metadata file for key.
+func (fc *FilesystemCache) writeMetadata(key string, md Metadata) error {
+	buf, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+
+	return fc.writeFile(fc.metadataPath(key), buf)
+}
+
+// writeFile replaces the file name with buf. It's written to a dot prefixed
+// temporary file that's renamed into place, so readers never see a partial
+// file.
+func (fc *FilesystemCache) writeFile(name string, buf []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), fc.dirMode); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+"-")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Chmod(fc.fileMode)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// cached records the metadata of a newly cached object, replacing that of
+// any previous copy.
+func (fc *FilesystemCache) cached(key string, md Metadata) error {
+	fc.metadataLock.Lock()
+	defer fc.metadataLock.Unlock()
+
+	md.FetchedAt = time.Now().UTC()
+	return fc.writeMetadata(key, md)
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir)
+	require.NoError(t, err)
+
+	_, err = c.Metadata("foobar")
+	require.Equal(t, ErrKeyNotFound, err)
+	require.Equal(t, ErrKeyNotFound, c.UpdateMetadata("foobar", func(md *Metadata) {}))
+
+	cr, cw, _, err := c.Get("foobar")
+	require.NoError(t, err)
+	_, err = cw.Write([]byte("foobar"))
+	require.NoError(t, err)
+	require.NoError(t, cr.Close())
+	require.NoError(t, c.Done("foobar", nil))
+
+	md, err := c.Metadata("foobar")
+	require.NoError(t, err)
+	require.False(t, md.FetchedAt.IsZero())
+	require.Equal(t, int64(6), md.Size)
+	require.Empty(t, md.Upstream)
+
+	require.NoError(t, c.UpdateMetadata("foobar", func(md *Metadata) {
+		md.Upstream = "https://example.com/foobar"
+		md.ETag = `"abc"`
+	}))
+
+	for i := 0; i < 2; i++ {
+		r, _, source, err := c.Get("foobar")
+		require.NoError(t, err)
+		require.Equal(t, SourceDisk, source)
+		require.NoError(t, r.Close())
+	}
+
+	// metadata persists across instances, access counts don't
+	fetched := md.FetchedAt
+	md, err = c.Metadata("foobar")
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/foobar", md.Upstream)
+	require.Equal(t, `"abc"`, md.ETag)
+	require.Equal(t, int64(2), md.Accesses)
+
+	c, err = NewFilesystemCache(dir)
+	require.NoError(t, err)
+	md, err = c.Metadata("foobar")
+	require.NoError(t, err)
+	require.True(t, fetched.Equal(md.FetchedAt))
+	require.Equal(t, `"abc"`, md.ETag)
+	require.Equal(t, int64(0), md.Accesses)
+
+	// quarantining the object removes its metadata
+	fi, err := os.Stat(c.objectPath("foobar"))
+	require.NoError(t, err)
+	require.NoError(t, c.Quarantine("foobar", fi))
+	_, err = os.Stat(c.metadataPath("foobar"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestDoneWithMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir)
+	require.NoError(t, err)
+
+	cr, cw, _, err := c.Get("foobar")
+	require.NoError(t, err)
+	_, err = cw.Write([]byte("foobar"))
+	require.NoError(t, err)
+	require.NoError(t, cr.Close())
+	require.NoError(t, c.DoneWithMetadata("foobar", nil, Metadata{Upstream: "https://example.com/foobar", Size: 1}))
+
+	md, err := c.Metadata("foobar")
+	require.NoError(t, err)
+	require.False(t, md.FetchedAt.IsZero())
+	require.Equal(t, int64(6), md.Size)
+	require.Equal(t, "https://example.com/foobar", md.Upstream)
+
+	// failed writes don't record metadata
+	cr, _, _, err = c.Get("failed")
+	require.NoError(t, err)
+	require.NoError(t, cr.Close())
+	require.NoError(t, c.DoneWithMetadata("failed", errors.New("failed"), Metadata{Upstream: "https://example.com/failed"}))
+	_, err = os.Stat(c.metadataPath("failed"))
+	require.True(t, os.IsNotExist(err))
+}
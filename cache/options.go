@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"os"
+	"time"
+)
+
+// Default permission modes used when creating cache directories and files.
+const (
+	DefaultDirMode  os.FileMode = 0700
+	DefaultFileMode os.FileMode = 0600
+)
+
+// Option configures a FilesystemCache.
+type Option func(*FilesystemCache)
+
+// WithDirMode sets the permission mode used when creating cache directories.
+func WithDirMode(mode os.FileMode) Option {
+	return func(fc *FilesystemCache) {
+		fc.dirMode = mode
+	}
+}
+
+// WithFileMode sets the permission mode used when creating cache files.
+func WithFileMode(mode os.FileMode) Option {
+	return func(fc *FilesystemCache) {
+		fc.fileMode = mode
+	}
+}
+
+// WithFilenamer sets the function used to name cached files on disk, see
+// FilesystemCache.Filenamer. The default is DefaultFilenamer.
+func WithFilenamer(filenamer func(key string) string) Option {
+	return func(fc *FilesystemCache) {
+		fc.Filenamer = filenamer
+	}
+}
+
+// WithIndexMode sets how the object index is built at startup. The default is
+// IndexModeLazy.
+func WithIndexMode(mode IndexMode) Option {
+	return func(fc *FilesystemCache) {
+		fc.indexMode = mode
+	}
+}
+
+// WithIndexWorkers sets the number of workers that walk the cache directory
+// concurrently when building the index. Each top-level shard directory is
+// walked by a single worker, so more workers than shards has no benefit. The
+// default is 1.
+func WithIndexWorkers(workers int) Option {
+	return func(fc *FilesystemCache) {
+		fc.indexWorkers = workers
+	}
+}
+
+// WithKeepPartial keeps the partially downloaded file of a fetch that failed
+// with a retryable error, so that it can be resumed. Kept partials are moved
+// to the partials subdirectory of the temp directory, and those that haven't
+// been resumed within ttl are removed.
+func WithKeepPartial(ttl time.Duration) Option {
+	return func(fc *FilesystemCache) {
+		fc.partialTTL = ttl
+	}
+}
+
+// WithPromotionHook sets a function called each time a completed download
+// has been moved from the temp directory into the cache directory, with the
+// time the move took.
+func WithPromotionHook(hook func(key string, took time.Duration, err error)) Option {
+	return func(fc *FilesystemCache) {
+		fc.promoted = hook
+	}
+}
+
+// WithTempDirectory sets the directory in-progress downloads are written to.
+// It defaults to the tmp subdirectory of the cache directory. If it is on a
+// different filesystem, completed downloads are copied rather than renamed
+// into the cache directory.
+func WithTempDirectory(directory string) Option {
+	return func(fc *FilesystemCache) {
+		fc.tempDir = directory
+	}
+}
+
+// WithSharedDirectory is used when the cache directory is shared by multiple
+// processes, such as on a network filesystem. Fetches are only coordinated
+// within a process, but as each fetch writes to a uniquely named temporary
+// file, processes fetching the same object at the same time each rename
+// their complete copy into place. Partial files left by a previous run aren't
+// resumed, as they can't be told apart from other processes' fetches that
+// are in progress.
+func WithSharedDirectory() Option {
+	return func(fc *FilesystemCache) {
+		fc.shared = true
+	}
+}
+
+// WithMaxInflightReaders limits the number of concurrent readers of each
+// inflight key, bounding the number of requests blocked waiting on a single
+// fetch. Get returns ErrTooManyReaders once the limit is reached. Objects on
+// disk have no limit.
+func WithMaxInflightReaders(readers int) Option {
+	return func(fc *FilesystemCache) {
+		fc.maxReaders = readers
+	}
+}
+
+// WithMaxInflightDuration fails inflight keys whose writer hasn't called
+// Done within duration, such as when a fetch hangs. The writer is closed,
+// readers are passed ErrInflightExpired, the temporary file is removed and
+// the key can be fetched again.
+func WithMaxInflightDuration(duration time.Duration) Option {
+	return func(fc *FilesystemCache) {
+		fc.maxInflight = duration
+	}
+}
+
+// WithObjectExtension appends extension, such as ".bin", to the names of
+// cached files, so that other software can recognise them. It isn't part of
+// the key: the index and Export ignore files without it, and strip it to
+// recover keys. Changing the extension of an existing cache directory leaves
+// the objects already cached unused.
+func WithObjectExtension(extension string) Option {
+	return func(fc *FilesystemCache) {
+		fc.extension = extension
+	}
+}
+
+// WithAccessTimesInterval persists the access times recorded by the index
+// every interval, and when SaveAccessTimes is called, to a file in the cache
+// directory. They're used in place of modification times when the cache is
+// next indexed, so that the least recently used order survives restarts
+// approximately, without updating the filesystem on every access.
+func WithAccessTimesInterval(interval time.Duration) Option {
+	return func(fc *FilesystemCache) {
+		fc.saveInterval = interval
+	}
+}
@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// partialSweepInterval is the maximum interval between sweeps of abandoned
+// partial files.
+const partialSweepInterval = time.Minute
+
+// partial is a partial file kept for resuming a fetch.
+type partial struct {
+	name string
+	kept time.Time
+}
+
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string { return e.err.Error() }
+func (e retryableError) Unwrap() error { return e.err }
+
+// Retryable marks an error passed to Done as retryable, indicating that the
+// data written so far is valid and the fetch can be resumed.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return retryableError{err}
+}
+
+// IsRetryable returns whether an error has been marked with Retryable.
+func IsRetryable(err error) bool {
+	var re retryableError
+	return errors.As(err, &re)
+}
+
+// Partial returns the size of a partial file kept for a key, and whether
+// there is one.
+func (fc *FilesystemCache) Partial(key string) (int64, bool) {
+	fc.lock.RLock()
+	kept, ok := fc.partials[key]
+	fc.lock.RUnlock()
+
+	if !ok {
+		return 0, false
+	}
+
+	fi, err := os.Stat(kept.name)
+	if err != nil {
+		return 0, false
+	}
+
+	return fi.Size(), true
+}
+
+// keepPartial moves the temporary file of a failed fetch for key into the
+// partials directory, and records it for resuming. A resumed partial is
+// already there. It must be called with the lock held.
+func (fc *FilesystemCache) keepPartial(key, temp string) error {
+	name := filepath.Join(fc.tempDir, DirPartials, filepath.Base(temp))
+	if err := os.Rename(temp, name); err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	fc.partials[key] = partial{name: name, kept: time.Now()}
+	return nil
+}
+
+// loadPartials records the partial files left in the partials directory by a
+// previous run. The key of a partial is its name without the unique token
+// suffix. If a key has more than one partial, the largest is kept and the
+// others are removed.
+func (fc *FilesystemCache) loadPartials() {
+	dir := filepath.Join(fc.tempDir, DirPartials)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	sizes := make(map[string]int64)
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		key := fi.Name()
+		if i := strings.LastIndex(key, "."); i > 0 {
+			key = key[:i]
+		}
+		name := filepath.Join(dir, fi.Name())
+
+		if kept, ok := fc.partials[key]; ok {
+			if sizes[key] >= fi.Size() {
+				os.Remove(name)
+				continue
+			}
+			os.Remove(kept.name)
+		}
+		fc.partials[key] = partial{name: name, kept: fi.ModTime()}
+		sizes[key] = fi.Size()
+	}
+}
+
+// sweepPartials periodically removes partial files older than the partial
+// TTL.
+func (fc *FilesystemCache) sweepPartials() {
+	interval := fc.partialTTL
+	if interval > partialSweepInterval {
+		interval = partialSweepInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fc.lock.Lock()
+		for key, kept := range fc.partials {
+			if _, ok := fc.singleflight[key]; ok || time.Since(kept.kept) < fc.partialTTL {
+				continue
+			}
+
+			os.Remove(kept.name)
+			delete(fc.partials, key)
+		}
+		fc.lock.Unlock()
+	}
+}
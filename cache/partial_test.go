@@ -0,0 +1,225 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeepPartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir, WithKeepPartial(100*time.Millisecond))
+	require.NoError(t, err)
+
+	fail := func(key string, err error) {
+		cr, cw, _, gerr := c.Get(key)
+		require.NoError(t, gerr)
+		_, werr := cw.Write([]byte("foo"))
+		require.NoError(t, werr)
+		require.NoError(t, cr.Close())
+		require.NoError(t, c.Done(key, err))
+	}
+
+	fail("retryable", Retryable(errors.New("connection reset")))
+	fail("permanent", errors.New("checksum mismatch"))
+
+	size, ok := c.Partial("retryable")
+	require.True(t, ok)
+	require.Equal(t, int64(3), size)
+	require.Len(t, tempFiles(t, filepath.Join(dir, DirTemp, DirPartials), "retryable"), 1)
+
+	_, ok = c.Partial("permanent")
+	require.False(t, ok)
+	require.Empty(t, tempFiles(t, filepath.Join(dir, DirTemp), "permanent"))
+
+	// abandoned partials are swept
+	require.Eventually(t, func() bool {
+		return len(tempFiles(t, filepath.Join(dir, DirTemp, DirPartials), "retryable")) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, ok = c.Partial("retryable")
+	require.False(t, ok)
+}
+
+func TestResumePartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir, WithKeepPartial(time.Hour))
+	require.NoError(t, err)
+
+	cr, cw, _, err := c.Get("key")
+	require.NoError(t, err)
+	_, err = cw.Write([]byte("foo"))
+	require.NoError(t, err)
+	require.NoError(t, cr.Close())
+	require.NoError(t, c.Done("key", Retryable(errors.New("connection reset"))))
+
+	// the next fetch appends to the data kept, which readers can read
+	cr, cw, source, err := c.Get("key")
+	require.NoError(t, err)
+	require.Equal(t, SourceFresh, source)
+	require.Equal(t, int64(3), cw.(*ConcurrentReadWriter).Offset())
+
+	_, err = cw.Write([]byte("bar"))
+	require.NoError(t, err)
+
+	p := make([]byte, 6)
+	_, err = io.ReadFull(cr, p)
+	require.NoError(t, err)
+	require.Equal(t, "foobar", string(p))
+	require.NoError(t, cr.Close())
+	require.NoError(t, c.Done("key", nil))
+
+	_, ok := c.Partial("key")
+	require.False(t, ok)
+}
+
+func TestSharedDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a, err := NewFilesystemCache(dir, WithSharedDirectory(), WithKeepPartial(time.Hour))
+	require.NoError(t, err)
+	b, err := NewFilesystemCache(dir, WithSharedDirectory(), WithKeepPartial(time.Hour))
+	require.NoError(t, err)
+
+	// concurrent fetches of the same key by two processes use their own files
+	acr, acw, _, err := a.Get("foobar")
+	require.NoError(t, err)
+	bcr, bcw, _, err := b.Get("foobar")
+	require.NoError(t, err)
+
+	_, err = acw.Write([]byte("foo"))
+	require.NoError(t, err)
+	_, err = bcw.Write([]byte("foobar"))
+	require.NoError(t, err)
+
+	require.Len(t, tempFiles(t, filepath.Join(dir, DirTemp), "foobar"), 2)
+
+	// a partial is resumed by the process that kept it
+	require.NoError(t, acr.Close())
+	require.NoError(t, a.Done("foobar", Retryable(errors.New("connection reset"))))
+	size, ok := a.Partial("foobar")
+	require.True(t, ok)
+	require.Equal(t, int64(3), size)
+
+	acr, acw, _, err = a.Get("foobar")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), acw.(*ConcurrentReadWriter).Offset())
+	_, err = acw.Write([]byte("bar"))
+	require.NoError(t, err)
+	require.NoError(t, acr.Close())
+	require.NoError(t, a.Done("foobar", nil))
+
+	require.NoError(t, bcr.Close())
+	require.NoError(t, b.Done("foobar", nil))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, DirObjects, DefaultFilenamer("foobar")))
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), data)
+}
+
+func TestLoadPartials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir, WithKeepPartial(time.Hour))
+	require.NoError(t, err)
+
+	cr, cw, _, err := c.Get("key")
+	require.NoError(t, err)
+	_, err = cw.Write([]byte("foo"))
+	require.NoError(t, err)
+	require.NoError(t, cr.Close())
+	require.NoError(t, c.Done("key", Retryable(errors.New("connection reset"))))
+
+	// partials kept by a previous run are found by their key
+	c, err = NewFilesystemCache(dir, WithKeepPartial(time.Hour))
+	require.NoError(t, err)
+
+	size, ok := c.Partial("key")
+	require.True(t, ok)
+	require.Equal(t, int64(3), size)
+}
+
+func TestLoadDuplicatePartials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir, WithKeepPartial(time.Hour))
+	require.NoError(t, err)
+
+	for _, name := range []string{"key.1", "key.2", "key.3"} {
+		data := []byte("foo")
+		if name == "key.2" {
+			data = []byte("foobar")
+		}
+		require.NoError(t, ioutil.WriteFile(filepath.Join(c.TempDirectory(), DirPartials, name), data, 0600))
+	}
+
+	// the largest partial is kept, and the others are removed
+	c, err = NewFilesystemCache(dir, WithKeepPartial(time.Hour))
+	require.NoError(t, err)
+
+	size, ok := c.Partial("key")
+	require.True(t, ok)
+	require.Equal(t, int64(6), size)
+	require.Equal(t, []string{filepath.Join(c.TempDirectory(), DirPartials, "key.2")}, tempFiles(t, filepath.Join(c.TempDirectory(), DirPartials), "key"))
+}
+
+func TestPartialsIgnoreForeignFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the temp directory is shared with files that aren't the cache's
+	tmp := filepath.Join(dir, "shared")
+	require.NoError(t, os.MkdirAll(tmp, 0700))
+	foreign := []string{"foo.log", "foo.txt", "store-123"}
+	for _, name := range foreign {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, name), []byte(name), 0600))
+	}
+
+	c, err := NewFilesystemCache(dir, WithTempDirectory(tmp), WithKeepPartial(50*time.Millisecond))
+	require.NoError(t, err)
+
+	cr, cw, _, err := c.Get("key")
+	require.NoError(t, err)
+	_, err = cw.Write([]byte("foo"))
+	require.NoError(t, err)
+	require.NoError(t, cr.Close())
+	require.NoError(t, c.Done("key", Retryable(errors.New("connection reset"))))
+
+	// reloading only finds the cache's partial, which is swept after the TTL
+	c, err = NewFilesystemCache(dir, WithTempDirectory(tmp), WithKeepPartial(50*time.Millisecond))
+	require.NoError(t, err)
+	_, ok := c.Partial("key")
+	require.True(t, ok)
+	_, ok = c.Partial("foo")
+	require.False(t, ok)
+
+	require.Eventually(t, func() bool {
+		_, ok := c.Partial("key")
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, name := range foreign {
+		data, err := ioutil.ReadFile(filepath.Join(tmp, name))
+		require.NoError(t, err)
+		require.Equal(t, []byte(name), data)
+	}
+}
@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// pinsFile is the name of the file in the cache directory that the keys of
+// pinned objects are persisted to.
+const pinsFile = "pins.json"
+
+// loadPins reads the keys pinned by a previous run. A missing or unreadable
+// file leaves no objects pinned.
+func (fc *FilesystemCache) loadPins() {
+	buf, err := ioutil.ReadFile(filepath.Join(fc.directory, pinsFile))
+	if err != nil {
+		return
+	}
+
+	var keys []string
+	if err := json.Unmarshal(buf, &keys); err != nil {
+		return
+	}
+
+	for _, key := range keys {
+		fc.index.pinned[key] = true
+	}
+}
+
+// Pin pins or unpins the cached object for key. Pinned objects are never
+// returned by LeastRecentlyUsed, so they aren't evicted. Pins are persisted
+// to the cache directory, and survive a restart. ErrKeyNotFound is returned
+// if the object isn't cached.
+func (fc *FilesystemCache) Pin(key string, pinned bool) error {
+	fc.pinLock.Lock()
+	defer fc.pinLock.Unlock()
+
+	if _, err := os.Stat(fc.objectPath(key)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrKeyNotFound
+		}
+		return err
+	}
+
+	buf, err := json.Marshal(fc.index.pin(key, pinned))
+	if err != nil {
+		return err
+	}
+
+	return fc.writeFile(filepath.Join(fc.directory, pinsFile), buf)
+}
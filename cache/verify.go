@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Verify re-hashes the cached object for key, which must be the SHA-256 hex
+// digest of its content, and moves it to the quarantine directory if it
+// doesn't match. It returns whether the object was corrupt. Objects that are
+// no longer cached, or whose keys aren't digests, are skipped.
+//
+// Clients already reading a quarantined object are unaffected, and the next
+// request for it is fetched from the upstream again.
+func (fc *FilesystemCache) Verify(key string) (bool, error) {
+	if len(key) != sha256.Size*2 {
+		return false, nil
+	}
+
+	filename := fc.objectPath(key)
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+	if hex.EncodeToString(h.Sum(nil)) == key {
+		return false, nil
+	}
+
+	verified, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	return true, fc.quarantine(key, filename, verified)
+}
+
+// Quarantine moves the cached object for key to the quarantine directory,
+// such as when it's found to be corrupt other than by Verify. fi is the
+// object's file info as opened, the object isn't moved if it has since been
+// replaced.
+func (fc *FilesystemCache) Quarantine(key string, fi os.FileInfo) error {
+	return fc.quarantine(key, fc.objectPath(key), fi)
+}
+
+// quarantine moves a corrupt object out of the objects directory, keeping it
+// for inspection. The object isn't moved if it has since been replaced by a
+// new fetch.
+func (fc *FilesystemCache) quarantine(key, filename string, verified os.FileInfo) error {
+	dir := filepath.Join(fc.directory, DirQuarantine)
+	if err := os.MkdirAll(dir, fc.dirMode); err != nil {
+		return err
+	}
+
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	if fi, err := os.Stat(filename); err != nil || !os.SameFile(fi, verified) {
+		return nil
+	}
+
+	if err := move(filename, filepath.Join(dir, key), fc.fileMode); err != nil {
+		return err
+	}
+	fc.index.remove(key)
+
+	if err := os.Remove(fc.metadataPath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewFilesystemCache(dir, WithIndexMode(IndexModeEager))
+	require.NoError(t, err)
+
+	store := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		key := hex.EncodeToString(sum[:])
+
+		cr, cw, _, err := c.Get(key)
+		require.NoError(t, err)
+		_, err = cw.Write([]byte(content))
+		require.NoError(t, err)
+		require.NoError(t, cr.Close())
+		require.NoError(t, c.Done(key, nil))
+
+		return key
+	}
+
+	valid := store("valid content")
+	rotten := store("rotten content")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, DirObjects, DefaultFilenamer(rotten)), []byte("bit rot"), 0600))
+
+	corrupt, err := c.Verify(valid)
+	require.NoError(t, err)
+	assert.False(t, corrupt)
+
+	corrupt, err = c.Verify(rotten)
+	require.NoError(t, err)
+	assert.True(t, corrupt)
+
+	// the corrupt object is moved aside and no longer indexed
+	_, err = os.Stat(filepath.Join(dir, DirObjects, DefaultFilenamer(rotten)))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, DirQuarantine, rotten))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, c.IndexStats().Objects)
+
+	// missing objects and keys that aren't digests are skipped
+	for _, key := range []string{rotten, "not-a-digest"} {
+		corrupt, err = c.Verify(key)
+		require.NoError(t, err)
+		assert.False(t, corrupt)
+	}
+}
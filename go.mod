@@ -3,6 +3,8 @@ module github.com/saracen/lfscache
 go 1.14
 
 require (
+	github.com/andybalholm/brotli v1.0.0
 	github.com/go-kit/kit v0.10.0
 	github.com/stretchr/testify v1.4.0
+	golang.org/x/net v0.0.0-20190813141303-74dc4d7220e7
 )
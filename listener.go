@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net"
+
+	"golang.org/x/net/netutil"
+)
+
+// listen listens for TCP connections on addr. If max is positive, at most
+// max connections are accepted simultaneously. Once the limit is reached,
+// Accept blocks until a connection is closed, so further connections wait in
+// the listen backlog rather than being served.
+func listen(addr string, max int) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err == nil && max > 0 {
+		l = netutil.LimitListener(l, max)
+	}
+	return l, err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenLimit(t *testing.T) {
+	l, err := listen("127.0.0.1:0", 1)
+	require.NoError(t, err)
+	defer l.Close()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+	}
+
+	first, err := l.Accept()
+	require.NoError(t, err)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	// the connection over the limit waits until the first is closed
+	select {
+	case <-accepted:
+		t.Fatal("connection over the limit was accepted")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, first.Close())
+	select {
+	case c := <-accepted:
+		assert.NoError(t, c.Close())
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't accepted once one was released")
+	}
+}
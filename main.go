@@ -1,15 +1,28 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"hash"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/saracen/lfscache/cache"
 	"github.com/saracen/lfscache/server"
 
 	"github.com/go-kit/kit/log"
@@ -22,17 +35,245 @@ var (
 	date    = "unknown"
 )
 
+// hmacHashes are the hashes supported for signing cache content requests.
+var hmacHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+type fileModeValue os.FileMode
+
+func (m *fileModeValue) String() string {
+	return fmt.Sprintf("%#o", os.FileMode(*m))
+}
+
+func (m *fileModeValue) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return err
+	}
+	*m = fileModeValue(mode)
+	return nil
+}
+
+// headerValue is a repeatable flag of "Name: value" headers.
+type headerValue http.Header
+
+func (h headerValue) String() string {
+	var headers []string
+	for key, values := range h {
+		for _, value := range values {
+			headers = append(headers, key+": "+value)
+		}
+	}
+	return strings.Join(headers, ", ")
+}
+
+func (h headerValue) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("header %q must be of the form \"Name: value\"", value)
+	}
+
+	name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if name == "" || strings.IndexFunc(name, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", r)
+	}) >= 0 {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("invalid header value %q", value)
+	}
+
+	http.Header(h).Add(name, value)
+	return nil
+}
+
+// timestampValuer returns the log timestamp valuer for a format, or nil if
+// timestamps are disabled. The RFC3339 formats use local time.
+func timestampValuer(format string) (log.Valuer, error) {
+	switch format {
+	case "utc":
+		return log.DefaultTimestampUTC, nil
+	case "rfc3339":
+		return log.TimestampFormat(time.Now, time.RFC3339), nil
+	case "rfc3339nano":
+		return log.DefaultTimestamp, nil
+	case "unix":
+		return func() interface{} { return time.Now().Unix() }, nil
+	case "none":
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("unsupported log timestamp format %q", format)
+}
+
+// archive exports the cache to, or imports it from, a tar file.
+func archive(logger log.Logger, directory, exportPath, importPath string, options []cache.Option) error {
+	c, err := cache.NewFilesystemCache(directory, options...)
+	if err != nil {
+		return err
+	}
+
+	if exportPath != "" {
+		f, err := os.Create(exportPath)
+		if err != nil {
+			return err
+		}
+
+		err = c.Export(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			level.Info(logger).Log("event", "exported", "path", exportPath)
+		}
+		return err
+	}
+
+	f, err := os.Open(importPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stats, err := c.Import(f)
+	level.Info(logger).Log("event", "imported", "path", importPath, "imported", stats.Imported, "rejected", stats.Rejected)
+	return err
+}
+
+// parseHostDurations parses a comma separated list of host=duration pairs.
+func parseHostDurations(value string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid host duration %q", pair)
+		}
+
+		duration, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid host duration %q: %v", pair, err)
+		}
+		durations[parts[0]] = duration
+	}
+
+	return durations, nil
+}
+
 func main() {
 	var (
 		httpAddr     = flag.String("http-addr", ":8080", "HTTP listen address")
+		metricsAddr  = flag.String("metrics-addr", "", "listen address for serving expvar metrics at /debug/vars (disabled if empty)")
 		httpsAddr    = flag.String("https-addr", ":8443", "HTTPS listen address (only enabled if key/cert options are provided)")
 		tlsKey       = flag.String("tls-key", "", "HTTPS TLS key filepath")
 		tlsCert      = flag.String("tls-cert", "", "HTTPS TLS certificate filepath")
+		clientCert   = flag.String("upstream-client-cert", "", "client certificate filepath presented to upstreams requiring mutual TLS")
+		clientKey    = flag.String("upstream-client-key", "", "client certificate key filepath (defaults to the certificate filepath)")
 		lfsServerURL = flag.String("url", "", "LFS server URL")
+		canonicalHst = flag.String("canonical-host", "", "host, with an optional port, that rewritten batch hrefs point to, rather than the host of each batch request")
+		publicURL    = flag.String("public-url", "", "URL, such as https://cache.example.com, whose scheme and host rewritten batch hrefs use, rather than those of each batch request")
+		mirrorURL    = flag.String("upstream-mirror", "", "mirror URL objects are fetched from when the LFS server or object store fails")
 		directory    = flag.String("directory", "./objects", "cache directory")
+		exportPath   = flag.String("export", "", "write the cached objects to this tar file and exit")
+		importPath   = flag.String("import", "", "add the objects in this tar file, as written by --export, to the cache and exit")
+		tempDir      = flag.String("temp-directory", "", "directory for in-progress downloads (default <directory>/tmp)")
+		probeEvery   = flag.Duration("readiness-probe-interval", 10*time.Second, "interval between checks that the cache directory can be written to, reported by "+server.ContentCachePathPrefix+"readyz (0 checks on each request instead)")
+		maxInflight  = flag.Duration("max-inflight-duration", 0, "fail and cancel fetches that are still inflight after this duration, such as hung fetches, so the object can be fetched again (0 disables)")
+		maxReaders   = flag.Int("max-inflight-readers", 0, "reject requests for an object being fetched with a 503 once this many clients are already waiting on it (0 is unlimited)")
+		backupDir    = flag.String("backup-directory", "", "copy newly cached objects to this directory in the background, such as a separate mount for disaster recovery")
+		backupJobs   = flag.Int("backup-workers", 2, "number of workers copying objects to --backup-directory")
+		sharedDir    = flag.Bool("shared-cache-dir", false, "the cache directory is shared by multiple lfscache processes, such as on a network filesystem")
+		keepPartial  = flag.Bool("keep-partial-on-error", false, "keep partially downloaded objects when a fetch fails with a retryable error")
+		partialTTL   = flag.Duration("partial-ttl", 24*time.Hour, "remove kept partial downloads that haven't been resumed within this duration")
+		indexMode    = flag.String("index-mode", string(cache.IndexModeLazy), "build the object index before serving (eager) or in the background (lazy)")
+		scrubEvery   = flag.Duration("background-scrub-interval", 0, "verify a few cached objects' checksums every interval, quarantining corrupt objects (0 disables)")
+		scrubCount   = flag.Int("background-scrub-objects", 10, "number of objects verified every --background-scrub-interval")
+		indexWorkers = flag.Int("index-workers", 1, "number of workers walking the cache directory concurrently when building the object index")
+		accessEvery  = flag.Duration("access-times-interval", 5*time.Minute, "interval between saves of the objects' in-memory access times, so least recently used order survives restarts (0 disables)")
+		noCache      = flag.Bool("no-cache", false, "run as a pure proxy, without caching objects")
+		audit        = flag.Bool("audit", false, "run as a pure proxy, logging the objects that would be cached and the projected cache size and hit rate")
+		auditEvery   = flag.Duration("audit-interval", time.Minute, "interval between audit summaries")
 		printVersion = flag.Bool("v", false, "print version")
+		logTimestamp = flag.String("log-timestamp-format", "utc", "log timestamp format: utc (RFC3339Nano in UTC), rfc3339 or rfc3339nano (local time), unix or none")
+		stripPrefix  = flag.String("strip-prefix", "", "path prefix removed from requests and added to rewritten hrefs, when served behind a path-prefixed ingress")
+		infoPage     = flag.Bool("info-page", false, "serve an informational page at the root path")
+		missRedirect = flag.Bool("miss-redirect", false, "redirect clients to the upstream href on a cache miss, fetching the object in the background")
+		wireCompress = flag.Bool("wire-compression", false, "compress served objects on the wire (brotli or gzip) when the client supports it")
+		userAgent    = flag.String("upstream-user-agent", "", "fixed User-Agent for upstream requests (default appends lfscache/<version> to the client's)")
+		objectExt    = flag.String("object-extension", "", "file extension appended to the names of cached objects, such as .bin, so other software can recognise them")
+		shardDepth   = flag.Int("shard-depth", 2, "number of two character prefix directory levels used to store cached objects (0 stores them flat)")
+		adminToken   = flag.String("admin-token", "", "bearer token required by administrative endpoints, which are disabled if empty")
+		hmacKey      = flag.String("hmac-key", "", "hex encoded key used to sign cache content requests, shared between instances (default random)")
+		hmacHash     = flag.String("hmac-hash", "sha256", "hash used to sign cache content requests (sha256, sha384 or sha512)")
+		fetchLimit   = flag.Int("fetch-concurrency", 0, "maximum number of concurrent upstream fetches (0 is unlimited)")
+		softLimit    = flag.Int("soft-fetch-limit", 0, "proxy uncached objects without caching them whilst this many fetches are inflight, rather than queuing (0 disables)")
+		hostOnly     = flag.Bool("upstream-host-only", false, "use only the LFS server URL's scheme and host, keeping the client's full request path so that one cache fronts every project on the host")
+		upstreamSep  = flag.Bool("upstream-trailing-slash", true, "suffix the LFS server URL's path with a separator if it doesn't have one")
+		maxQueued    = flag.Int("max-queued-requests", 0, "reject content requests with a 503 once this many are waiting for fetches to start (0 is unlimited)")
+		bufferBudget = flag.Int64("max-serve-buffer-memory", 0, "reject requests for uncached objects with a 503 once the buffers serving objects that aren't on disk use this many bytes, an estimated 32KB each (0 is unlimited)")
+		fetchPrio    = flag.Bool("fetch-priority", false, "start queued fetches in priority order (X-Lfs-Cache-Priority header, then smallest object first)")
+		defaultPrio  = flag.Int("fetch-default-priority", 0, "priority of fetches for requests without a priority header")
+		parallel     = flag.Int("parallel-fetch", 0, "fetch large objects as this many parallel range requests, if supported by the upstream")
+		fetchTimeout = flag.Duration("fetch-timeout", 0, "abort object fetches that take longer than this in total (0 disables)")
+		minRate      = flag.Int64("fetch-min-rate", 0, "abort object fetches that download fewer than this many bytes per second over --fetch-min-rate-window (0 disables)")
+		minRateWin   = flag.Duration("fetch-min-rate-window", 30*time.Second, "window over which --fetch-min-rate is measured")
+		retryAfter   = flag.Duration("retry-after", server.DefaultRetryAfter, "Retry-After duration sent to clients with transient 503 failures")
+		failedTTL    = flag.Duration("failed-fetch-ttl", 0, "fail requests for an object whose fetch failed within this duration, instead of fetching it again (0 disables)")
+		skipChecksum = flag.Bool("skip-checksum", false, "don't verify the checksum of fetched objects (corruption will not be detected)")
+		checksumTry  = flag.Int("checksum-retries", 0, "fetch an object again up to this many times when its download's checksum doesn't match, rather than failing the fetch")
+		minRewrite   = flag.Int64("min-object-size", 0, "only route downloads of objects of at least this size in bytes through the cache, smaller objects are downloaded directly from the upstream")
+		expiryMargin = flag.Duration("rewrite-expiry-margin", 0, "don't route downloads through the cache if their href expires within this duration, so clients download them directly in time (0 disables)")
+		maxBatchBuf  = flag.Int64("max-batch-buffer-size", server.DefaultMaxBatchBufferSize, "size in bytes above which rewritten batch responses are streamed rather than buffered in memory (0 always buffers)")
+		sourceHeader = flag.Bool("expose-source-header", false, "set the X-Lfs-Cache-Source header (disk, inflight or fresh) on served content")
+		flushInfl    = flag.Bool("flush-inflight", false, "flush objects that are being fetched to clients as the data arrives, lowering the time to first byte of cold objects")
+		verbatimJSON = flag.Bool("verbatim-batch-objects", false, "copy batch response objects as the upstream encoded them, only re-encoding the actions that are rewritten")
+		noPassthru   = flag.Bool("disable-passthrough", false, "respond with a 404 to requests other than LFS batch and object downloads, rather than proxying them to the upstream")
+		corsOrigins  = flag.String("cors-allow-origin", "", "comma separated origins allowed to make cross-origin batch and content requests, or * for any (disabled if empty)")
+		corsMaxAge   = flag.Duration("cors-max-age", 10*time.Minute, "duration browsers can cache CORS preflight responses for")
+		maxBatchBody = flag.Int64("max-batch-body-size", 0, "maximum size in bytes of batch request bodies (0 is unlimited)")
+		batchTTL     = flag.Duration("batch-cache-ttl", 0, "cache download batch responses for this duration (0 disables)")
+		batchRetries = flag.Int("batch-retries", 0, "retry batch requests that fail with a transport error or a 502, 503 or 504 response this many times (0 disables)")
+		retryBase    = flag.Duration("batch-retry-base", 250*time.Millisecond, "maximum wait before the first batch retry, doubled for each further retry, the wait is chosen at random up to it")
+		retryMax     = flag.Duration("batch-retry-max", 10*time.Second, "cap on the maximum wait between batch retries")
+		authCacheTTL = flag.Duration("auth-cache-ttl", 0, "cache download batch responses to authenticated requests for this duration, overriding --batch-cache-ttl")
+		webhookURL   = flag.String("webhook-url", "", "URL to post JSON fetch events to")
+		allowedHosts = flag.String("allowed-upstream-hosts", "", "comma separated list of hosts objects can be fetched from (default any)")
+		fwdHeaders   = flag.String("fetch-forward-headers", "", "comma separated list of client headers captured at batch time and replayed when fetching objects")
+		stripReqHdrs = flag.String("strip-request-headers", "", "comma separated list of headers removed from requests to the upstream, such as internal routing headers or cookies")
+		stripResHdrs = flag.String("strip-response-headers", "", "comma separated list of headers removed from upstream responses proxied to clients")
+		serveHeaders = headerValue{}
+		selfTestOID  = flag.String("self-test", "", "download the object with this OID from the upstream through the cache, verify it and exit, with a non-zero status on failure")
+		selfTestSize = flag.Int64("self-test-size", 0, "size in bytes of the --self-test object")
+		selfTestKeep = flag.Bool("self-test-keep", false, "cache the --self-test object in the cache directory, rather than a temporary directory that's removed afterwards")
+		selfTestHdrs = headerValue{}
+		dirMode      = fileModeValue(cache.DefaultDirMode)
+		fileMode     = fileModeValue(cache.DefaultFileMode)
+
+		readHeaderTimeout = flag.Duration("read-header-timeout", 10*time.Second, "maximum duration for reading request headers")
+		readTimeout       = flag.Duration("read-timeout", 0, "maximum duration for reading an entire request, including the body (0 disables)")
+		writeTimeout      = flag.Duration("write-timeout", 0, "maximum duration before timing out writes of a response (0 disables, large objects can take a long time to transfer)")
+		idleTimeout       = flag.Duration("idle-timeout", 120*time.Second, "maximum amount of time to wait for the next request on keep-alive connections")
+		maxConnections    = flag.Int("max-connections", 0, "maximum number of simultaneous connections accepted by each of the HTTP and HTTPS listeners, further connections wait to be accepted (0 is unlimited)")
+		shutdownTimeout   = flag.Duration("shutdown-timeout", 30*time.Second, "maximum duration to wait for requests and inflight fetches to finish when shutting down")
+
+		maxIdleConns        = flag.Int("upstream-max-idle-conns", server.DefaultMaxIdleConns, "maximum number of idle upstream connections across all hosts")
+		maxIdleConnsPerHost = flag.Int("upstream-max-idle-conns-per-host", server.DefaultMaxIdleConnsPerHost, "maximum number of idle upstream connections per host")
+		maxConnsPerHost     = flag.Int("upstream-max-conns-per-host", 0, "maximum number of upstream connections per host (0 is unlimited)")
+		headerTimeout       = flag.Duration("upstream-response-header-timeout", 10*time.Second, "maximum amount of time to wait for upstream response headers")
+		hostHeaderTimeouts  = flag.String("upstream-host-response-header-timeouts", "", "comma separated host=duration list overriding the upstream response header timeout for specific hosts")
+		idleConnTimeout     = flag.Duration("upstream-idle-conn-timeout", server.DefaultIdleConnTimeout, "maximum amount of time an idle upstream connection remains open")
 	)
 
+	flag.Var(&dirMode, "cache-dir-mode", "cache directory permission mode (octal)")
+	flag.Var(&fileMode, "cache-file-mode", "cache file permission mode (octal)")
+	flag.Var(selfTestHdrs, "self-test-header", "header sent with the --self-test batch request, such as Authorization, as \"Name: value\" (repeatable)")
+	flag.Var(serveHeaders, "serve-header", "header added to successful content responses, as \"Name: value\" (repeatable)")
 	flag.Parse()
 
 	if *printVersion {
@@ -44,19 +285,305 @@ func main() {
 	{
 		logger = log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
 		logger = level.NewFilter(logger, level.AllowInfo())
-		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+
+		timestamp, err := timestampValuer(*logTimestamp)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		if timestamp != nil {
+			logger = log.With(logger, "ts", timestamp)
+		}
 	}
 
+	// exporting and importing don't need an upstream
+	archiving := *exportPath != "" || *importPath != ""
+
 	addr, err := url.Parse(*lfsServerURL)
-	if err == nil && (addr.Scheme != "http" && addr.Scheme != "https") {
+	if err == nil && !archiving && (addr.Scheme != "http" && addr.Scheme != "https") {
 		err = errors.New("unsupported LFS server URL")
 	}
+	var mirror *url.URL
+	if err == nil && *mirrorURL != "" {
+		mirror, err = url.Parse(*mirrorURL)
+		if err == nil && (mirror.Scheme != "http" && mirror.Scheme != "https") {
+			err = errors.New("unsupported upstream mirror URL")
+		}
+	}
+	if err == nil && *indexMode != string(cache.IndexModeEager) && *indexMode != string(cache.IndexModeLazy) {
+		err = errors.New("unsupported index mode")
+	}
+	if err == nil && *minRate > 0 && *minRateWin <= 0 {
+		err = errors.New("fetch min rate window must be positive")
+	}
+	if err == nil && *exportPath != "" && *importPath != "" {
+		err = errors.New("--export and --import cannot be used together")
+	}
+	if err == nil && *scrubEvery > 0 && *scrubCount < 1 {
+		err = errors.New("background scrub objects must be at least 1")
+	}
+	if err == nil && *indexWorkers < 1 {
+		err = errors.New("index workers must be at least 1")
+	}
+	if err == nil && *shardDepth < 0 {
+		err = errors.New("shard depth cannot be negative")
+	}
+	if err == nil && strings.ContainsAny(*objectExt, `/\`) {
+		err = errors.New("object extension cannot contain path separators")
+	}
+	if err == nil && *selfTestOID != "" && *selfTestSize <= 0 {
+		err = errors.New("self test requires the object's size")
+	}
+	if err == nil && *selfTestOID != "" && (*noCache || *audit || *hostOnly) {
+		err = errors.New("self test requires caching and an LFS server URL that isn't host only")
+	}
+	if err == nil && strings.ContainsAny(*canonicalHst, "/?#@") {
+		err = errors.New("canonical host must be a host, with an optional port")
+	}
+	var public *url.URL
+	if err == nil && *publicURL != "" {
+		public, err = url.Parse(*publicURL)
+		if err == nil && ((public.Scheme != "http" && public.Scheme != "https") || public.Host == "" || strings.Trim(public.Path, "/") != "" || public.RawQuery != "" || public.User != nil) {
+			err = errors.New("public URL must be an http or https URL without a path, use --strip-prefix for path prefixes")
+		}
+		if err == nil && *canonicalHst != "" {
+			err = errors.New("--public-url and --canonical-host cannot be used together")
+		}
+	}
+	if err == nil && *checksumTry < 0 {
+		err = errors.New("checksum retries cannot be negative")
+	}
+	if err == nil && *maxConnections < 0 {
+		err = errors.New("max connections cannot be negative")
+	}
+	if err == nil && *batchRetries > 0 && (*retryBase <= 0 || *retryMax < *retryBase) {
+		err = errors.New("batch retry base must be positive and no greater than batch retry max")
+	}
+	signingHash, ok := hmacHashes[*hmacHash]
+	if err == nil && !ok {
+		err = fmt.Errorf("unsupported HMAC hash %q", *hmacHash)
+	}
+	var headerTimeouts map[string]time.Duration
+	if err == nil {
+		headerTimeouts, err = parseHostDurations(*hostHeaderTimeouts)
+	}
 	if err != nil {
 		level.Error(logger).Log("err", err)
 		os.Exit(1)
 	}
 
-	s, err := server.New(logger, addr.String(), *directory)
+	cacheOptions := []cache.Option{
+		cache.WithDirMode(os.FileMode(dirMode)),
+		cache.WithFileMode(os.FileMode(fileMode)),
+		cache.WithFilenamer(cache.ShardedFilenamer(*shardDepth)),
+		cache.WithObjectExtension(*objectExt),
+		cache.WithIndexMode(cache.IndexMode(*indexMode)),
+		cache.WithIndexWorkers(*indexWorkers),
+		cache.WithTempDirectory(*tempDir),
+	}
+	if *keepPartial {
+		cacheOptions = append(cacheOptions, cache.WithKeepPartial(*partialTTL))
+	}
+	if *sharedDir {
+		cacheOptions = append(cacheOptions, cache.WithSharedDirectory())
+	}
+	if *maxReaders > 0 {
+		cacheOptions = append(cacheOptions, cache.WithMaxInflightReaders(*maxReaders))
+	}
+	if *maxInflight > 0 {
+		cacheOptions = append(cacheOptions, cache.WithMaxInflightDuration(*maxInflight))
+	}
+	if *accessEvery > 0 {
+		cacheOptions = append(cacheOptions, cache.WithAccessTimesInterval(*accessEvery))
+	}
+
+	if archiving {
+		if err := archive(logger, *directory, *exportPath, *importPath, cacheOptions); err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	options := []server.Option{
+		server.WithVersion(version),
+		server.WithUserAgent(*userAgent),
+		server.WithUpstreamConnLimits(*maxIdleConns, *maxIdleConnsPerHost, *maxConnsPerHost, *idleConnTimeout),
+		server.WithUpstreamResponseHeaderTimeout(*headerTimeout, headerTimeouts),
+		server.WithCacheOptions(cacheOptions...),
+		server.WithRetryAfter(*retryAfter),
+		server.WithMaxBatchBufferSize(*maxBatchBuf),
+	}
+	if len(serveHeaders) > 0 {
+		options = append(options, server.WithServeHeaders(http.Header(serveHeaders)))
+	}
+	if *stripPrefix != "" {
+		options = append(options, server.WithStripPrefix(*stripPrefix))
+	}
+	if *infoPage {
+		options = append(options, server.WithInfoPage())
+	}
+	if *adminToken != "" {
+		options = append(options, server.WithAdminToken(*adminToken))
+	}
+	if *hmacKey != "" {
+		key, err := hex.DecodeString(*hmacKey)
+		if err != nil {
+			level.Error(logger).Log("err", fmt.Errorf("invalid HMAC key: %v", err))
+			os.Exit(1)
+		}
+		options = append(options, server.WithHMACKey(key))
+	}
+	if *hmacHash != "sha256" {
+		options = append(options, server.WithHMACHash(signingHash))
+	}
+	if *allowedHosts != "" {
+		options = append(options, server.WithAllowedUpstreamHosts(strings.Split(*allowedHosts, ",")...))
+	}
+	if *clientCert != "" || *clientKey != "" {
+		if *clientKey == "" {
+			*clientKey = *clientCert
+		}
+		if *clientCert == "" {
+			*clientCert = *clientKey
+		}
+
+		cert, err := tls.LoadX509KeyPair(*clientCert, *clientKey)
+		if err != nil {
+			level.Error(logger).Log("err", fmt.Errorf("invalid upstream client certificate: %v", err))
+			os.Exit(1)
+		}
+		options = append(options, server.WithUpstreamClientCertificate(cert))
+	}
+	if *fwdHeaders != "" {
+		options = append(options, server.WithForwardHeaders(strings.Split(*fwdHeaders, ",")...))
+	}
+	if *stripReqHdrs != "" {
+		options = append(options, server.WithStripRequestHeaders(strings.Split(*stripReqHdrs, ",")...))
+	}
+	if *stripResHdrs != "" {
+		options = append(options, server.WithStripResponseHeaders(strings.Split(*stripResHdrs, ",")...))
+	}
+	if *fetchLimit > 0 {
+		options = append(options, server.WithFetchConcurrency(*fetchLimit))
+	}
+	if *softLimit > 0 {
+		options = append(options, server.WithSoftFetchLimit(*softLimit))
+	}
+	if *probeEvery > 0 {
+		options = append(options, server.WithReadinessProbe(*probeEvery))
+	}
+	if *backupDir != "" {
+		options = append(options, server.WithBackupDirectory(*backupDir, *backupJobs))
+	}
+	if *hostOnly {
+		options = append(options, server.WithHostOnlyUpstream())
+	}
+	if *noPassthru {
+		options = append(options, server.WithoutPassthrough())
+	}
+	if *verbatimJSON {
+		options = append(options, server.WithVerbatimBatchObjects())
+	}
+	if *corsOrigins != "" {
+		options = append(options, server.WithCORS(strings.Split(*corsOrigins, ","), *corsMaxAge))
+	}
+	if *sourceHeader {
+		options = append(options, server.WithSourceHeader())
+	}
+	if *canonicalHst != "" {
+		options = append(options, server.WithCanonicalHost(*canonicalHst))
+	}
+	if public != nil {
+		options = append(options, server.WithPublicURL(public))
+	}
+	if *flushInfl {
+		options = append(options, server.WithFlushInflight())
+	}
+	if !*upstreamSep {
+		options = append(options, server.WithoutUpstreamPathSeparator())
+	}
+	if *maxQueued > 0 {
+		options = append(options, server.WithMaxQueuedRequests(*maxQueued))
+	}
+	if *bufferBudget > 0 {
+		options = append(options, server.WithServeBufferBudget(*bufferBudget))
+	}
+	if *fetchPrio {
+		options = append(options, server.WithFetchPriority(*defaultPrio))
+	}
+	if *parallel > 1 {
+		options = append(options, server.WithParallelFetch(*parallel))
+	}
+	if *fetchTimeout > 0 {
+		options = append(options, server.WithFetchTimeout(*fetchTimeout))
+	}
+	if *minRate > 0 {
+		options = append(options, server.WithMinFetchRate(*minRate, *minRateWin))
+	}
+	if *scrubEvery > 0 {
+		options = append(options, server.WithBackgroundScrub(*scrubEvery, *scrubCount))
+	}
+	if *failedTTL > 0 {
+		options = append(options, server.WithFailedFetchTTL(*failedTTL))
+	}
+	if *skipChecksum {
+		options = append(options, server.WithSkipChecksum())
+	}
+	if *checksumTry > 0 {
+		options = append(options, server.WithChecksumRetries(*checksumTry))
+	}
+	if *minRewrite > 0 {
+		options = append(options, server.WithMinRewriteSize(*minRewrite))
+	}
+	if *expiryMargin > 0 {
+		options = append(options, server.WithRewriteExpiryMargin(*expiryMargin))
+	}
+	if *maxBatchBody > 0 {
+		options = append(options, server.WithMaxBatchBodySize(*maxBatchBody))
+	}
+	if *batchTTL > 0 {
+		options = append(options, server.WithBatchCache(*batchTTL))
+	}
+	if *authCacheTTL > 0 {
+		options = append(options, server.WithAuthCache(*authCacheTTL))
+	}
+	if *batchRetries > 0 {
+		options = append(options, server.WithBatchRetries(*batchRetries, *retryBase, *retryMax))
+	}
+	if *webhookURL != "" {
+		options = append(options, server.WithWebhook(*webhookURL))
+	}
+	if mirror != nil {
+		options = append(options, server.WithUpstreamMirror(mirror))
+	}
+	if *audit {
+		*noCache = true
+		options = append(options, server.WithAudit(*auditEvery))
+	}
+	if *missRedirect {
+		options = append(options, server.WithMissRedirect())
+	}
+	if *wireCompress {
+		options = append(options, server.WithWireCompression())
+	}
+
+	if *selfTestOID != "" {
+		err := selfTest(logger, addr.String(), *directory, *stripPrefix, *selfTestOID, *selfTestSize, http.Header(selfTestHdrs), *selfTestKeep, options, cacheOptions)
+		if err != nil {
+			level.Error(logger).Log("event", "self-test", "oid", *selfTestOID, "err", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("event", "self-test", "oid", *selfTestOID, "result", "passed")
+		os.Exit(0)
+	}
+
+	var s *server.Server
+	if *noCache {
+		s, err = server.NewNoCache(logger, addr.String(), options...)
+	} else {
+		s, err = server.New(logger, addr.String(), *directory, options...)
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -70,28 +597,67 @@ func main() {
 
 	httpsEnabled := *httpsAddr != "" && *tlsKey != ""
 
+	newHTTPServer := func(addr string, handler http.Handler) *http.Server {
+		return &http.Server{
+			Addr:              addr,
+			Handler:           handler,
+			ReadHeaderTimeout: *readHeaderTimeout,
+			ReadTimeout:       *readTimeout,
+			WriteTimeout:      *writeTimeout,
+			IdleTimeout:       *idleTimeout,
+		}
+	}
+
 	var wg sync.WaitGroup
-	if *httpAddr != "" {
-		level.Info(logger).Log("event", "listening", "proxy-endpoint", addr.String(), "transport", "HTTP", "addr", *httpAddr)
+	var servers []*http.Server
+	if *metricsAddr != "" {
+		level.Info(logger).Log("event", "listening", "transport", "metrics", "addr", *metricsAddr)
+
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		srv := newHTTPServer(*metricsAddr, mux)
+		servers = append(servers, srv)
 
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				panic(err)
+			}
+		}()
+	}
 
-			if httpsEnabled {
-				http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-					host, _, _ := net.SplitHostPort(r.Host)
-					_, port, _ := net.SplitHostPort(*httpsAddr)
+	if *httpAddr != "" {
+		level.Info(logger).Log("event", "listening", "proxy-endpoint", addr.String(), "transport", "HTTP", "addr", *httpAddr)
+
+		handler := s.Handle()
+		if httpsEnabled {
+			handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				host, _, _ := net.SplitHostPort(r.Host)
+				_, port, _ := net.SplitHostPort(*httpsAddr)
+
+				url := r.URL
+				url.Scheme = "https"
+				url.Host = host + ":" + port
 
-					url := r.URL
-					url.Scheme = "https"
-					url.Host = host + ":" + port
+				http.Redirect(w, r, url.String(), http.StatusMovedPermanently)
+			})
+		}
 
-					http.Redirect(w, r, url.String(), http.StatusMovedPermanently)
-				})
-				panic(http.ListenAndServe(*httpAddr, nil))
-			} else {
-				panic(http.ListenAndServe(*httpAddr, s.Handle()))
+		srv := newHTTPServer(*httpAddr, handler)
+		servers = append(servers, srv)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// the proxy listeners are limited to the maximum number of
+			// connections
+			l, err := listen(srv.Addr, *maxConnections)
+			if err == nil {
+				err = srv.Serve(l)
+			}
+			if err != http.ErrServerClosed {
+				panic(err)
 			}
 		}()
 	}
@@ -99,12 +665,48 @@ func main() {
 	if httpsEnabled {
 		level.Info(logger).Log("event", "listening", "proxy-endpoint", addr.String(), "transport", "HTTPS", "addr", *httpsAddr)
 
+		srv := newHTTPServer(*httpsAddr, s.Handle())
+		servers = append(servers, srv)
+
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			panic(http.ListenAndServeTLS(*httpsAddr, *tlsCert, *tlsKey, s.Handle()))
+			l, err := listen(srv.Addr, *maxConnections)
+			if err == nil {
+				err = srv.ServeTLS(l, *tlsCert, *tlsKey)
+			}
+			if err != http.ErrServerClosed {
+				panic(err)
+			}
 		}()
 	}
 
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	// stop accepting requests and let inflight fetches finish caching, both
+	// bounded by the shutdown timeout
+	level.Info(logger).Log("event", "shutting-down", "timeout", *shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	var stopped sync.WaitGroup
+	for _, srv := range servers {
+		stopped.Add(1)
+		go func(srv *http.Server) {
+			defer stopped.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				srv.Close()
+			}
+		}(srv)
+	}
+
+	if err := s.Shutdown(ctx); err != nil {
+		level.Error(logger).Log("event", "shutdown", "err", fmt.Errorf("abandoning inflight fetches: %v", err))
+	}
+
+	stopped.Wait()
 	wg.Wait()
+	level.Info(logger).Log("event", "shutdown")
 }
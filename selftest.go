@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/saracen/lfscache/cache"
+	"github.com/saracen/lfscache/server"
+)
+
+// selfTestTimeout bounds each step of the self test.
+const selfTestTimeout = 5 * time.Minute
+
+// selfTest downloads an object through a cache server for upstream, the way
+// a git-lfs client would: a batch request to the server, then a download of
+// the rewritten href. It verifies the downloaded and then the cached object's
+// checksum. Unless keep is set, the object is cached in a temporary directory
+// that's removed afterwards, rather than the cache directory.
+func selfTest(logger log.Logger, upstream, directory, prefix, oid string, size int64, header http.Header, keep bool, options []server.Option, cacheOptions []cache.Option) error {
+	if !keep {
+		dir, err := ioutil.TempDir("", "lfscache-self-test-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		// the temporary cache has its own temp directory, and isn't backed
+		// up
+		directory = dir
+		cacheOptions = append(cacheOptions, cache.WithTempDirectory(""))
+		options = append(options, server.WithCacheOptions(cache.WithTempDirectory("")), server.WithBackupDirectory("", 0))
+	}
+
+	// the object is downloaded from the local listener, rather than the
+	// public host hrefs are otherwise rewritten to
+	options = append(options, server.WithCanonicalHost(""), server.WithPublicURL(nil))
+
+	s, err := server.New(logger, upstream, directory, options...)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: s.Handle()}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+
+	action, err := selfTestBatch(ctx, "http://"+l.Addr().String()+prefix, oid, size, header)
+	if err != nil {
+		return fmt.Errorf("batch request: %v", err)
+	}
+	level.Info(logger).Log("event", "self-test", "step", "batch", "oid", oid, "href", action.Href)
+
+	if err := selfTestDownload(ctx, action, oid, size); err != nil {
+		return fmt.Errorf("download: %v", err)
+	}
+	level.Info(logger).Log("event", "self-test", "step", "download", "oid", oid)
+
+	// wait for the fetch to be moved into the cache
+	if err := s.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	c, err := cache.NewFilesystemCache(directory, cacheOptions...)
+	if err != nil {
+		return err
+	}
+	r, source, err := c.Lookup(oid)
+	if err == nil && source != cache.SourceDisk {
+		r.Close()
+		err = fmt.Errorf("object is %s rather than on disk", source)
+	}
+	if err != nil {
+		return fmt.Errorf("cache: %v", err)
+	}
+	defer r.Close()
+
+	if err := verifyObject(r, oid, size); err != nil {
+		return fmt.Errorf("cache: %v", err)
+	}
+	level.Info(logger).Log("event", "self-test", "step", "cache", "oid", oid)
+
+	return nil
+}
+
+// selfTestBatch requests a download of the object from the batch endpoint at
+// endpoint, returning the object's download action.
+func selfTestBatch(ctx context.Context, endpoint, oid string, size int64, header http.Header) (*server.BatchObjectActionResponse, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"operation": "download",
+		"transfers": []string{"basic"},
+		"objects":   []map[string]interface{}{{"oid": oid, "size": size}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Accept", "application/vnd.git-lfs+json")
+	req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("responded with %d status code", resp.StatusCode)
+	}
+
+	var br server.BatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&br); err != nil {
+		return nil, err
+	}
+	if len(br.Objects) != 1 || br.Objects[0].OID != oid {
+		return nil, fmt.Errorf("object %s missing from response", oid)
+	}
+	if object := br.Objects[0]; object.Error != nil {
+		return nil, fmt.Errorf("object error %d: %s", object.Error.Code, object.Error.Message)
+	}
+	action, ok := br.Objects[0].Actions["download"]
+	if !ok {
+		return nil, fmt.Errorf("object %s has no download action", oid)
+	}
+
+	return action, nil
+}
+
+// selfTestDownload downloads the object using action, verifying its content.
+func selfTestDownload(ctx context.Context, action *server.BatchObjectActionResponse, oid string, size int64) error {
+	req, err := http.NewRequest(http.MethodGet, action.Href, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for key, value := range action.Header {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("responded with %d status code", resp.StatusCode)
+	}
+
+	return verifyObject(resp.Body, oid, size)
+}
+
+// verifyObject checks that r's content has the given size and SHA-256 digest.
+func verifyObject(r io.Reader, oid string, size int64) error {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("read %d bytes, expected %d", n, size)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != oid {
+		return fmt.Errorf("checksum %s doesn't match", sum)
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/saracen/lfscache/cache"
+	"github.com/saracen/lfscache/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// selfTestUpstream returns an upstream that serves an object with oid,
+// downloaded with the content served.
+func selfTestUpstream(oid string, size int64, served []byte) *httptest.Server {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/objects/batch":
+			json.NewEncoder(w).Encode(server.BatchResponse{
+				Transfer: "basic",
+				Objects: []*server.BatchObjectResponse{
+					{
+						OID:  oid,
+						Size: size,
+						Actions: map[string]*server.BatchObjectActionResponse{
+							"download": {Href: ts.URL + "/download/" + oid},
+						},
+					},
+				},
+			})
+
+		case "/download/" + oid:
+			w.Write(served)
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	return ts
+}
+
+func TestSelfTest(t *testing.T) {
+	content := []byte("self test content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	tests := map[string]struct {
+		served []byte
+		size   int64
+		err    string
+	}{
+		"passed":         {content, int64(len(content)), ""},
+		"corrupt object": {[]byte("corrupt object!!!"), int64(len(content)), "download: "},
+		"wrong size":     {content, int64(len(content)) + 1, "download: "},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ts := selfTestUpstream(oid, tc.size, tc.served)
+			defer ts.Close()
+
+			dir, err := ioutil.TempDir("", "")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			err = selfTest(log.NewNopLogger(), ts.URL, dir, "", oid, tc.size, http.Header{}, true, nil, nil)
+			if tc.err == "" {
+				require.NoError(t, err)
+
+				// the object was kept in the cache directory
+				data, err := ioutil.ReadFile(filepath.Join(dir, cache.DirObjects, cache.DefaultFilenamer(oid)))
+				require.NoError(t, err)
+				assert.Equal(t, content, data)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
+
+func TestSelfTestTemporaryCache(t *testing.T) {
+	content := []byte("self test temporary content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	ts := selfTestUpstream(oid, int64(len(content)), content)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, selfTest(log.NewNopLogger(), ts.URL, dir, "", oid, int64(len(content)), http.Header{}, false, nil, nil))
+
+	// without keep, the cache directory is left untouched
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestSelfTestMissingObject(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(server.BatchResponse{
+			Transfer: "basic",
+			Objects: []*server.BatchObjectResponse{
+				{
+					OID:   "1111111",
+					Error: &server.BatchObjectErrorResponse{Code: http.StatusNotFound, Message: "Object does not exist"},
+				},
+			},
+		})
+	}))
+	defer ts.Close()
+
+	err := selfTest(log.NewNopLogger(), ts.URL, "", "", "1111111", 1, http.Header{}, false, nil, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "batch request: object error 404: Object does not exist")
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/saracen/lfscache/cache"
+)
+
+// Page sizes of the cached objects listing.
+const (
+	defaultObjectsLimit = 1000
+	maxObjectsLimit     = 10000
+)
+
+// ObjectsResponse is a page of the cached objects listing. NextCursor is
+// passed as the cursor query parameter to fetch the next page, and is empty
+// on the last page.
+type ObjectsResponse struct {
+	Objects    []*CachedObjectResponse `json:"objects"`
+	NextCursor string                  `json:"next_cursor,omitempty"`
+}
+
+// CachedObjectResponse describes a cached object.
+type CachedObjectResponse struct {
+	OID        string    `json:"oid"`
+	Size       int64     `json:"size"`
+	AccessedAt time.Time `json:"accessed_at"`
+	Pinned     bool      `json:"pinned"`
+}
+
+// authorized returns whether a request carries the admin bearer token.
+func (s *Server) authorized(r *http.Request) bool {
+	expected := "Bearer " + s.adminToken
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1
+}
+
+// objects lists the cached objects, paginated in key order.
+func (s *Server) objects() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		limit := defaultObjectsLimit
+		if value := r.URL.Query().Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if n < maxObjectsLimit {
+				limit = n
+			} else {
+				limit = maxObjectsLimit
+			}
+		}
+
+		objects := s.cache.Objects(r.URL.Query().Get("cursor"), limit)
+
+		response := ObjectsResponse{Objects: make([]*CachedObjectResponse, len(objects))}
+		for i, object := range objects {
+			response.Objects[i] = &CachedObjectResponse{
+				OID:        object.Key,
+				Size:       object.Size,
+				AccessedAt: object.Accessed.UTC(),
+				Pinned:     object.Pinned,
+			}
+		}
+		if len(objects) == limit {
+			response.NextCursor = objects[len(objects)-1].Key
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+// pin pins a cached object with a PUT request, so that it's never evicted,
+// and unpins it with a DELETE request.
+func (s *Server) pin() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		key := path.Base(r.URL.Path)
+		err := s.cache.Pin(key, r.Method == http.MethodPut)
+		switch {
+		case err == cache.ErrKeyNotFound:
+			writeContentError(w, http.StatusNotFound, key, "object is not cached")
+		case err != nil:
+			level.Error(s.logger).Log("event", "pinning", "oid", key, "err", err)
+			writeContentError(w, http.StatusInternalServerError, key, "pinning object failed")
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+}
+
+// refresh replaces a cached object with a copy fetched from the upstream,
+// such as when the cached object is stale. Requests carry the same signed
+// headers as the object's content requests, and the copy is only swapped in
+// once its content has been verified, so that the object is never missing
+// for clients reading it.
+func (s *Server) refresh() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		oid := path.Base(r.URL.Path)
+		url, size, header, err := s.parseHeaders(r)
+		if err != nil {
+			s.rejectHeaders(w, r, "refresh", err)
+			return
+		}
+		header.Set("User-Agent", s.upstreamUserAgent(r.Header.Get("User-Agent")))
+
+		resp, err := s.get(r.Context(), url, header, "")
+		if err == nil && resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = upstreamStatusError{resp.StatusCode}
+		}
+		if err != nil {
+			level.Error(s.logger).Log("event", "refreshing", "oid", oid, "err", err)
+			writeContentError(w, fetchErrorStatus(err), oid, fetchErrorMessage(err))
+			return
+		}
+		defer resp.Body.Close()
+
+		err = s.cache.Replace(oid, s.KeyFunc(oid, r), io.LimitReader(resp.Body, int64(size)))
+		if err != nil {
+			level.Error(s.logger).Log("event", "refreshing", "oid", oid, "err", err)
+
+			status, message := http.StatusInternalServerError, "replacing cached object failed"
+			if err == cache.ErrDigestMismatch {
+				status, message = http.StatusBadGateway, "upstream object does not match its oid"
+			}
+			writeContentError(w, status, oid, message)
+			return
+		}
+
+		level.Info(s.logger).Log("event", "refreshed", "oid", oid, "size", size)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/saracen/lfscache/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObjectsListing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(log.NewNopLogger(), "http://example.com", dir, WithAdminToken("secret"))
+	require.NoError(t, err)
+	<-s.cache.Indexed()
+
+	for _, key := range []string{"cc", "aa", "bb"} {
+		cr, cw, _, err := s.cache.Get(key)
+		require.NoError(t, err)
+		_, err = cw.Write([]byte(key))
+		require.NoError(t, err)
+		require.NoError(t, cr.Close())
+		require.NoError(t, s.cache.Done(key, nil))
+	}
+
+	list := func(query, token string) (int, ObjectsResponse) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", ContentCachePathPrefix+"objects"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		s.Handle().ServeHTTP(w, req)
+
+		var response ObjectsResponse
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		}
+		return w.Code, response
+	}
+
+	code, _ := list("", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = list("", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, page := list("?limit=2", "secret")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, page.Objects, 2)
+	assert.Equal(t, "aa", page.Objects[0].OID)
+	assert.Equal(t, int64(2), page.Objects[0].Size)
+	assert.False(t, page.Objects[0].AccessedAt.IsZero())
+	assert.Equal(t, "bb", page.Objects[1].OID)
+	assert.Equal(t, "bb", page.NextCursor)
+
+	code, page = list("?limit=2&cursor="+page.NextCursor, "secret")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, page.Objects, 1)
+	assert.Equal(t, "cc", page.Objects[0].OID)
+	assert.False(t, page.Objects[0].Pinned)
+	assert.Empty(t, page.NextCursor)
+}
+
+func TestPin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(log.NewNopLogger(), "http://example.com", dir, WithAdminToken("secret"))
+	require.NoError(t, err)
+	<-s.cache.Indexed()
+
+	cr, cw, _, err := s.cache.Get("aa")
+	require.NoError(t, err)
+	_, err = cw.Write([]byte("aa"))
+	require.NoError(t, err)
+	require.NoError(t, cr.Close())
+	require.NoError(t, s.cache.Done("aa", nil))
+
+	pin := func(method, key, token string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, ContentCachePathPrefix+"pin/"+key, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		s.Handle().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, pin("PUT", "aa", "wrong"))
+	assert.Equal(t, http.StatusNotFound, pin("PUT", "bb", "secret"))
+
+	assert.Equal(t, http.StatusNoContent, pin("PUT", "aa", "secret"))
+	assert.True(t, s.cache.Objects("", 1)[0].Pinned)
+
+	assert.Equal(t, http.StatusNoContent, pin("DELETE", "aa", "secret"))
+	assert.False(t, s.cache.Objects("", 1)[0].Pinned)
+}
+
+func TestRefresh(t *testing.T) {
+	content := []byte("refreshed content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	served := content
+	ts, s, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(served)
+	}, WithAdminToken("secret"))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	filename := filepath.Join(dir, cache.DirObjects, cache.DefaultFilenamer(oid))
+	require.NoError(t, os.MkdirAll(filepath.Dir(filename), 0700))
+	require.NoError(t, ioutil.WriteFile(filename, []byte("stale"), 0600))
+
+	action := batchAction(t, s)
+	refresh := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", ContentCachePathPrefix+"refresh/"+oid, nil)
+		for key, val := range action.Header {
+			req.Header.Set(key, val)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		s.Handle().ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, refresh("wrong").Code)
+
+	// an upstream object that doesn't match leaves the cached one in place
+	served = []byte("corrupt")
+	assert.Equal(t, http.StatusBadGateway, refresh("secret").Code)
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("stale"), data)
+
+	served = content
+	assert.Equal(t, http.StatusNoContent, refresh("secret").Code)
+	data, err = ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+}
+
+func TestRefreshKeyFunc(t *testing.T) {
+	content := []byte("refreshed namespaced content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	ts, s, dir, err := objectServer(content, WithAdminToken("secret"))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	s.KeyFunc = func(oid string, r *http.Request) string {
+		return "repo-" + oid
+	}
+
+	action := batchAction(t, s)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", ContentCachePathPrefix+"refresh/"+oid, nil)
+	for key, val := range action.Header {
+		req.Header.Set(key, val)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	s.Handle().ServeHTTP(w, req)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, cache.DirObjects, cache.DefaultFilenamer("repo-"+oid)))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+}
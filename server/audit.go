@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// audit projects the size and hit rate the cache would have, for objects
+// served without caching.
+type audit struct {
+	interval time.Duration
+
+	lock     sync.Mutex
+	objects  map[string]int64
+	bytes    int64
+	requests int64
+	hits     int64
+}
+
+func newAudit(interval time.Duration) *audit {
+	return &audit{
+		interval: interval,
+		objects:  make(map[string]int64),
+	}
+}
+
+// record records a request for an object, returning whether it would have
+// been a cache hit.
+func (a *audit) record(key string, size int64) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.requests++
+	if _, ok := a.objects[key]; ok {
+		a.hits++
+		return true
+	}
+
+	a.objects[key] = size
+	a.bytes += size
+	return false
+}
+
+// summarize periodically logs the projected cache size and hit rate.
+func (a *audit) summarize(logger log.Logger) {
+	if a.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		a.lock.Lock()
+		objects, bytes, requests, hits := len(a.objects), a.bytes, a.requests, a.hits
+		a.lock.Unlock()
+
+		hitRate := 0.0
+		if requests > 0 {
+			hitRate = float64(hits) / float64(requests)
+		}
+
+		level.Info(logger).Log("event", "audit-summary", "objects", objects, "bytes", bytes, "requests", requests, "hits", hits, "hit-rate", fmt.Sprintf("%.3f", hitRate))
+	}
+}
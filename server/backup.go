@@ -0,0 +1,148 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/saracen/lfscache/cache"
+)
+
+// backupQueueSize is the number of objects waiting to be backed up before
+// new objects are dropped.
+const backupQueueSize = 1024
+
+// backupAttempts is the number of times copying an object to the backup
+// directory is attempted before it's given up on.
+const backupAttempts = 3
+
+// backup copies newly cached objects to a secondary directory. Objects are
+// queued and copied by a fixed number of workers, so that backing up never
+// slows down promoting or serving objects.
+type backup struct {
+	logger    log.Logger
+	directory string
+	filenamer func(key string) string
+	retryWait time.Duration
+	queue     chan backupObject
+}
+
+type backupObject struct {
+	oid  string
+	path string
+}
+
+func newBackup(logger log.Logger, directory string, workers int, filenamer func(key string) string) *backup {
+	b := &backup{
+		logger:    logger,
+		directory: directory,
+		filenamer: filenamer,
+		retryWait: time.Second,
+		queue:     make(chan backupObject, backupQueueSize),
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go b.run()
+	}
+
+	return b
+}
+
+// send queues the object at path for backup, dropping it if the queue is
+// full.
+func (b *backup) send(oid, path string) {
+	if b == nil {
+		return
+	}
+
+	select {
+	case b.queue <- backupObject{oid: oid, path: path}:
+	default:
+		metricBackupErrors.Add(1)
+		level.Error(b.logger).Log("event", "backup", "oid", oid, "err", "queue full, object dropped")
+	}
+}
+
+func (b *backup) run() {
+	for object := range b.queue {
+		var err error
+		wait := b.retryWait
+		for attempt := 1; attempt <= backupAttempts; attempt++ {
+			if err = b.copy(object); err == nil {
+				break
+			}
+			if attempt < backupAttempts {
+				time.Sleep(wait)
+				wait *= 2
+			}
+		}
+
+		logger := log.With(b.logger, "event", "backup", "oid", object.oid)
+		if err != nil {
+			metricBackupErrors.Add(1)
+			level.Error(logger).Log("err", err)
+			continue
+		}
+
+		metricBackedUpObjects.Add(1)
+		level.Debug(logger).Log()
+	}
+}
+
+// copy copies the object to the backup directory, named and with the same
+// permissions as it is in the cache directory, so that the backup directory
+// can itself be used as a cache directory. It's written to a dot prefixed
+// temporary file that's renamed into place, so a partial copy is never
+// mistaken for the object.
+func (b *backup) copy(object backupObject) error {
+	dest := filepath.Join(b.directory, cache.DirObjects, b.filenamer(object.oid))
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(object.path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	dir, err := os.Stat(filepath.Dir(object.path))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), dir.Mode().Perm()); err != nil {
+		return err
+	}
+
+	out, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+"-")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Chmod(fi.Mode().Perm())
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dest)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+	}
+
+	return err
+}
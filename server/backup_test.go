@@ -0,0 +1,61 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/saracen/lfscache/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupDirectory(t *testing.T) {
+	backupDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupDir)
+
+	content := []byte("backup content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	ts, s, dir, err := objectServer(content, WithBackupDirectory(backupDir, 1))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	w := download(s, batchAction(t, s), "GET", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	backedUp := filepath.Join(backupDir, cache.DirObjects, cache.DefaultFilenamer(oid))
+	assert.Eventually(t, func() bool {
+		buf, err := ioutil.ReadFile(backedUp)
+		return err == nil && string(buf) == string(content)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBackupRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	b := newBackup(log.NewNopLogger(), filepath.Join(dir, "backup"), 1, cache.DefaultFilenamer)
+	b.retryWait = 50 * time.Millisecond
+
+	// the object doesn't exist until after the first attempt
+	object := filepath.Join(dir, "object")
+	b.send("abcdef", object)
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, ioutil.WriteFile(object, []byte("retried"), 0600))
+
+	assert.Eventually(t, func() bool {
+		buf, err := ioutil.ReadFile(filepath.Join(dir, "backup", cache.DirObjects, cache.DefaultFilenamer("abcdef")))
+		return err == nil && string(buf) == "retried"
+	}, time.Second, 10*time.Millisecond)
+}
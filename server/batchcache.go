@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// batchCacheExpiryMargin is subtracted from the earliest action expiry of a
+// batch response, so that cached responses are never served with hrefs that
+// are about to expire.
+const batchCacheExpiryMargin = time.Minute
+
+// batchCacheMaxBodySize is the largest batch request body that's read to key
+// the cache. Requests with larger bodies are proxied without caching.
+const batchCacheMaxBodySize = 1 << 20
+
+// batchCacheMaxEntries is the most responses the batch cache holds. When it's
+// full, the entry closest to expiring makes way for a new one.
+const batchCacheMaxEntries = 4096
+
+// batchCacheIgnoredHeaders are request headers that don't identify a client,
+// and so aren't part of the cache key. Every other header is, so that
+// credentials in headers other than Authorization are also keyed on.
+var batchCacheIgnoredHeaders = map[string]bool{
+	"Accept":            true,
+	"Accept-Encoding":   true,
+	"Connection":        true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"User-Agent":        true,
+	"X-Forwarded-For":   true,
+	"X-Forwarded-Host":  true,
+	"X-Forwarded-Proto": true,
+}
+
+// batchCache caches upstream batch responses in memory for a short time.
+// Responses are stored as returned by the upstream, and rewritten and signed
+// with the current HMAC key each time they're served.
+//
+// authTTL applies to authenticated requests and ttl to all others. If authTTL
+// isn't set, ttl applies to every request.
+type batchCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	authTTL time.Duration
+	entries map[string]batchCacheEntry
+}
+
+type batchCacheKey struct {
+	key string
+	ttl time.Duration
+}
+
+type batchCacheEntry struct {
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func newBatchCache() *batchCache {
+	return &batchCache{
+		entries: make(map[string]batchCacheEntry),
+	}
+}
+
+// key returns the cache key for a batch request, and how long its response
+// can be cached for (zero if it can't be). The key includes the query string
+// and the request headers, so that a cached response is only ever returned to
+// a client that presented the same credentials. Only download requests are
+// cached, as upload actions carry short-lived authorization for a single
+// push. The request body is restored after being read, and requests with
+// bodies larger than batchCacheMaxBodySize aren't cached.
+func (bc *batchCache) key(r *http.Request) (string, time.Duration, error) {
+	authenticated := r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != ""
+
+	ttl := bc.ttl
+	if authenticated && bc.authTTL > 0 {
+		ttl = bc.authTTL
+	}
+	if r.Method != http.MethodPost || ttl <= 0 {
+		return "", 0, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, batchCacheMaxBodySize+1))
+	if err != nil {
+		return "", 0, err
+	}
+	if len(body) > batchCacheMaxBodySize {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return "", 0, nil
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var br batchRequest
+	if err := json.Unmarshal(body, &br); err != nil || br.Operation != "download" {
+		return "", 0, nil
+	}
+
+	h := sha256.New()
+	h.Write([]byte(r.URL.Path))
+	h.Write([]byte{0})
+	h.Write([]byte(r.URL.RawQuery))
+	h.Write([]byte{0})
+
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		if !batchCacheIgnoredHeaders[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range r.Header[name] {
+			h.Write([]byte(name))
+			h.Write([]byte{':'})
+			h.Write([]byte(value))
+			h.Write([]byte{0})
+		}
+	}
+	h.Write([]byte{0})
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil)), ttl, nil
+}
+
+// get returns a copy of a cached batch response, or nil if there isn't one.
+func (bc *batchCache) get(key string) *BatchResponse {
+	bc.lock.Lock()
+	entry, ok := bc.entries[key]
+	bc.lock.Unlock()
+
+	now := time.Now()
+	if !ok || now.After(entry.expires) {
+		return nil
+	}
+
+	var br BatchResponse
+	if err := json.Unmarshal(entry.body, &br); err != nil {
+		return nil
+	}
+
+	// relative expiries are adjusted by the time spent in the cache, rounded
+	// up so that they're never later than the upstream's
+	elapsed := int(math.Ceil(now.Sub(entry.stored).Seconds()))
+	for _, object := range br.Objects {
+		for _, action := range object.Actions {
+			if action.ExpiresIn > 0 {
+				action.ExpiresIn -= elapsed
+				if action.ExpiresIn < 1 {
+					action.ExpiresIn = 1
+				}
+			}
+		}
+	}
+
+	return &br
+}
+
+// set caches a batch response. The entry expires after the TTL, or before the
+// earliest expiring action, whichever is sooner.
+func (bc *batchCache) set(key string, ttl time.Duration, br *BatchResponse) {
+	now := time.Now()
+	expires := now.Add(ttl)
+	for _, object := range br.Objects {
+		for _, action := range object.Actions {
+			if at := action.expires(now); !at.IsZero() && at.Add(-batchCacheExpiryMargin).Before(expires) {
+				expires = at.Add(-batchCacheExpiryMargin)
+			}
+		}
+	}
+
+	if !expires.After(now) {
+		return
+	}
+
+	body, err := json.Marshal(br)
+	if err != nil {
+		return
+	}
+
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	// remove expired entries, and if still full, the one closest to expiring
+	var soonest string
+	for k, entry := range bc.entries {
+		if now.After(entry.expires) {
+			delete(bc.entries, k)
+			continue
+		}
+		if soonest == "" || entry.expires.Before(bc.entries[soonest].expires) {
+			soonest = k
+		}
+	}
+	if _, ok := bc.entries[key]; !ok && len(bc.entries) >= batchCacheMaxEntries {
+		delete(bc.entries, soonest)
+	}
+
+	bc.entries[key] = batchCacheEntry{body: body, stored: now, expires: expires}
+}
+
+// cachedBatch serves batch responses from the batch cache, and caches the
+// responses of proxied requests that can be cached.
+func (s *Server) cachedBatch(proxy http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ttl, err := s.batchCache.key(r)
+		if err != nil {
+			level.Error(s.logger).Log("event", "proxying", "request", r.URL, "err", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if ttl <= 0 {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+
+		if br := s.batchCache.get(key); br != nil {
+			level.Info(s.logger).Log("event", "batch", "source", "cache", "objects", len(br.Objects))
+
+			s.rewriteBatch(withOriginalHost(r), br)
+
+			w.Header().Set("Content-Type", "application/vnd.git-lfs+json")
+			json.NewEncoder(w).Encode(br)
+			return
+		}
+
+		proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKeyBatchCacheKey, &batchCacheKey{key, ttl})))
+	})
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+var errTransferAfterObjects = errors.New("non-basic transfer field follows objects")
+
+// streamBatch replaces the batch response's body with a rewritten version
+// that's produced as the upstream body is read, one object at a time, rather
+// than decoding the whole response first. Rewritten responses that fit within
+// the maximum batch buffer size are buffered so that they keep a
+// Content-Length, larger ones are streamed to the client.
+func (s *Server) streamBatch(r *http.Response) error {
+	upstream := r.Body
+	body, compress, err := responseBody(r)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	sw := &spillWriter{
+		buf:     cappedBuffer{max: s.maxBatchBuffer},
+		pw:      pw,
+		spilled: make(chan struct{}),
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		wc := nopCloser(sw)
+		if compress {
+			wc = gzip.NewWriter(sw)
+		}
+
+		err := s.rewriteBatchStream(r.Request, wc, body)
+		if cerr := wc.Close(); err == nil {
+			err = cerr
+		}
+		upstream.Close()
+
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+
+		r.Body = ioutil.NopCloser(&sw.buf.buf)
+		r.ContentLength = int64(sw.buf.buf.Len())
+		r.Header.Set("Content-Length", strconv.Itoa(sw.buf.buf.Len()))
+
+	case <-sw.spilled:
+		r.Body = pr
+		r.ContentLength = -1
+		r.Header.Del("Content-Length")
+	}
+
+	return nil
+}
+
+// rewriteBatchStream copies the batch response JSON read from r to w,
+// decoding and rewriting each element of objects individually. Other top
+// level fields are copied as is. A non-basic transfer field is honoured only
+// if it precedes objects; one that follows it is an error, as the objects have
+// already been rewritten by then.
+func (s *Server) rewriteBatchStream(req *http.Request, w io.Writer, r io.Reader) error {
+	dec := json.NewDecoder(r)
+	ew := &errWriter{w: w}
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	ew.WriteString("{")
+
+	basic, rewritten := true, false
+	for i := 0; dec.More(); i++ {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := token.(string)
+		if !ok {
+			return fmt.Errorf("unexpected batch response token %v", token)
+		}
+
+		if i > 0 {
+			ew.WriteString(",")
+		}
+		ew.WriteJSON(key)
+		ew.WriteString(":")
+
+		switch key {
+		case "objects":
+			if err := s.rewriteBatchObjects(req, dec, ew, basic); err != nil {
+				return err
+			}
+			rewritten = basic
+
+		default:
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return err
+			}
+
+			if key == "transfer" {
+				var transfer string
+				if err := json.Unmarshal(raw, &transfer); err != nil {
+					return err
+				}
+
+				basic = transfer == "" || transfer == "basic"
+				if !basic && rewritten {
+					return errTransferAfterObjects
+				}
+			}
+
+			ew.Write(raw)
+		}
+
+		if ew.err != nil {
+			return ew.err
+		}
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return err
+	}
+	ew.WriteString("}\n")
+
+	return ew.err
+}
+
+// rewriteBatchObjects copies the objects array from dec to ew, rewriting each
+// object if rewrite is set. If batch objects are kept verbatim, objects that
+// aren't rewritten are copied byte for byte, and only the rewritten actions of
+// those that are are re-encoded.
+func (s *Server) rewriteBatchObjects(req *http.Request, dec *json.Decoder, ew *errWriter, rewrite bool) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		ew.WriteString("null")
+		return nil
+	}
+	if token != json.Delim('[') {
+		return fmt.Errorf("unexpected batch response token %v", token)
+	}
+
+	ew.WriteString("[")
+	for i := 0; dec.More() && ew.err == nil; i++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		var object BatchObjectResponse
+		if err := json.Unmarshal(raw, &object); err != nil {
+			return err
+		}
+
+		var rewritten map[string]bool
+		if rewrite {
+			rewritten = s.rewriteObject(req, &object)
+		}
+
+		if i > 0 {
+			ew.WriteString(",")
+		}
+		switch {
+		case !s.verbatimBatch:
+			ew.WriteJSON(&object)
+
+		case len(rewritten) == 0:
+			ew.Write(raw)
+
+		default:
+			patched, err := patchFields(raw, func(key string, value json.RawMessage) (json.RawMessage, error) {
+				if key != "actions" {
+					return value, nil
+				}
+
+				return patchFields(value, func(operation string, action json.RawMessage) (json.RawMessage, error) {
+					if !rewritten[operation] {
+						return action, nil
+					}
+					return json.Marshal(object.Actions[operation])
+				})
+			})
+			if err != nil {
+				return err
+			}
+			ew.Write(patched)
+		}
+	}
+	if ew.err != nil {
+		return ew.err
+	}
+
+	if err := expectDelim(dec, ']'); err != nil {
+		return err
+	}
+	ew.WriteString("]")
+
+	return nil
+}
+
+// patchFields returns the JSON object raw with each field's value replaced by
+// the one returned by patch. The fields' order, and the bytes of values that
+// are returned as is, are kept.
+func patchFields(raw json.RawMessage, patch func(key string, value json.RawMessage) (json.RawMessage, error)) (json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for i := 0; dec.More(); i++ {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := token.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected batch response token %v", token)
+		}
+
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		if value, err = patch(key, value); err != nil {
+			return nil, err
+		}
+
+		name, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.Write(name)
+		buf.WriteString(":")
+		buf.Write(value)
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	buf.WriteString("}")
+
+	return buf.Bytes(), nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("unexpected batch response token %v, expected %v", token, delim)
+	}
+	return nil
+}
+
+// errWriter is a writer that remembers the first error and ignores
+// subsequent writes.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) Write(p []byte) {
+	if ew.err == nil {
+		_, ew.err = ew.w.Write(p)
+	}
+}
+
+func (ew *errWriter) WriteString(s string) {
+	ew.Write([]byte(s))
+}
+
+func (ew *errWriter) WriteJSON(v interface{}) {
+	if ew.err != nil {
+		return
+	}
+
+	var p []byte
+	p, ew.err = json.Marshal(v)
+	ew.Write(p)
+}
+
+// spillWriter buffers writes until the buffer's cap would be exceeded. It
+// then closes spilled and sends the buffered data, and all writes after it,
+// to pw instead.
+type spillWriter struct {
+	buf       cappedBuffer
+	pw        *io.PipeWriter
+	spilled   chan struct{}
+	streaming bool
+}
+
+func (w *spillWriter) Write(p []byte) (int, error) {
+	if !w.streaming {
+		n, err := w.buf.Write(p)
+		if err != errBufferCapExceeded {
+			return n, err
+		}
+
+		w.streaming = true
+		close(w.spilled)
+
+		buffered := w.buf.buf.Bytes()
+		w.buf.buf = bytes.Buffer{}
+		if _, err := w.pw.Write(buffered); err != nil {
+			return 0, err
+		}
+	}
+
+	return w.pw.Write(p)
+}
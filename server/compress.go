@@ -0,0 +1,117 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// encodings supported for on-the-wire compression, in order of preference.
+var encodings = []string{"br", "gzip"}
+
+// incompressible lists sniffed content types that are already compressed.
+var incompressible = []string{
+	"image/",
+	"audio/",
+	"video/",
+	"font/woff",
+	"application/ogg",
+	"application/pdf",
+	"application/wasm",
+	"application/x-gzip",
+	"application/x-rar-compressed",
+	"application/zip",
+}
+
+// negotiateEncoding returns the best supported encoding advertised by an
+// Accept-Encoding header value, or an empty string if there is none.
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+
+		for _, encoding := range encodings {
+			if coding != encoding || q <= 0 {
+				continue
+			}
+			if q > bestQ || (q == bestQ && preference(encoding) < preference(best)) {
+				best, bestQ = encoding, q
+			}
+		}
+	}
+
+	return best
+}
+
+func preference(encoding string) int {
+	for idx, e := range encodings {
+		if e == encoding {
+			return idx
+		}
+	}
+	return len(encodings)
+}
+
+// compressible sniffs the start of the content to determine whether it is
+// worth compressing.
+func compressible(r io.ReaderAt, size int64) bool {
+	sample := make([]byte, 512)
+	if size < int64(len(sample)) {
+		sample = sample[:size]
+	}
+
+	n, err := r.ReadAt(sample, 0)
+	if err != nil && err != io.EOF {
+		return false
+	}
+
+	ct := http.DetectContentType(sample[:n])
+	for _, prefix := range incompressible {
+		if strings.HasPrefix(ct, prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func serveCompressed(w http.ResponseWriter, r *http.Request, content io.Reader, encoding string) error {
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	var cw io.WriteCloser
+	switch encoding {
+	case "br":
+		cw = brotli.NewWriter(w)
+	default:
+		cw = gzip.NewWriter(w)
+	}
+
+	if _, err := io.Copy(cw, content); err != nil {
+		cw.Close()
+		return err
+	}
+
+	return cw.Close()
+}
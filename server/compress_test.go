@@ -0,0 +1,34 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                      "",
+		"identity":              "",
+		"gzip":                  "gzip",
+		"br":                    "br",
+		"gzip, br":              "br",
+		"br;q=0.5, gzip":        "gzip",
+		"br;q=0, gzip;q=0":      "",
+		"deflate, GZIP;q=0.8":   "gzip",
+		"gzip;q=1.0, br;q=1.0 ": "br",
+	}
+
+	for header, expected := range tests {
+		assert.Equal(t, expected, negotiateEncoding(header), header)
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	text := []byte("version https://git-lfs.github.com/spec/v1\n")
+	assert.True(t, compressible(bytes.NewReader(text), int64(len(text))))
+
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0A")
+	assert.False(t, compressible(bytes.NewReader(png), int64(len(png))))
+}
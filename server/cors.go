@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// corsExposeHeaders are the response headers, beyond the CORS-safelisted ones,
+// that cross-origin clients can read.
+var corsExposeHeaders = strings.Join([]string{
+	"Content-Length",
+	"Content-Range",
+	"Accept-Ranges",
+	"Retry-After",
+	SourceHeader,
+}, ", ")
+
+// withCORS adds CORS headers to next's responses to requests from allowed
+// origins, and answers their preflight requests.
+func (s *Server) withCORS(next http.Handler) http.Handler {
+	if len(s.corsOrigins) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		allowed, ok := s.corsAllowedOrigin(origin)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := make(http.Header)
+		header.Set("Access-Control-Allow-Origin", allowed)
+		header.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			header.Set("Access-Control-Allow-Methods", "GET, HEAD, POST")
+			if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				// requests carry the signed cache headers, and whatever
+				// headers the upstream's actions ask for, so the requested
+				// headers are allowed rather than a fixed list
+				header.Set("Access-Control-Allow-Headers", requested)
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+			}
+			if s.corsMaxAge > 0 {
+				header.Set("Access-Control-Max-Age", strconv.Itoa(int(s.corsMaxAge.Seconds())))
+			}
+
+			for key, values := range header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(&serveHeaderWriter{ResponseWriter: w, header: header, anyStatus: true}, r)
+	})
+}
+
+// corsAllowedOrigin returns the Access-Control-Allow-Origin value for origin,
+// and whether it's allowed.
+func (s *Server) corsAllowedOrigin(origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+
+	for _, allowed := range s.corsOrigins {
+		if allowed == "*" {
+			return "*", true
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin, true
+		}
+	}
+
+	return "", false
+}
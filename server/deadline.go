@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/saracen/lfscache/cache"
+)
+
+// fetchDeadline cancels a fetch that takes too long or transfers too slowly,
+// remembering why so that the fetch fails with a descriptive error rather
+// than a bare context cancellation.
+type fetchDeadline struct {
+	cancel context.CancelFunc
+	timer  *time.Timer
+	done   chan struct{}
+
+	lock sync.Mutex
+	err  error
+}
+
+// fetchContext returns the context an upstream fetch writing to hcw runs
+// with, bounded by the configured fetch timeout and minimum fetch rate. A
+// fetch writing to the cache is also cancelled if the cache closes its
+// writer, w, as it does once the maximum inflight duration is exceeded.
+func (s *Server) fetchContext(hcw *hashCountWriter, w io.Writer) (context.Context, *fetchDeadline) {
+	ctx, cancel := context.WithCancel(s.fetchCtx)
+	d := &fetchDeadline{cancel: cancel, done: make(chan struct{})}
+
+	if s.fetchTimeout > 0 {
+		timeout := s.fetchTimeout
+		d.timer = time.AfterFunc(timeout, func() {
+			d.abort(fmt.Errorf("fetch exceeded timeout of %v", timeout))
+		})
+	}
+	if s.minFetchRate > 0 && s.minRateWindow > 0 {
+		go d.watch(hcw, s.minFetchRate, s.minRateWindow)
+	}
+	if crw, ok := w.(*cache.ConcurrentReadWriter); ok {
+		go d.watchClosed(crw)
+	}
+
+	return ctx, d
+}
+
+// watch aborts the fetch if fewer than rate bytes per second are written to
+// hcw over any window.
+func (d *fetchDeadline) watch(hcw *hashCountWriter, rate int64, window time.Duration) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+
+	last := atomic.LoadInt64(&hcw.progress)
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+
+		n := atomic.LoadInt64(&hcw.progress)
+		if float64(n-last)/window.Seconds() < float64(rate) {
+			d.abort(fmt.Errorf("fetch rate %s fell below minimum of %d bytes/s", formatByteRate(uint64(n-last), window), rate))
+			return
+		}
+		last = n
+	}
+}
+
+// watchClosed aborts the fetch if crw is closed before it finishes, such as
+// by the cache once the key's inflight duration is exceeded, so that a hung
+// fetch doesn't keep holding its fetch slot.
+func (d *fetchDeadline) watchClosed(crw *cache.ConcurrentReadWriter) {
+	select {
+	case <-d.done:
+	case <-crw.Done():
+		d.abort(cache.ErrInflightExpired)
+	}
+}
+
+func (d *fetchDeadline) abort(err error) {
+	d.lock.Lock()
+	if d.err == nil {
+		d.err = err
+	}
+	d.lock.Unlock()
+
+	d.cancel()
+}
+
+// reason returns the error a fetch should fail with: the reason it was
+// aborted if it was, otherwise err. Aborted fetches are retryable, the data
+// written so far is intact.
+func (d *fetchDeadline) reason(err error) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.err == nil {
+		return err
+	}
+
+	return cache.Retryable(d.err)
+}
+
+// stop releases the deadline's resources once the fetch has finished.
+func (d *fetchDeadline) stop() {
+	close(d.done)
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.cancel()
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// ContentErrorResponse is the body of an error response from the cache
+// content endpoint.
+type ContentErrorResponse struct {
+	Message string `json:"message"`
+	OID     string `json:"oid,omitempty"`
+}
+
+// writeContentError writes status with a JSON body explaining the error.
+func writeContentError(w http.ResponseWriter, status int, oid, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ContentErrorResponse{Message: message, OID: oid})
+}
+
+// fetchErrorMessage returns the message reported to clients for a failed
+// fetch. Transport errors can include the signed upstream href, so only
+// upstream status errors are described.
+func fetchErrorMessage(err error) string {
+	var statusErr upstreamStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Error()
+	}
+
+	return "fetching object from upstream failed"
+}
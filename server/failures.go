@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/saracen/lfscache/cache"
+)
+
+// upstreamStatusError is returned by fetch when the upstream responds with an
+// unexpected status.
+type upstreamStatusError struct {
+	code int
+}
+
+func (e upstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream server responded with %d status", e.code)
+}
+
+// fetchErrorStatus returns the status reported to clients for a failed fetch.
+// Upstream client errors are passed on. Transient failures, such as dropped
+// connections, slow transfers and fetches abandoned during shutdown, are
+// reported as unavailable so that clients retry them, and others are reported
+// as a bad gateway.
+func fetchErrorStatus(err error) int {
+	var statusErr upstreamStatusError
+	if errors.As(err, &statusErr) && statusErr.code >= 400 && statusErr.code < 500 {
+		return statusErr.code
+	}
+	if cache.IsRetryable(err) || errors.Is(err, context.Canceled) {
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusBadGateway
+}
+
+// setRetryAfter sets the Retry-After header to d, rounded up to the second.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	seconds := int64((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
+
+// fetchFailures remembers recently failed fetches, so that client retries
+// fail fast with the same status rather than each starting a new fetch.
+type fetchFailures struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries map[string]fetchFailure
+}
+
+type fetchFailure struct {
+	status  int
+	err     error
+	expires time.Time
+}
+
+func newFetchFailures(ttl time.Duration) *fetchFailures {
+	return &fetchFailures{
+		ttl:     ttl,
+		entries: make(map[string]fetchFailure),
+	}
+}
+
+// add records a failed fetch. Fetches cancelled during shutdown aren't
+// recorded.
+func (ff *fetchFailures) add(key string, err error) {
+	if ff == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+
+	now := time.Now()
+	for k, failure := range ff.entries {
+		if now.After(failure.expires) {
+			delete(ff.entries, k)
+		}
+	}
+
+	ff.entries[key] = fetchFailure{
+		status:  fetchErrorStatus(err),
+		err:     err,
+		expires: now.Add(ff.ttl),
+	}
+}
+
+// get returns a recent failure for a key, if there is one.
+func (ff *fetchFailures) get(key string) (fetchFailure, bool) {
+	if ff == nil {
+		return fetchFailure{}, false
+	}
+
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+
+	failure, ok := ff.entries[key]
+	if !ok || time.Now().After(failure.expires) {
+		return fetchFailure{}, false
+	}
+
+	return failure, true
+}
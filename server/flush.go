@@ -0,0 +1,67 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// availableReaderAt is implemented by the cache's readers of inflight
+// objects, which can return the data fetched so far rather than waiting to
+// fill each read.
+type availableReaderAt interface {
+	ReadAvailableAt(p []byte, off int64) (int, error)
+}
+
+// availableReader reads size bytes from r as they're fetched. Unlike an
+// io.SectionReader, whose reads wait until the whole buffer has been fetched,
+// reads return as soon as any data is available, so that it can be flushed
+// to the client.
+type availableReader struct {
+	r    availableReaderAt
+	off  int64
+	size int64
+}
+
+func (ar *availableReader) Read(p []byte) (int, error) {
+	if ar.off >= ar.size {
+		return 0, io.EOF
+	}
+	if max := ar.size - ar.off; int64(len(p)) > max {
+		p = p[:max]
+	}
+
+	n, err := ar.r.ReadAvailableAt(p, ar.off)
+	ar.off += int64(n)
+	return n, err
+}
+
+func (ar *availableReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += ar.off
+	case io.SeekEnd:
+		offset += ar.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek to negative offset")
+	}
+
+	ar.off = offset
+	return offset, nil
+}
+
+// flushWriter flushes each write to the client, rather than leaving it in
+// the response buffer until enough has been written to fill it.
+type flushWriter struct {
+	http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if err == nil {
+		w.flusher.Flush()
+	}
+	return n, err
+}
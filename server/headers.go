@@ -0,0 +1,74 @@
+package server
+
+import "net/http"
+
+// withServeHeaders adds the configured serve headers to next's successful
+// responses.
+func (s *Server) withServeHeaders(next http.Handler) http.Handler {
+	if len(s.serveHeaders) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&serveHeaderWriter{ResponseWriter: w, header: s.serveHeaders}, r)
+	})
+}
+
+// serveHeaderWriter sets headers when a successful status is written, or any
+// final status if anyStatus is set.
+type serveHeaderWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	anyStatus   bool
+	wroteHeader bool
+}
+
+func (w *serveHeaderWriter) WriteHeader(code int) {
+	// informational responses are followed by the final status
+	if !w.wroteHeader && code >= http.StatusOK {
+		w.wroteHeader = true
+		if w.anyStatus || code < http.StatusMultipleChoices || code == http.StatusNotModified {
+			for key, values := range w.header {
+				w.Header().Del(key)
+				for _, value := range values {
+					w.Header().Add(key, value)
+				}
+			}
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *serveHeaderWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *serveHeaderWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// stripHeaders removes the named headers from header.
+func stripHeaders(header http.Header, names []string) {
+	for _, name := range names {
+		header.Del(name)
+	}
+}
+
+// modifyResponse returns a proxy ModifyResponse function that strips the
+// configured response headers before calling modify, if it isn't nil.
+func (s *Server) modifyResponse(modify func(*http.Response) error) func(*http.Response) error {
+	return func(r *http.Response) error {
+		stripHeaders(r.Header, s.stripResponseHeaders)
+		if modify == nil {
+			return nil
+		}
+		return modify(r)
+	}
+}
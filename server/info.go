@@ -0,0 +1,49 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+)
+
+var infoTemplate = template.Must(template.New("info").Parse(`<!DOCTYPE html>
+<html>
+<head><title>lfscache</title></head>
+<body>
+<h1>lfscache</h1>
+<p>lfscache is a caching proxy for Git LFS servers.</p>
+<table>
+<tr><td>Version</td><td>{{.Version}}</td></tr>
+<tr><td>Upstream</td><td>{{.Upstream}}</td></tr>
+</table>
+<p>To use this cache, point your Git LFS client at it:</p>
+<pre>git config lfs.url {{.URL}}</pre>
+</body>
+</html>
+`))
+
+func (s *Server) info(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// hrefs are rewritten to the same URL clients should use, and with a
+		// host only upstream, clients put the project in the URL
+		lfsURL := s.cacheURL(&originalHost{http: r.TLS == nil, host: r.Host}, "/").String()
+		if s.hostOnly {
+			lfsURL += "ORG/REPO.git/info/lfs"
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		infoTemplate.Execute(w, struct {
+			Version  string
+			Upstream string
+			URL      string
+		}{
+			Version:  s.version,
+			Upstream: s.upstream.String(),
+			URL:      lfsURL,
+		})
+	})
+}
@@ -0,0 +1,138 @@
+//go:build integration
+// +build integration
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestIntegrationGitLFS runs a real git-lfs client against two lfscache
+// instances sharing an HMAC key: batch requests are handled by the first and
+// content requests by the second.
+//
+// Run with: go test -tags integration ./server/
+func TestIntegrationGitLFS(t *testing.T) {
+	if _, err := exec.LookPath("git-lfs"); err != nil {
+		t.Skip("git-lfs not found in PATH")
+	}
+
+	content := []byte("lfscache integration test content\n")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	var downloads int32
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/objects/batch":
+			w.Header().Set("Content-Type", "application/vnd.git-lfs+json")
+			json.NewEncoder(w).Encode(BatchResponse{
+				Transfer: "basic",
+				Objects: []*BatchObjectResponse{
+					{
+						OID:  oid,
+						Size: int64(len(content)),
+						Actions: map[string]*BatchObjectActionResponse{
+							"download": {
+								Href: upstream.URL + "/download/" + oid,
+							},
+						},
+					},
+				},
+			})
+
+		case "/download/" + oid:
+			atomic.AddInt32(&downloads, 1)
+			w.Write(content)
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	tmp, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	key := make([]byte, 64)
+	copy(key, "shared integration test key")
+
+	// content replica
+	contentServer, err := New(log.NewNopLogger(), upstream.URL, filepath.Join(tmp, "cache2"), WithHMACKey(key))
+	require.NoError(t, err)
+	replica := httptest.NewServer(contentServer.Handle())
+	defer replica.Close()
+
+	replicaURL, err := url.Parse(replica.URL)
+	require.NoError(t, err)
+
+	// batch replica, pointing content hrefs at the content replica
+	batchServer, err := New(log.NewNopLogger(), upstream.URL, filepath.Join(tmp, "cache1"), WithHMACKey(key))
+	require.NoError(t, err)
+	batchServer.ObjectBatchActionURLRewriter = func(href *url.URL) *url.URL {
+		href.Host = replicaURL.Host
+		return href
+	}
+	proxy := httptest.NewServer(batchServer.Handle())
+	defer proxy.Close()
+
+	git := func(dir string, args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"HOME="+tmp,
+			"GIT_CONFIG_NOSYSTEM=1",
+			"GIT_LFS_SKIP_SMUDGE=1",
+			"GIT_AUTHOR_NAME=lfscache",
+			"GIT_AUTHOR_EMAIL=lfscache@example.com",
+			"GIT_COMMITTER_NAME=lfscache",
+			"GIT_COMMITTER_EMAIL=lfscache@example.com",
+		)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, "git %v: %s", args, out)
+	}
+
+	origin := filepath.Join(tmp, "origin")
+	require.NoError(t, os.MkdirAll(origin, 0700))
+	git(tmp, "lfs", "install", "--skip-repo")
+	git(origin, "init")
+
+	pointer := fmt.Sprintf("version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n", oid, len(content))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(origin, ".gitattributes"), []byte("*.bin filter=lfs diff=lfs merge=lfs -text\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(origin, "object.bin"), []byte(pointer), 0600))
+	git(origin, "add", ".gitattributes", "object.bin")
+	git(origin, "commit", "-m", "add object")
+
+	for i := 0; i < 2; i++ {
+		clone := filepath.Join(tmp, fmt.Sprintf("clone%d", i))
+		git(tmp, "clone", origin, clone)
+		git(clone, "config", "lfs.url", proxy.URL+"/")
+		git(clone, "lfs", "pull")
+
+		data, err := ioutil.ReadFile(filepath.Join(clone, "object.bin"))
+		require.NoError(t, err)
+		assert.Equal(t, content, data)
+	}
+
+	// the second pull must have been served from the content replica's cache
+	assert.Equal(t, int32(1), atomic.LoadInt32(&downloads))
+	assert.FileExists(t, filepath.Join(tmp, "cache2", "objects", oid[0:2], oid[2:4], oid))
+}
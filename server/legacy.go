@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// LegacyObjectResponse represents a legacy API object response payload.
+//
+// https://github.com/git-lfs/git-lfs/blob/v1.5.0/docs/api/v1/http-v1-original.md
+type LegacyObjectResponse struct {
+	OID   string                                `json:"oid"`
+	Size  int64                                 `json:"size"`
+	Links map[string]*BatchObjectActionResponse `json:"_links,omitempty"`
+}
+
+// legacy handles the single object legacy API endpoint (GET /objects/:oid,
+// under a project path for host only upstreams), routing downloads through
+// the cache the same way batch downloads are.
+func (s *Server) legacy() http.Handler {
+	proxy := s.proxy()
+	proxy.ModifyResponse = s.modifyResponse(func(r *http.Response) error {
+		if r.StatusCode != http.StatusOK {
+			return nil
+		}
+
+		var or LegacyObjectResponse
+		compress, err := decodeResponse(r, &or)
+		if err != nil {
+			return err
+		}
+
+		if action, ok := or.Links["download"]; ok && s.rewritable(or.Size, action) {
+			s.rewriteAction(r.Request, or.OID, or.Size, action)
+		}
+
+		return encodeResponse(&or, compress, r, s.maxBatchBuffer)
+	})
+
+	passthrough := s.passthrough()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dir, oid := path.Split(r.URL.Path)
+		if r.Method != http.MethodGet || oid == "" || !strings.HasSuffix(dir, "/objects/") {
+			passthrough.ServeHTTP(w, r)
+			return
+		}
+
+		proxy.ServeHTTP(w, r)
+	})
+}
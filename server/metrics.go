@@ -0,0 +1,77 @@
+package server
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics/expvar"
+	"github.com/saracen/lfscache/cache"
+)
+
+// Metrics are published with expvar, and are shared by all servers in the
+// process.
+var (
+	metricPromotionSeconds = expvar.NewHistogram("lfscache_promotion_seconds", 50)
+	metricPromotionErrors  = expvar.NewCounter("lfscache_promotion_errors_total")
+	metricScrubbedObjects  = expvar.NewCounter("lfscache_scrubbed_objects_total")
+	metricScrubCorrupt     = expvar.NewCounter("lfscache_scrub_corrupt_objects_total")
+	metricScrubErrors      = expvar.NewCounter("lfscache_scrub_errors_total")
+	metricQueuedRequests   = expvar.NewGauge("lfscache_queued_requests")
+	metricShedRequests     = expvar.NewCounter("lfscache_shed_requests_total")
+	metricBypassedRequests = expvar.NewCounter("lfscache_bypassed_requests_total")
+	metricCacheWriteErrors = expvar.NewCounter("lfscache_cache_write_errors_total")
+	metricBackedUpObjects  = expvar.NewCounter("lfscache_backed_up_objects_total")
+	metricBackupErrors     = expvar.NewCounter("lfscache_backup_errors_total")
+	metricCacheWritable    = expvar.NewGauge("lfscache_cache_writable")
+	metricBatchRetries     = expvar.NewCounter("lfscache_batch_retries_total")
+	metricServeBufferBytes = expvar.NewGauge("lfscache_serve_buffer_bytes")
+	metricChecksumRetries  = expvar.NewCounter("lfscache_checksum_retries_total")
+	metricDiskTotalBytes   = expvar.NewGauge("lfscache_cache_disk_total_bytes")
+	metricDiskUsedBytes    = expvar.NewGauge("lfscache_cache_disk_used_bytes")
+	metricDiskFreeBytes    = expvar.NewGauge("lfscache_cache_disk_free_bytes")
+)
+
+// diskUsageInterval is how often the cache filesystem's usage is sampled.
+const diskUsageInterval = 30 * time.Second
+
+// promoted is called by the cache once a completed download has been moved
+// into the cache directory.
+func (s *Server) promoted(oid string, took time.Duration, err error) {
+	metricPromotionSeconds.Observe(took.Seconds())
+
+	logger := log.With(s.logger, "event", "promoted", "oid", oid, "took", took)
+	if err != nil {
+		metricPromotionErrors.Add(1)
+		level.Error(logger).Log("err", err)
+		return
+	}
+
+	level.Info(logger).Log()
+
+	s.backup.send(oid, filepath.Join(s.cache.Directory(), cache.DirObjects, s.cache.ObjectName(oid)))
+}
+
+// sampleDiskUsage periodically updates the cache filesystem usage gauges. It
+// returns if usage can't be determined on this platform.
+func (s *Server) sampleDiskUsage() {
+	ticker := time.NewTicker(diskUsageInterval)
+	defer ticker.Stop()
+
+	for {
+		usage, err := s.cache.DiskUsage()
+		if err == cache.ErrDiskUsageUnsupported {
+			return
+		}
+		if err != nil {
+			level.Error(s.logger).Log("event", "disk-usage", "err", err)
+		} else {
+			metricDiskTotalBytes.Set(float64(usage.Total))
+			metricDiskUsedBytes.Set(float64(usage.Used))
+			metricDiskFreeBytes.Set(float64(usage.Free))
+		}
+
+		<-ticker.C
+	}
+}
@@ -0,0 +1,595 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"hash"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/saracen/lfscache/cache"
+)
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithCacheOptions sets the options used when creating the filesystem cache.
+func WithCacheOptions(options ...cache.Option) Option {
+	return func(s *Server) {
+		s.cacheOptions = append(s.cacheOptions, options...)
+	}
+}
+
+// WithVersion sets the version reported by the info page and in the
+// User-Agent sent upstream.
+func WithVersion(version string) Option {
+	return func(s *Server) {
+		s.version = version
+	}
+}
+
+// WithInfoPage enables an informational page served at the bare root path.
+func WithInfoPage() Option {
+	return func(s *Server) {
+		s.infoPage = true
+	}
+}
+
+// WithWireCompression enables compressing served objects on the wire using
+// the best encoding (brotli or gzip) advertised by the client.
+func WithWireCompression() Option {
+	return func(s *Server) {
+		s.wireCompression = true
+	}
+}
+
+// WithUserAgent sets a fixed User-Agent for requests sent upstream. By
+// default, lfscache/<version> is appended to the client's User-Agent.
+func WithUserAgent(userAgent string) Option {
+	return func(s *Server) {
+		s.userAgent = userAgent
+	}
+}
+
+// WithForwardHeaders sets additional client headers that are captured from
+// batch requests and replayed when fetching objects upstream.
+func WithForwardHeaders(headers ...string) Option {
+	return func(s *Server) {
+		for _, header := range headers {
+			if header = strings.TrimSpace(header); header != "" {
+				s.forwardHeaders = append(s.forwardHeaders, http.CanonicalHeaderKey(header))
+			}
+		}
+	}
+}
+
+// WithHMACKey sets the key used to sign and verify cache content requests.
+// Instances sharing a key can serve content requests signed by each other.
+// By default, a random key is generated.
+func WithHMACKey(key []byte) Option {
+	return func(s *Server) {
+		s.hmacKey = key
+	}
+}
+
+// WithHMACHash sets the hash function used by the HMAC that signs and
+// verifies cache content requests. Instances sharing a key must also use the
+// same hash. By default, SHA-256 is used, and the random key generated when
+// no key is given is the hash's block size in length.
+func WithHMACHash(h func() hash.Hash) Option {
+	return func(s *Server) {
+		s.hmacHash = h
+	}
+}
+
+// WithUpstreamConnLimits configures connection pooling for upstream requests.
+// A maxConnsPerHost of zero means no limit.
+func WithUpstreamConnLimits(maxIdleConns, maxIdleConnsPerHost, maxConnsPerHost int, idleConnTimeout time.Duration) Option {
+	return func(s *Server) {
+		transport := s.client.Transport.(*http.Transport)
+		transport.MaxIdleConns = maxIdleConns
+		transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+		transport.MaxConnsPerHost = maxConnsPerHost
+		transport.IdleConnTimeout = idleConnTimeout
+	}
+}
+
+// WithUpstreamClientCertificate sets the client certificate presented to
+// upstreams that require mutual TLS, for both proxied requests and fetches.
+func WithUpstreamClientCertificate(cert tls.Certificate) Option {
+	return func(s *Server) {
+		transport := s.client.Transport.(*http.Transport)
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.Certificates = append(transport.TLSClientConfig.Certificates, cert)
+	}
+}
+
+// WithWebhook enables posting JSON events about fetches, and about objects
+// evicted from the cache, to the given URL. Delivery is best-effort and never
+// blocks request handling.
+func WithWebhook(url string) Option {
+	return func(s *Server) {
+		s.webhookURL = url
+	}
+}
+
+// WithFetchConcurrency limits the number of concurrent upstream fetches.
+// Fetches beyond the limit wait for a free slot.
+func WithFetchConcurrency(limit int) Option {
+	return func(s *Server) {
+		if limit > 0 {
+			s.fetches = newFetchScheduler(limit)
+		}
+	}
+}
+
+// WithFetchPriority enables priority scheduling of fetches waiting for a
+// slot. A fetch's priority is taken from the client's PriorityHeader, or the
+// default priority if it isn't set. Equal priority fetches of smaller objects
+// are started first.
+func WithFetchPriority(defaultPriority int) Option {
+	return func(s *Server) {
+		s.prioritize = true
+		s.defaultPriority = defaultPriority
+	}
+}
+
+// WithSkipChecksum disables verifying the checksum of fetched objects. This
+// saves CPU for fully trusted upstreams, but corrupt downloads will be cached.
+func WithSkipChecksum() Option {
+	return func(s *Server) {
+		s.skipChecksum = true
+	}
+}
+
+// WithParallelFetch fetches large objects as the given number of byte ranges
+// in parallel, if the upstream supports range requests.
+func WithParallelFetch(parts int) Option {
+	return func(s *Server) {
+		s.parallelFetch = parts
+	}
+}
+
+// WithAuthCache caches download batch responses to authenticated requests in
+// memory for the given duration, keyed by a hash of the request and its
+// credentials. Identical requests within that time are answered without
+// revalidating the credentials upstream. Responses are never cached beyond
+// the expiry of the hrefs they contain.
+func WithAuthCache(ttl time.Duration) Option {
+	return func(s *Server) {
+		if ttl > 0 {
+			if s.batchCache == nil {
+				s.batchCache = newBatchCache()
+			}
+			s.batchCache.authTTL = ttl
+		}
+	}
+}
+
+// WithBatchCache caches download batch responses in memory for the given
+// duration, keyed by a hash of the request body and credentials. Retried or
+// repeated batch requests within that time are answered without an upstream
+// round trip. Hrefs are re-signed each time a cached response is served, and
+// responses are never cached beyond the expiry of the hrefs they contain.
+// Upload batch responses are never cached.
+//
+// If WithAuthCache is also used, its duration applies to authenticated
+// requests instead.
+func WithBatchCache(ttl time.Duration) Option {
+	return func(s *Server) {
+		if ttl > 0 {
+			if s.batchCache == nil {
+				s.batchCache = newBatchCache()
+			}
+			s.batchCache.ttl = ttl
+		}
+	}
+}
+
+// WithAllowedUpstreamHosts restricts the hosts objects are fetched from.
+// Content requests for hrefs on other hosts are rejected, and redirects to
+// other hosts are not followed. Hosts match with or without a port.
+func WithAllowedUpstreamHosts(hosts ...string) Option {
+	return func(s *Server) {
+		s.allowedHosts = make(map[string]bool)
+		for _, host := range hosts {
+			if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+				s.allowedHosts[host] = true
+			}
+		}
+
+		s.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if !s.upstreamAllowed(req.URL.String()) {
+				return errUpstreamHostNotAllowed
+			}
+			return nil
+		}
+	}
+}
+
+// WithMaxBatchBodySize rejects batch requests with bodies larger than size
+// bytes with 413 Request Entity Too Large, rather than proxying them.
+func WithMaxBatchBodySize(size int64) Option {
+	return func(s *Server) {
+		s.maxBatchBody = size
+	}
+}
+
+// WithFailedFetchTTL remembers failed fetches for the given duration. Requests
+// for the object within that time fail immediately with the same status,
+// rather than each retry starting a new upstream fetch.
+func WithFailedFetchTTL(ttl time.Duration) Option {
+	return func(s *Server) {
+		if ttl > 0 {
+			s.failures = newFetchFailures(ttl)
+		}
+	}
+}
+
+// WithAdminToken enables the administrative endpoints, the cached objects
+// listing at /_lfs_cache/objects, object refreshes at
+// /_lfs_cache/refresh/:oid and object pins at /_lfs_cache/pin/:oid, for
+// requests authenticated with the token as a bearer token.
+func WithAdminToken(token string) Option {
+	return func(s *Server) {
+		s.adminToken = token
+	}
+}
+
+// WithStripPrefix serves requests under a path prefix, such as when behind an
+// ingress that routes a prefixed path to lfscache without stripping it. The
+// prefix is removed before routing, and included in rewritten hrefs.
+// Requests without the prefix are not found.
+func WithStripPrefix(prefix string) Option {
+	return func(s *Server) {
+		s.pathPrefix = "/" + strings.Trim(prefix, "/")
+		if s.pathPrefix == "/" {
+			s.pathPrefix = ""
+		}
+	}
+}
+
+// WithUpstreamResponseHeaderTimeout sets how long to wait for upstream
+// response headers, for both proxied requests and fetches. Timeouts for
+// specific hosts override the default, and match with or without a port.
+func WithUpstreamResponseHeaderTimeout(timeout time.Duration, hosts map[string]time.Duration) Option {
+	return func(s *Server) {
+		s.client.Transport.(*http.Transport).ResponseHeaderTimeout = timeout
+
+		s.headerTimeouts = make(map[string]time.Duration)
+		for host, timeout := range hosts {
+			s.headerTimeouts[strings.ToLower(host)] = timeout
+		}
+	}
+}
+
+// WithMissRedirect redirects clients to the original href on a cache miss,
+// rather than proxying the object, whilst fetching it into the cache in the
+// background. Hrefs that require upstream headers are proxied as usual, as
+// the headers can't be passed on with a redirect. Redirected misses aren't
+// shed by the serve buffer budget or proxied by the soft fetch limit, as they
+// neither use a serve buffer nor wait on their fetch.
+func WithMissRedirect() Option {
+	return func(s *Server) {
+		s.missRedirect = true
+	}
+}
+
+// WithUpstreamMirror sets a mirror that objects are fetched from when the
+// upstream fails with an error or a server error status. Hrefs under the
+// upstream URL are rebased onto the mirror URL, and other hrefs are fetched
+// from the mirror's host with the same path. The mirror is sent the same
+// headers as the upstream.
+func WithUpstreamMirror(mirror *url.URL) Option {
+	return func(s *Server) {
+		s.mirror = mirror
+	}
+}
+
+// WithAudit logs the objects that would have been cached by a server created
+// with NewNoCache, along with a summary of the projected cache size and hit
+// rate every interval (0 disables the summary). It has no effect on caching
+// servers.
+func WithAudit(interval time.Duration) Option {
+	return func(s *Server) {
+		s.audit = newAudit(interval)
+	}
+}
+
+// WithMinRewriteSize only routes downloads of objects of at least size bytes
+// through the cache. Smaller objects keep their original href, and clients
+// download them directly from the upstream.
+func WithMinRewriteSize(size int64) Option {
+	return func(s *Server) {
+		s.minRewriteSize = size
+	}
+}
+
+// WithRewriteExpiryMargin leaves download hrefs that expire within margin
+// unmodified, so that clients download them directly from the upstream
+// before they expire, rather than risk the cache's fetch starting too late.
+func WithRewriteExpiryMargin(margin time.Duration) Option {
+	return func(s *Server) {
+		s.expiryMargin = margin
+	}
+}
+
+// WithFetchTimeout aborts fetches whose transfer takes longer than timeout in
+// total, unlike WithUpstreamResponseHeaderTimeout which only bounds the wait
+// for the upstream's response headers. The data fetched so far is kept if
+// partials are enabled in the cache.
+func WithFetchTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.fetchTimeout = timeout
+	}
+}
+
+// WithMinFetchRate aborts fetches that download less than rate bytes per
+// second, measured over each window. This catches stalled or trickling
+// upstreams that would otherwise hold a fetch slot, and the clients waiting
+// on it, indefinitely.
+func WithMinFetchRate(rate int64, window time.Duration) Option {
+	return func(s *Server) {
+		s.minFetchRate = rate
+		s.minRateWindow = window
+	}
+}
+
+// WithRetryAfter sets the Retry-After duration sent with 503 responses to
+// transient failures, such as an unavailable cache or an interrupted fetch.
+// The default is DefaultRetryAfter.
+func WithRetryAfter(d time.Duration) Option {
+	return func(s *Server) {
+		s.retryAfter = d
+	}
+}
+
+// WithBackgroundScrub re-hashes count cached objects every interval, cycling
+// through the whole cache over time. Objects whose content no longer matches
+// their OID are moved to the cache's quarantine directory and fetched again
+// on their next request.
+func WithBackgroundScrub(interval time.Duration, count int) Option {
+	return func(s *Server) {
+		s.scrubInterval = interval
+		s.scrubCount = count
+	}
+}
+
+// WithMaxQueuedRequests sheds load once max content requests are waiting for
+// their fetches to start, for example because the fetch concurrency limit has
+// been reached. Further content requests are rejected with a 503, a
+// Retry-After and Connection: close until the queue drains.
+func WithMaxQueuedRequests(max int) Option {
+	return func(s *Server) {
+		s.maxQueued = int64(max)
+	}
+}
+
+// WithServeHeaders adds headers to successful content responses, replacing
+// any of the same name. As objects are content addressed, a long lived
+// Cache-Control lets a CDN in front of lfscache cache them indefinitely.
+// Error responses don't get the headers, so that they aren't cached.
+func WithServeHeaders(header http.Header) Option {
+	return func(s *Server) {
+		s.serveHeaders = header
+	}
+}
+
+// WithoutUpstreamPathSeparator keeps the upstream URL's path as given, rather
+// than suffixing it with a separator. Requests for the proxy's root are then
+// sent to the exact upstream path, for upstreams that don't accept a trailing
+// separator. Other requests resolve under the upstream path either way.
+func WithoutUpstreamPathSeparator() Option {
+	return func(s *Server) {
+		s.exactUpstream = true
+	}
+}
+
+// WithHostOnlyUpstream treats the upstream URL as a scheme and host only,
+// ignoring any path, and keeps the client's request path in full. One cache
+// can then front every project on the upstream host, with clients putting the
+// project in their LFS URL, for example
+// http://lfscache:9876/org/repo.git/info/lfs.
+func WithHostOnlyUpstream() Option {
+	return func(s *Server) {
+		s.hostOnly = true
+	}
+}
+
+// WithMaxBatchBufferSize sets the size in bytes above which rewritten batch
+// responses are streamed to the client as they're encoded, without a
+// Content-Length, rather than buffered in memory. 0 always buffers. The
+// default is DefaultMaxBatchBufferSize.
+func WithMaxBatchBufferSize(size int64) Option {
+	return func(s *Server) {
+		s.maxBatchBuffer = size
+	}
+}
+
+// WithSourceHeader sets the SourceHeader on content responses, so that
+// clients can tell whether a request was served from the cache.
+func WithSourceHeader() Option {
+	return func(s *Server) {
+		s.sourceHeader = true
+	}
+}
+
+// WithCORS answers CORS preflight requests, and adds CORS headers to
+// responses, for the content and batch endpoints when the request's origin is
+// one of origins. An origin of "*" allows any origin. Preflight responses are
+// cacheable by browsers for maxAge, if non-zero. Requests proxied to the
+// upstream as is aren't affected.
+func WithCORS(origins []string, maxAge time.Duration) Option {
+	return func(s *Server) {
+		for _, origin := range origins {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				s.corsOrigins = append(s.corsOrigins, origin)
+			}
+		}
+		s.corsMaxAge = maxAge
+	}
+}
+
+// WithoutPassthrough responds with a 404 to requests that aren't for the
+// batch, legacy object download or cached content endpoints, rather than
+// proxying them to the upstream. This includes other LFS API endpoints, such
+// as locks.
+func WithoutPassthrough() Option {
+	return func(s *Server) {
+		s.noPassthrough = true
+	}
+}
+
+// WithSoftFetchLimit proxies content requests for objects that aren't cached
+// directly from the upstream, without caching them, whilst limit or more
+// fetches are inflight. Unlike WithFetchConcurrency, clients aren't delayed
+// waiting for a fetch slot, at the cost of those objects not being cached.
+// Caching resumes once fewer fetches are inflight.
+func WithSoftFetchLimit(limit int) Option {
+	return func(s *Server) {
+		s.softFetchLimit = int64(limit)
+	}
+}
+
+// WithBackupDirectory copies each newly cached object to directory, laid out
+// the same way as the cache directory so that it can replace it, using the
+// given number of workers. Copies are made asynchronously after an object is
+// cached and are retried a few times; objects that still can't be copied, or
+// that arrive whilst the backup queue is full, are logged and counted but
+// otherwise don't affect serving.
+func WithBackupDirectory(directory string, workers int) Option {
+	return func(s *Server) {
+		s.backupDir = directory
+		s.backupWorkers = workers
+	}
+}
+
+// WithVerbatimBatchObjects copies the objects of batch responses as the
+// upstream encoded them, rather than re-encoding them, for clients that are
+// sensitive to field order or formatting. Objects that aren't rewritten are
+// copied byte for byte, and of those that are, only the rewritten actions are
+// re-encoded. It has no effect on responses served from the batch cache,
+// which are always re-encoded.
+func WithVerbatimBatchObjects() Option {
+	return func(s *Server) {
+		s.verbatimBatch = true
+	}
+}
+
+// WithFilenamer sets the function used to name cached files on disk, relative
+// to the cache's objects directory. It's shorthand for passing
+// cache.WithFilenamer to WithCacheOptions, see cache.FilesystemCache's
+// Filenamer for its requirements.
+func WithFilenamer(filenamer func(key string) string) Option {
+	return WithCacheOptions(cache.WithFilenamer(filenamer))
+}
+
+// WithReadinessProbe probes that the cache can be written to every interval,
+// with the readiness endpoint reporting the latest result. Without it, the
+// cache is probed on each request to the readiness endpoint instead.
+func WithReadinessProbe(interval time.Duration) Option {
+	return func(s *Server) {
+		s.probeInterval = interval
+	}
+}
+
+// WithStripRequestHeaders removes the named headers from requests to the
+// upstream: proxied client requests, such as batch requests, and object
+// fetches, including headers captured with WithForwardHeaders.
+func WithStripRequestHeaders(headers ...string) Option {
+	return func(s *Server) {
+		for _, header := range headers {
+			if header = strings.TrimSpace(header); header != "" {
+				s.stripRequestHeaders = append(s.stripRequestHeaders, http.CanonicalHeaderKey(header))
+			}
+		}
+	}
+}
+
+// WithStripResponseHeaders removes the named headers from upstream responses
+// proxied to clients, such as batch responses. Cached content responses
+// don't include upstream headers.
+func WithStripResponseHeaders(headers ...string) Option {
+	return func(s *Server) {
+		for _, header := range headers {
+			if header = strings.TrimSpace(header); header != "" {
+				s.stripResponseHeaders = append(s.stripResponseHeaders, http.CanonicalHeaderKey(header))
+			}
+		}
+	}
+}
+
+// WithBatchRetries retries batch requests that fail with a transport error
+// or a 502, 503 or 504 response up to retries times. Each retry waits a
+// random duration of up to base, doubled for each retry and capped at max,
+// so that retries from many clients spread out rather than arriving at a
+// recovering upstream together.
+func WithBatchRetries(retries int, base, max time.Duration) Option {
+	return func(s *Server) {
+		s.batchRetries = retries
+		s.batchRetryBase = base
+		s.batchRetryMax = max
+	}
+}
+
+// WithFlushInflight streams objects that are being fetched to clients as the
+// data arrives, flushing each write, rather than waiting for each read of the
+// object and the response buffer to fill. It lowers the time to first byte of
+// cold objects, at the cost of more, smaller writes to the client.
+func WithFlushInflight() Option {
+	return func(s *Server) {
+		s.flushInflight = true
+	}
+}
+
+// WithServeBufferBudget limits the estimated memory of the buffers serving
+// objects that aren't on disk to bytes. Each request streaming a fresh or
+// inflight object holds its own buffer, so many simultaneous pulls of cold
+// objects can use a lot of memory. Once the budget is reached, requests for
+// objects that aren't cached are shed with a 503 rather than fetched. The
+// memory in use is reported by the lfscache_serve_buffer_bytes metric.
+func WithServeBufferBudget(bytes int64) Option {
+	return func(s *Server) {
+		s.bufferBudget = bytes
+	}
+}
+
+// WithCanonicalHost rewrites batch response hrefs to host, such as
+// "cache.example.com" or "cache.example.com:8080", rather than the host the
+// batch request was made to. The cache can be served under several hostnames
+// either way, as hrefs are signed without their host, but pinning them keeps
+// the URLs clients are given stable across the names they reach it by.
+func WithCanonicalHost(host string) Option {
+	return func(s *Server) {
+		s.canonicalHost = host
+	}
+}
+
+// WithPublicURL rewrites batch response hrefs to the scheme and host of u,
+// such as https://cache.example.com, rather than deriving them from the
+// batch request's Host and TLS. It's for deployments where the host lfscache
+// sees, such as an internal service name behind an ingress, isn't reachable
+// by clients. It takes precedence over WithCanonicalHost, and u's path is
+// ignored: use WithStripPrefix to serve under a path prefix.
+func WithPublicURL(u *url.URL) Option {
+	return func(s *Server) {
+		s.publicURL = u
+	}
+}
+
+// WithChecksumRetries fetches an object again, up to retries times, when the
+// download's checksum doesn't match, rather than failing the fetch, as a
+// corrupt download from a flaky upstream may be correct the next time. Each
+// retry downloads the whole object again, with the hash reset.
+func WithChecksumRetries(retries int) Option {
+	return func(s *Server) {
+		s.checksumRetries = retries
+	}
+}
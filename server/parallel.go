@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/saracen/lfscache/cache"
+)
+
+// minParallelFetchSize is the minimum object size fetched in parallel parts.
+const minParallelFetchSize = 8 << 20
+
+func httpRange(offset, length int) string {
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// fetchParts fetches an object as multiple ranges in parallel. The first
+// range's response is streamed to hcw, whilst the remaining ranges are
+// written directly into their region of crw as they arrive, so that readers
+// can read each part as soon as the parts before it have been written. Once
+// all parts have been written, the rest of the object is hashed so that hcw
+// can be verified as though it had been written sequentially.
+func (s *Server) fetchParts(ctx context.Context, hcw *hashCountWriter, crw *cache.ConcurrentReadWriter, first *http.Response, url string, header http.Header, size, partSize int) error {
+	// the first response is checked before the other parts are requested
+	if err := checkPart(first, 0, partSize, size); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var parts int
+	errs := make(chan error, (size+partSize-1)/partSize)
+	for offset := partSize; offset < size; offset += partSize {
+		length := partSize
+		if offset+length > size {
+			length = size - offset
+		}
+
+		parts++
+		go func(offset, length int) {
+			errs <- s.fetchPart(ctx, hcw, crw, url, header, offset, length, size)
+		}(offset, length)
+	}
+
+	err := copyPart(hcw, first, 0, partSize, size)
+	if err != nil {
+		cancel()
+	}
+	for i := 0; i < parts; i++ {
+		if perr := <-errs; perr != nil && err == nil {
+			err = perr
+			cancel()
+		}
+	}
+
+	// parts are written out of order, so a failed fetch can leave gaps in
+	// the data written, which is discarded rather than kept for resuming
+	if err != nil {
+		if rerr := crw.Rewind(nil); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+
+	if hcw.h != nil {
+		r := crw.Reader()
+		if r == nil {
+			return errors.New("object closed before its parts were hashed")
+		}
+		defer r.Close()
+
+		if _, err := io.Copy(hcw.h, io.NewSectionReader(r, int64(partSize), int64(size-partSize))); err != nil {
+			return err
+		}
+	}
+	hcw.n = size
+
+	return nil
+}
+
+// fetchPart downloads a range of an object, writing it at its offset of crw.
+func (s *Server) fetchPart(ctx context.Context, hcw *hashCountWriter, crw *cache.ConcurrentReadWriter, url string, header http.Header, offset, length, size int) error {
+	resp, err := s.get(ctx, url, header, httpRange(offset, length))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return copyPart(&partWriter{offsetWriter: offsetWriter{w: crw, off: int64(offset)}, hcw: hcw}, resp, offset, length, size)
+}
+
+// partWriter writes a part at its offset of the object, adding its progress
+// to hcw's so that the minimum fetch rate accounts for every part.
+type partWriter struct {
+	offsetWriter
+	hcw *hashCountWriter
+}
+
+func (pw *partWriter) Write(p []byte) (int, error) {
+	n, err := pw.offsetWriter.Write(p)
+	atomic.AddInt64(&pw.hcw.progress, int64(n))
+
+	if err != nil {
+		metricCacheWriteErrors.Add(1)
+	}
+	return n, err
+}
+
+// checkPart checks that resp is the requested range of length bytes from
+// offset, of an object of the given size.
+func checkPart(resp *http.Response, offset, length, size int) error {
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("upstream server responded with %d status to range request", resp.StatusCode)
+	}
+
+	expected := fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size)
+	if contentRange := resp.Header.Get("Content-Range"); contentRange != expected {
+		return fmt.Errorf("upstream responded with range %q, expected %q", contentRange, expected)
+	}
+
+	return nil
+}
+
+// copyPart copies a range response's body, ensuring it is the requested range
+// and length. No more than length bytes are copied, so that a part never
+// overwrites the part after it.
+func copyPart(w io.Writer, resp *http.Response, offset, length, size int) error {
+	if err := checkPart(resp, offset, length, size); err != nil {
+		return err
+	}
+
+	n, err := io.Copy(w, io.LimitReader(resp.Body, int64(length)))
+	if err != nil {
+		return err
+	}
+	if n != int64(length) {
+		return fmt.Errorf("upstream sent %d bytes for range, expected %d", n, length)
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/saracen/lfscache/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParallelFetch(t *testing.T) {
+	content := make([]byte, minParallelFetchSize+12345)
+	rand.Read(content)
+
+	tests := map[string]struct {
+		ranges   bool
+		requests int32
+	}{
+		"ranges supported": {true, 4},
+		"ranges ignored":   {false, 1},
+	}
+
+	for name, tc := range tests {
+		var requests int32
+		ts, s, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			if tc.ranges {
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+				return
+			}
+			w.Write(content)
+		}, WithParallelFetch(4))
+		require.NoError(t, err)
+
+		w := download(s, batchAction(t, s), "GET", nil)
+		assert.True(t, bytes.Equal(content, w.Body.Bytes()), name)
+
+		require.Eventually(t, func() bool {
+			return s.cache.IndexStats().Objects == 1
+		}, 5*time.Second, 10*time.Millisecond, name)
+		assert.Equal(t, tc.requests, atomic.LoadInt32(&requests), name)
+
+		// temporary part files are removed
+		tmp, err := ioutil.ReadDir(filepath.Join(dir, cache.DirTemp))
+		require.NoError(t, err)
+		assert.Len(t, tmp, 0, name)
+
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestParallelFetchAbortedDiscardsParts(t *testing.T) {
+	content := make([]byte, minParallelFetchSize+12345)
+	rand.Read(content)
+	sum := sha256.Sum256(content)
+
+	release := make(chan struct{})
+	defer close(release)
+
+	ts, s, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+		// the last part stalls until the fetch is aborted
+		if !strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}, WithParallelFetch(2), WithFetchTimeout(500*time.Millisecond), WithCacheOptions(cache.WithKeepPartial(time.Hour)))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	download(s, batchAction(t, s), "GET", nil)
+
+	// the first part was written, but the partial is kept empty as the
+	// parts after it are missing
+	var size int64
+	require.Eventually(t, func() bool {
+		var ok bool
+		size, ok = s.cache.Partial(hex.EncodeToString(sum[:]))
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(0), size)
+}
+
+func TestParallelFetchRangeMismatch(t *testing.T) {
+	content := make([]byte, minParallelFetchSize+12345)
+	rand.Read(content)
+	sum := sha256.Sum256(content)
+	partSize := (len(content) + 1) / 2
+
+	tests := map[string]struct {
+		part  string
+		shift int
+	}{
+		"first part": {httpRange(0, partSize), 1},
+		"later part": {httpRange(partSize, len(content)-partSize), -1},
+	}
+
+	for name, tc := range tests {
+		// the part is served shifted from the range requested, but with the
+		// expected length
+		ts, s, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Range") == tc.part {
+				var start, end int
+				fmt.Sscanf(tc.part, "bytes=%d-%d", &start, &end)
+				r.Header.Set("Range", httpRange(start+tc.shift, end-start+1))
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		}, WithParallelFetch(2), WithSkipChecksum())
+		require.NoError(t, err)
+
+		w := download(s, batchAction(t, s), "GET", nil)
+		assert.False(t, bytes.Equal(content, w.Body.Bytes()), name)
+		s.inflight.Wait()
+
+		// without a checksum to catch it, the misplaced part isn't cached
+		_, err = os.Stat(filepath.Join(dir, cache.DirObjects, cache.DefaultFilenamer(hex.EncodeToString(sum[:]))))
+		assert.True(t, os.IsNotExist(err), name)
+
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// readiness is the result of the latest cache write probe.
+type readiness struct {
+	lock sync.Mutex
+	err  error
+}
+
+func (rd *readiness) set(err error) (changed bool) {
+	rd.lock.Lock()
+	defer rd.lock.Unlock()
+
+	changed = (rd.err == nil) != (err == nil)
+	rd.err = err
+
+	return changed
+}
+
+func (rd *readiness) get() error {
+	rd.lock.Lock()
+	defer rd.lock.Unlock()
+
+	return rd.err
+}
+
+// probe checks the cache can be written to, recording and logging changes
+// in readiness.
+func (s *Server) probe() error {
+	err := s.cache.Probe()
+	if s.readiness.set(err) {
+		if err != nil {
+			level.Error(s.logger).Log("event", "readiness", "ready", false, "err", err)
+		} else {
+			level.Info(s.logger).Log("event", "readiness", "ready", true)
+		}
+	}
+
+	ready := 1.0
+	if err != nil {
+		ready = 0
+	}
+	metricCacheWritable.Set(ready)
+
+	return err
+}
+
+// probeCache probes the cache every interval.
+func (s *Server) probeCache(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.probe()
+		<-ticker.C
+	}
+}
+
+// ready responds with a 503 if the cache can't be written to, so that load
+// balancers can route requests away from an instance whose cache directory
+// has become unusable. The result of the latest periodic probe is reported,
+// or without one, the cache is probed on each request. Without a cache, the
+// server is always ready.
+func (s *Server) ready() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var err error
+		switch {
+		case s.cache == nil:
+		case s.probeInterval > 0:
+			err = s.readiness.get()
+		default:
+			err = s.probe()
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("cache unavailable\n"))
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/saracen/lfscache/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReady(t *testing.T) {
+	ready := func(s *Server) int {
+		w := httptest.NewRecorder()
+		s.Handle().ServeHTTP(w, httptest.NewRequest("GET", ContentCachePathPrefix+"readyz", nil))
+		return w.Code
+	}
+
+	t.Run("on demand", func(t *testing.T) {
+		ts, s, dir, err := server()
+		defer os.RemoveAll(dir)
+		defer ts.Close()
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, ready(s))
+
+		// the temp directory going away, such as an unmounted volume
+		require.NoError(t, os.RemoveAll(filepath.Join(dir, cache.DirTemp)))
+		assert.Equal(t, http.StatusServiceUnavailable, ready(s))
+
+		require.NoError(t, os.Mkdir(filepath.Join(dir, cache.DirTemp), 0700))
+		assert.Equal(t, http.StatusOK, ready(s))
+	})
+
+	t.Run("periodic", func(t *testing.T) {
+		ts, s, dir, err := server(WithReadinessProbe(10 * time.Millisecond))
+		defer os.RemoveAll(dir)
+		defer ts.Close()
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, ready(s))
+
+		require.NoError(t, os.RemoveAll(filepath.Join(dir, cache.DirObjects)))
+		assert.Eventually(t, func() bool {
+			return ready(s) == http.StatusServiceUnavailable
+		}, time.Second, 10*time.Millisecond)
+
+		require.NoError(t, os.Mkdir(filepath.Join(dir, cache.DirObjects), 0700))
+		assert.Eventually(t, func() bool {
+			return ready(s) == http.StatusOK
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("no cache", func(t *testing.T) {
+		s, err := NewNoCache(log.NewNopLogger(), "http://example.com")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, ready(s))
+	})
+}
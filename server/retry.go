@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// retryTransport retries requests that fail with a transport error or a 502,
+// 503 or 504 response. Attempts are separated by an exponential backoff with
+// full jitter: the wait is random, up to base doubled for each attempt and
+// capped at max, so that clients whose requests failed together don't retry
+// together and hammer a recovering upstream in step.
+type retryTransport struct {
+	logger    log.Logger
+	transport http.RoundTripper
+	retries   int
+	base      time.Duration
+	max       time.Duration
+}
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the body is buffered so that it can be sent again, batch requests are
+	// small enough to buffer
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		r := req
+		if body != nil {
+			r = req.Clone(req.Context())
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		resp, err := rt.transport.RoundTrip(r)
+		if attempt >= rt.retries {
+			return resp, err
+		}
+
+		switch {
+		case err != nil:
+			if errors.Is(err, context.Canceled) {
+				return resp, err
+			}
+		case resp.StatusCode == http.StatusBadGateway,
+			resp.StatusCode == http.StatusServiceUnavailable,
+			resp.StatusCode == http.StatusGatewayTimeout:
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			err = fmt.Errorf("remote server responded with %d status code", resp.StatusCode)
+		default:
+			return resp, err
+		}
+
+		wait := rt.backoff(attempt)
+		metricBatchRetries.Add(1)
+		level.Info(rt.logger).Log("event", "retrying", "request", req.URL, "attempt", attempt+1, "wait", wait, "err", err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// backoff returns a random wait of up to base doubled attempt times, capped
+// at max.
+func (rt *retryTransport) backoff(attempt int) time.Duration {
+	ceiling := rt.max
+	if attempt < 32 {
+		if d := rt.base << uint(attempt); d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling))) + 1
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchRetries(t *testing.T) {
+	const request = `{"operation":"download","objects":[{"oid":"foobar","size":6}]}`
+
+	tests := map[string]struct {
+		failures int32
+		retries  int
+		code     int
+		attempts int32
+	}{
+		"disabled":  {1, 0, http.StatusServiceUnavailable, 1},
+		"recovered": {2, 3, http.StatusOK, 3},
+		"exhausted": {5, 2, http.StatusServiceUnavailable, 3},
+	}
+
+	for name, tc := range tests {
+		var attempts int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// every attempt is sent the whole request body
+			body, _ := ioutil.ReadAll(r.Body)
+			assert.Equal(t, request, string(body), name)
+
+			if atomic.AddInt32(&attempts, 1) <= tc.failures {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			json.NewEncoder(w).Encode(BatchResponse{Objects: []*BatchObjectResponse{{OID: "foobar", Size: 6}}})
+		}))
+
+		dir, err := ioutil.TempDir("", "")
+		require.NoError(t, err)
+
+		s, err := New(log.NewNopLogger(), ts.URL, dir, WithBatchRetries(tc.retries, time.Millisecond, 5*time.Millisecond))
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		s.Handle().ServeHTTP(w, httptest.NewRequest("POST", "/objects/batch", strings.NewReader(request)))
+		assert.Equal(t, tc.code, w.Code, name)
+		assert.Equal(t, tc.attempts, atomic.LoadInt32(&attempts), name)
+
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBatchRetryCancelled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	rt := &retryTransport{
+		logger:    log.NewNopLogger(),
+		transport: http.DefaultTransport,
+		retries:   10,
+		base:      time.Hour,
+		max:       time.Hour,
+	}
+
+	req := httptest.NewRequest("POST", ts.URL, strings.NewReader("{}"))
+	req.RequestURI = ""
+	ctx, cancel := context.WithTimeout(req.Context(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := rt.RoundTrip(req.WithContext(ctx))
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestBatchRetryBackoff(t *testing.T) {
+	rt := &retryTransport{base: 100 * time.Millisecond, max: time.Second}
+
+	for attempt, ceiling := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		for i := 0; i < 100; i++ {
+			wait := rt.backoff(attempt)
+			assert.True(t, wait > 0 && wait <= ceiling, "attempt %d waited %v", attempt, wait)
+		}
+	}
+
+	// large attempts don't overflow
+	wait := rt.backoff(100)
+	assert.True(t, wait > 0 && wait <= time.Second)
+}
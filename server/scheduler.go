@@ -0,0 +1,123 @@
+package server
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+)
+
+// fetchScheduler limits the number of concurrent fetches. When the limit is
+// reached, fetches wait and are granted a slot in priority order: highest
+// priority first, then smallest object, then first come first served.
+type fetchScheduler struct {
+	lock    sync.Mutex
+	limit   int
+	active  int
+	seq     uint64
+	waiting fetchQueue
+}
+
+type fetchWaiter struct {
+	priority int
+	size     int
+	seq      uint64
+	index    int
+	ready    chan struct{}
+}
+
+func newFetchScheduler(limit int) *fetchScheduler {
+	return &fetchScheduler{limit: limit}
+}
+
+// acquire blocks until a fetch slot is available or the context is done.
+func (fs *fetchScheduler) acquire(ctx context.Context, priority, size int) error {
+	if fs == nil {
+		return nil
+	}
+
+	fs.lock.Lock()
+	if fs.active < fs.limit {
+		fs.active++
+		fs.lock.Unlock()
+		return nil
+	}
+
+	fs.seq++
+	waiter := &fetchWaiter{priority: priority, size: size, seq: fs.seq, ready: make(chan struct{})}
+	heap.Push(&fs.waiting, waiter)
+	fs.lock.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nil
+
+	case <-ctx.Done():
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+
+		// the slot may have been granted whilst the context was cancelled
+		select {
+		case <-waiter.ready:
+			fs.releaseLocked()
+		default:
+			heap.Remove(&fs.waiting, waiter.index)
+		}
+		return ctx.Err()
+	}
+}
+
+// release frees a fetch slot, handing it to the next waiter if any.
+func (fs *fetchScheduler) release() {
+	if fs == nil {
+		return
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.releaseLocked()
+}
+
+func (fs *fetchScheduler) releaseLocked() {
+	if fs.waiting.Len() > 0 {
+		close(heap.Pop(&fs.waiting).(*fetchWaiter).ready)
+		return
+	}
+	fs.active--
+}
+
+// fetchQueue implements heap.Interface for waiting fetches.
+type fetchQueue []*fetchWaiter
+
+func (q fetchQueue) Len() int { return len(q) }
+
+func (q fetchQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	if q[i].size != q[j].size {
+		return q[i].size < q[j].size
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q fetchQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *fetchQueue) Push(x interface{}) {
+	waiter := x.(*fetchWaiter)
+	waiter.index = len(*q)
+	*q = append(*q, waiter)
+}
+
+func (q *fetchQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	waiter := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return waiter
+}
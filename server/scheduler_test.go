@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchScheduler(t *testing.T) {
+	fs := newFetchScheduler(1)
+	require.NoError(t, fs.acquire(context.Background(), 0, 0))
+
+	order := make(chan string, 4)
+	queue := func(name string, priority, size int) {
+		go func() {
+			require.NoError(t, fs.acquire(context.Background(), priority, size))
+			order <- name
+			fs.release()
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	queue("low", 0, 10)
+	queue("high", 10, 1000)
+	queue("low-small", 0, 1)
+	queue("low-later", 0, 10)
+
+	fs.release()
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, <-order)
+	}
+	assert.Equal(t, []string{"high", "low-small", "low", "low-later"}, got)
+}
+
+func TestFetchSchedulerCancel(t *testing.T) {
+	fs := newFetchScheduler(1)
+	require.NoError(t, fs.acquire(context.Background(), 0, 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, fs.acquire(ctx, 0, 0))
+
+	fs.release()
+	assert.Equal(t, 0, fs.active)
+	assert.Equal(t, 0, fs.waiting.Len())
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/saracen/lfscache/cache"
+)
+
+// scrub verifies count cached objects every interval, cycling through the
+// whole cache in key order. Corrupt objects are quarantined by the cache, so
+// that they're fetched again on their next request. Verifying a few objects
+// at a time keeps the scrub from competing with serving for disk I/O.
+func (s *Server) scrub(interval time.Duration, count int) {
+	<-s.cache.Indexed()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var cursor string
+	var verified, corrupt int
+	begin := time.Now()
+	for range ticker.C {
+		objects := s.cache.Objects(cursor, count)
+		if len(objects) == 0 {
+			if cursor != "" {
+				level.Info(s.logger).Log("event", "scrubbed", "objects", verified, "corrupt", corrupt, "took", time.Since(begin))
+			}
+			cursor, verified, corrupt, begin = "", 0, 0, time.Now()
+			continue
+		}
+
+		for _, object := range objects {
+			bad, err := s.cache.Verify(object.Key)
+			if err != nil {
+				metricScrubErrors.Add(1)
+				level.Error(s.logger).Log("event", "scrubbing", "oid", object.Key, "err", err)
+				continue
+			}
+
+			verified++
+			metricScrubbedObjects.Add(1)
+			if bad {
+				corrupt++
+				metricScrubCorrupt.Add(1)
+				level.Error(s.logger).Log("event", "quarantined", "oid", object.Key, "size", object.Size)
+				s.webhook.send(WebhookEvent{Event: WebhookEventEvicted, OID: object.Key, Size: object.Size, Source: string(cache.SourceDisk), Error: "checksum mismatch"})
+			}
+		}
+		cursor = objects[len(objects)-1].Key
+	}
+}
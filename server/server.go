@@ -19,9 +19,12 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -42,7 +45,15 @@ type BatchObjectResponse struct {
 	OID           string                                `json:"oid"`
 	Size          int64                                 `json:"size"`
 	Authenticated bool                                  `json:"authenticated,omitempty"`
-	Actions       map[string]*BatchObjectActionResponse `json:"actions"`
+	Actions       map[string]*BatchObjectActionResponse `json:"actions,omitempty"`
+	Error         *BatchObjectErrorResponse             `json:"error,omitempty"`
+}
+
+// BatchObjectErrorResponse is the error item of a BatchObjectResponse, set
+// instead of actions for objects that can't be transferred.
+type BatchObjectErrorResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
 }
 
 // BatchObjectActionResponse is the action item of a BatchObjectResponse
@@ -53,6 +64,34 @@ type BatchObjectActionResponse struct {
 	ExpiresAt time.Time         `json:"expires_at,omitempty"`
 }
 
+// MarshalJSON omits expires_at if it isn't set, rather than encoding the zero
+// time, which clients could take as the action having already expired.
+func (a BatchObjectActionResponse) MarshalJSON() ([]byte, error) {
+	type action BatchObjectActionResponse
+	v := struct {
+		action
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	}{action: action(a)}
+	if !a.ExpiresAt.IsZero() {
+		v.ExpiresAt = &a.ExpiresAt
+	}
+
+	return json.Marshal(v)
+}
+
+// expires returns when the action expires, taking expires_in as relative to
+// now, or the zero time if it doesn't.
+func (a *BatchObjectActionResponse) expires(now time.Time) time.Time {
+	expires := a.ExpiresAt
+	if a.ExpiresIn > 0 {
+		if at := now.Add(time.Duration(a.ExpiresIn) * time.Second); expires.IsZero() || at.Before(expires) {
+			expires = at
+		}
+	}
+
+	return expires
+}
+
 const (
 	// UpstreamHeaderList is a list of headers to be used when fetching the
 	// original content location.
@@ -68,13 +107,49 @@ const (
 	// additional headers.
 	SignatureHeader = "X-Lfs-Signature"
 
+	// PriorityHeader is the scheduling priority of the fetch triggered by a
+	// content request. Higher priority fetches are started first.
+	PriorityHeader = "X-Lfs-Cache-Priority"
+
+	// SourceHeader is set on content responses, if enabled, to where the
+	// content was served from (disk, inflight or fresh).
+	SourceHeader = "X-Lfs-Cache-Source"
+
 	// ContentCachePathPrefix is the path prefix for cached content delivery.
 	ContentCachePathPrefix = "/_lfs_cache/"
 )
 
+// Default upstream connection pooling settings.
+const (
+	DefaultMaxIdleConns        = 100
+	DefaultMaxIdleConnsPerHost = 10
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+// DefaultMaxBatchBufferSize is the size above which rewritten batch responses
+// are streamed rather than buffered in memory.
+const DefaultMaxBatchBufferSize = 16 << 20
+
+// DefaultRetryAfter is how long clients are asked to wait before retrying a
+// transient failure.
+const DefaultRetryAfter = 5 * time.Second
+
+var (
+	errChecksumMismatch       = errors.New("file checksum mismatch")
+	errUpstreamHostNotAllowed = errors.New("upstream host not allowed")
+	errMissingSignature       = errors.New("missing signature header")
+	errMissingHref            = errors.New("missing href header")
+	errInvalidSignature       = errors.New("invalid signature")
+	errSignatureMismatch      = errors.New("signature mismatch")
+)
+
 type contextKey string
 
-var contextKeyOriginalHost = contextKey("original-host")
+var (
+	contextKeyOriginalHost  = contextKey("original-host")
+	contextKeyNoCacheTarget = contextKey("no-cache-target")
+	contextKeyBatchCacheKey = contextKey("batch-cache-key")
+)
 
 type originalHost struct {
 	http bool
@@ -85,41 +160,115 @@ func DefaultObjectBatchActionURLRewriter(href *url.URL) *url.URL {
 	return href
 }
 
+// DefaultKeyFunc is the default KeyFunc, caching objects by their OID.
+func DefaultKeyFunc(oid string, r *http.Request) string {
+	return oid
+}
+
 // Server is a LFS caching server.
 type Server struct {
+	// queued is the number of requests waiting for their fetches to start,
+	// fetching the number of fetches inflight and buffered the estimated
+	// memory of the buffers serving objects that aren't on disk. They're
+	// first so that they're 64-bit aligned for atomic access.
+	queued   int64
+	fetching int64
+	buffered int64
+
 	logger   log.Logger
 	upstream *url.URL
 	mux      *http.ServeMux
 	cache    *cache.FilesystemCache
 	client   *http.Client
-	hmacKey  [64]byte
+	hmacKey  []byte
+	hmacHash func() hash.Hash
+
+	cacheOptions []cache.Option
+	infoPage     bool
+	version      string
+	userAgent    string
+
+	wireCompression bool
+	forwardHeaders  []string
+	webhookURL      string
+	webhook         *webhook
+	backupDir       string
+	backupWorkers   int
+	backup          *backup
+	fetches         *fetchScheduler
+	prioritize      bool
+	defaultPriority int
+	skipChecksum    bool
+	parallelFetch   int
+	fetchCtx        context.Context
+	cancelFetches   context.CancelFunc
+	inflight        sync.WaitGroup
+	maxBatchBody    int64
+	allowedHosts    map[string]bool
+	batchCache      *batchCache
+	failures        *fetchFailures
+	adminToken      string
+	pathPrefix      string
+	headerTimeouts  map[string]time.Duration
+	missRedirect    bool
+	mirror          *url.URL
+	audit           *audit
+	minRewriteSize  int64
+	expiryMargin    time.Duration
+	fetchTimeout    time.Duration
+	minFetchRate    int64
+	minRateWindow   time.Duration
+	retryAfter      time.Duration
+	scrubInterval   time.Duration
+	scrubCount      int
+	maxQueued       int64
+	serveHeaders    http.Header
+	exactUpstream   bool
+	hostOnly        bool
+	maxBatchBuffer  int64
+	sourceHeader    bool
+	corsOrigins     []string
+	corsMaxAge      time.Duration
+	noPassthrough   bool
+	verbatimBatch   bool
+	softFetchLimit  int64
+	bypassProxy     http.Handler
+	probeInterval   time.Duration
+	readiness       readiness
+	batchRetries    int
+	batchRetryBase  time.Duration
+	batchRetryMax   time.Duration
+	flushInflight   bool
+	bufferBudget    int64
+	canonicalHost   string
+	publicURL       *url.URL
+	checksumRetries int
+
+	stripRequestHeaders  []string
+	stripResponseHeaders []string
 
 	ObjectBatchActionURLRewriter func(href *url.URL) *url.URL
+
+	// KeyFunc maps an object and its content request to the key it is
+	// cached under, for example to namespace objects by the repository in
+	// the request's OriginalHrefHeader. The key must be usable as a file
+	// name.
+	KeyFunc func(oid string, r *http.Request) string
 }
 
 // New returns a new LFS proxy caching server.
-func New(logger log.Logger, upstream, directory string) (*Server, error) {
-	return newServer(logger, upstream, directory, true)
+func New(logger log.Logger, upstream, directory string, options ...Option) (*Server, error) {
+	return newServer(logger, upstream, directory, true, options)
 }
 
 // NewNoCache returns a new LFS proxy server, with no caching.
-func NewNoCache(logger log.Logger, upstream string) (*Server, error) {
-	return newServer(logger, upstream, "", false)
+func NewNoCache(logger log.Logger, upstream string, options ...Option) (*Server, error) {
+	return newServer(logger, upstream, "", false, options)
 }
 
-func newServer(logger log.Logger, upstream, directory string, cacheEnabled bool) (*Server, error) {
-	var fs *cache.FilesystemCache
-	var err error
-	if cacheEnabled {
-		fs, err = cache.NewFilesystemCache(directory)
-		if err != nil {
-			return nil, err
-		}
-	}
-
+func newServer(logger log.Logger, upstream, directory string, cacheEnabled bool, options []Option) (*Server, error) {
 	s := &Server{
 		logger: logger,
-		cache:  fs,
 		client: &http.Client{
 			Transport: &http.Transport{
 				Dial: (&net.Dialer{
@@ -127,36 +276,136 @@ func newServer(logger log.Logger, upstream, directory string, cacheEnabled bool)
 					KeepAlive: 30 * time.Second,
 				}).Dial,
 				ForceAttemptHTTP2:     true,
+				MaxIdleConns:          DefaultMaxIdleConns,
+				MaxIdleConnsPerHost:   DefaultMaxIdleConnsPerHost,
+				IdleConnTimeout:       DefaultIdleConnTimeout,
 				TLSHandshakeTimeout:   10 * time.Second,
 				ResponseHeaderTimeout: 10 * time.Second,
 				ExpectContinueTimeout: 1 * time.Second,
 			},
 		},
+		version:                      "dev",
+		retryAfter:                   DefaultRetryAfter,
+		maxBatchBuffer:               DefaultMaxBatchBufferSize,
+		hmacHash:                     sha256.New,
 		ObjectBatchActionURLRewriter: DefaultObjectBatchActionURLRewriter,
+		KeyFunc:                      DefaultKeyFunc,
 	}
 
-	_, err = rand.Read(s.hmacKey[:])
-	if err != nil {
-		return nil, err
+	for _, option := range options {
+		option(s)
+	}
+
+	s.fetchCtx, s.cancelFetches = context.WithCancel(context.Background())
+
+	// options configure the shared transport, per host transports are cloned
+	// from it once they've all been applied
+	if len(s.headerTimeouts) > 0 {
+		s.client.Transport = newHostTransport(s.client.Transport.(*http.Transport), s.headerTimeouts)
+	}
+
+	if s.webhookURL != "" {
+		s.webhook = newWebhook(logger, s.webhookURL)
+	}
+	if s.audit != nil {
+		if cacheEnabled {
+			s.audit = nil
+		} else {
+			go s.audit.summarize(logger)
+		}
+	}
+
+	var err error
+	if cacheEnabled {
+		options := append(s.cacheOptions, cache.WithPromotionHook(s.promoted))
+		s.cache, err = cache.NewFilesystemCache(directory, options...)
+		if err != nil {
+			return nil, err
+		}
+
+		go func() {
+			begin := time.Now()
+			<-s.cache.Indexed()
+
+			stats := s.cache.IndexStats()
+			logger := log.With(s.logger, "event", "indexed", "objects", stats.Objects, "bytes", stats.Bytes, "took", time.Since(begin))
+			if err := s.cache.IndexErr(); err != nil {
+				level.Error(logger).Log("err", err)
+			} else {
+				level.Info(logger).Log()
+			}
+		}()
+
+		if s.backupDir != "" {
+			s.backup = newBackup(logger, s.backupDir, s.backupWorkers, s.cache.ObjectName)
+		}
+
+		go s.sampleDiskUsage()
+
+		if s.probeInterval > 0 {
+			go s.probeCache(s.probeInterval)
+		}
+
+		if s.scrubInterval > 0 && s.scrubCount > 0 {
+			go s.scrub(s.scrubInterval, s.scrubCount)
+		}
+	}
+
+	// generate a random key unless one is shared between instances, keys
+	// longer than the hash's block size are hashed so there's no benefit to
+	// making it any longer
+	if s.hmacKey == nil {
+		s.hmacKey = make([]byte, s.hmacHash().BlockSize())
+		if _, err = rand.Read(s.hmacKey); err != nil {
+			return nil, err
+		}
 	}
 
 	if s.upstream, err = url.Parse(upstream); err != nil {
 		return nil, err
 	}
 
-	// ensure upstream path has suffixed separator
-	if !strings.HasSuffix(s.upstream.Path, "/") {
+	// the client's path is kept in full when the upstream is a host only
+	if s.hostOnly {
+		s.upstream.Path, s.upstream.RawPath = "/", ""
+	}
+
+	// ensure upstream path has suffixed separator, unless the upstream
+	// doesn't accept one
+	if !s.exactUpstream && !strings.HasSuffix(s.upstream.Path, "/") {
 		s.upstream.Path += "/"
 	}
+	if s.mirror != nil && !strings.HasSuffix(s.mirror.Path, "/") {
+		s.mirror.Path += "/"
+	}
 
 	s.mux = http.NewServeMux()
+	s.mux.Handle(ContentCachePathPrefix+"readyz", s.ready())
 	if s.cache != nil {
-		s.mux.HandleFunc(ContentCachePathPrefix, s.serve)
+		s.mux.Handle(ContentCachePathPrefix, s.withCORS(s.withServeHeaders(http.HandlerFunc(s.serve))))
+		if s.adminToken != "" {
+			s.mux.Handle(ContentCachePathPrefix+"objects", s.objects())
+			s.mux.Handle(ContentCachePathPrefix+"refresh/", s.refresh())
+			s.mux.Handle(ContentCachePathPrefix+"pin/", s.pin())
+		}
+		if s.softFetchLimit > 0 {
+			s.bypassProxy = s.nocache()
+		}
 	} else {
-		s.mux.Handle(ContentCachePathPrefix, s.nocache())
+		s.mux.Handle(ContentCachePathPrefix, s.withCORS(s.withServeHeaders(s.nocache())))
+	}
+	batch, legacy := s.withCORS(s.batch()), s.withCORS(s.legacy())
+	s.mux.Handle("/objects/batch", batch)
+	s.mux.Handle("/objects/", legacy)
+
+	root := s.passthrough()
+	if s.infoPage {
+		root = s.info(root)
+	}
+	if s.hostOnly {
+		root = projectRouter(batch, legacy, root)
 	}
-	s.mux.Handle("/objects/batch", s.batch())
-	s.mux.Handle("/", s.proxy())
+	s.mux.Handle("/", root)
 
 	return s, nil
 }
@@ -166,181 +415,685 @@ func (s *Server) Logger() log.Logger {
 	return s.logger
 }
 
+// Shutdown waits for inflight fetches to finish, so that their objects are
+// cached rather than discarded, then saves the cache's access times. If ctx
+// is done first, the remaining fetches are cancelled and ctx's error is
+// returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.cancelFetches()
+		err = ctx.Err()
+	}
+
+	if s.cache != nil {
+		if serr := s.cache.SaveAccessTimes(); serr != nil {
+			level.Error(s.logger).Log("event", "save-access-times", "err", serr)
+		}
+	}
+
+	return err
+}
+
+// Fetch downloads an object from href into the cache, returning once it has
+// been cached or the fetch has failed. Objects that are already cached return
+// immediately, and objects that are already being fetched are waited on.
+//
+// The cache key is derived with KeyFunc from a GET request for the object
+// carrying header, which is also sent to the upstream. If ctx is done first,
+// ctx's error is returned but the fetch continues, as it would for a client
+// that disconnected.
+func (s *Server) Fetch(ctx context.Context, oid, href string, size int64, header http.Header) error {
+	if s.cache == nil {
+		return errors.New("caching is disabled")
+	}
+	if !s.upstreamAllowed(href) {
+		return errUpstreamHostNotAllowed
+	}
+
+	r, err := http.NewRequest(http.MethodGet, s.pathPrefix+ContentCachePathPrefix+oid, nil)
+	if err != nil {
+		return err
+	}
+	r = r.WithContext(ctx)
+	r.Header = header.Clone()
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+
+	key := s.KeyFunc(oid, r)
+	cr, cw, source, err := s.cache.Get(key)
+	if err != nil {
+		return err
+	}
+	if source == cache.SourceDisk {
+		return cr.Close()
+	}
+
+	done := make(chan error, 1)
+	if cw == nil {
+		// wait for the inflight fetch by reading it to the end, a failed
+		// fetch's error is returned by the reader
+		go func() {
+			defer cr.Close()
+
+			_, err := io.Copy(ioutil.Discard, cr)
+			done <- err
+		}()
+	} else {
+		// the fetch can't be promoted into the cache whilst a reader is open
+		cr.Close()
+
+		upstream := r.Header.Clone()
+		upstream.Set("User-Agent", s.upstreamUserAgent(""))
+
+		s.inflight.Add(1)
+		go func() {
+			done <- s.fetch(cw, key, oid, href, int(size), upstream, s.fetchPriority(r), nil)
+		}()
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Handle returns this server's http.Handler.
 func (s *Server) Handle() http.Handler {
+	if s.pathPrefix != "" {
+		return http.StripPrefix(s.pathPrefix, s.mux)
+	}
 	return s.mux
 }
 
 func (s *Server) proxy() *httputil.ReverseProxy {
 	director := func(req *http.Request) {
-		outreq := req.WithContext(context.WithValue(req.Context(), contextKeyOriginalHost, &originalHost{
-			http: req.TLS == nil,
-			host: req.Host,
-		}))
-		*req = *outreq
+		*req = *withOriginalHost(req)
 
 		req.URL.Path = strings.TrimLeft(req.URL.Path, "/")
-		req.URL = s.upstream.ResolveReference(req.URL)
+		req.URL = s.resolveUpstream(req.URL)
 		req.Host = req.URL.Host
 
-		if _, ok := req.Header["User-Agent"]; !ok {
-			req.Header.Set("User-Agent", "")
-		}
+		req.Header.Set("User-Agent", s.upstreamUserAgent(req.Header.Get("User-Agent")))
+		stripHeaders(req.Header, s.stripRequestHeaders)
 	}
 
 	errorHandler := func(w http.ResponseWriter, r *http.Request, err error) {
 		level.Error(s.logger).Log("event", "proxying", "request", r.URL, "err", err)
+		w.WriteHeader(http.StatusBadGateway)
 	}
 
-	return &httputil.ReverseProxy{Director: director, ErrorHandler: errorHandler}
+	return &httputil.ReverseProxy{Director: director, Transport: s.client.Transport, ErrorHandler: errorHandler, ModifyResponse: s.modifyResponse(nil)}
 }
 
-func (s *Server) batch() *httputil.ReverseProxy {
+// withOriginalHost returns a shallow copy of the request with the original
+// host information stored in its context.
+func withOriginalHost(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), contextKeyOriginalHost, &originalHost{
+		http: req.TLS == nil,
+		host: req.Host,
+	}))
+}
+
+func (s *Server) batch() http.Handler {
 	proxy := s.proxy()
-	proxy.ModifyResponse = func(r *http.Response) error {
+	proxy.ModifyResponse = s.modifyResponse(func(r *http.Response) error {
 		if r.StatusCode != http.StatusOK {
 			level.Error(s.logger).Log("event", "proxying", "request", r.Request.URL, "err", fmt.Sprintf("remote server responded with %d status code", r.StatusCode))
 			return nil
 		}
 
-		var err error
-		var compress bool
-		if !r.Uncompressed && strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
-			compress = true
-			if r.Body, err = gzip.NewReader(r.Body); err != nil {
+		// cache the upstream response before it is rewritten, this requires
+		// the whole response to be decoded
+		if key, ok := r.Request.Context().Value(contextKeyBatchCacheKey).(*batchCacheKey); ok {
+			var br BatchResponse
+			compress, err := decodeResponse(r, &br)
+			if err != nil {
 				return err
 			}
+
+			s.batchCache.set(key.key, key.ttl, &br)
+			s.rewriteBatch(r.Request, &br)
+
+			return encodeResponse(&br, compress, r, s.maxBatchBuffer)
 		}
 
-		var br BatchResponse
-		if err = json.NewDecoder(r.Body).Decode(&br); err != nil {
-			return err
+		return s.streamBatch(r)
+	})
+	if s.batchRetries > 0 {
+		proxy.Transport = &retryTransport{
+			logger:    s.logger,
+			transport: proxy.Transport,
+			retries:   s.batchRetries,
+			base:      s.batchRetryBase,
+			max:       s.batchRetryMax,
 		}
+	}
+
+	var handler http.Handler = proxy
+	if s.batchCache != nil {
+		handler = s.cachedBatch(proxy)
+	}
+	handler = s.logBatch(handler)
+	if s.maxBatchBody > 0 {
+		handler = s.limitBatchBody(handler)
+	}
+
+	return handler
+}
 
-		// only support basic transfers
-		if br.Transfer != "" && br.Transfer != "basic" {
-			return s.batchResponse(&br, compress, r)
+// batchRequest is the part of a batch request that's logged.
+type batchRequest struct {
+	Operation string     `json:"operation"`
+	Objects   []struct{} `json:"objects"`
+	Ref       *struct {
+		Name string `json:"name"`
+	} `json:"ref"`
+}
+
+// batchLogMaxBodySize is the largest batch request body that's read to log
+// the request. The details of requests with larger bodies aren't logged.
+const batchLogMaxBodySize = 1 << 20
+
+// logBatch logs batch requests: their operation, number of objects and ref,
+// the client's git-lfs version and the repository, where they're known. The
+// request body is restored after being read.
+func (s *Server) logBatch(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
 		}
 
-		// modify batch request urls
-		for _, object := range br.Objects {
-			for operation, action := range object.Actions {
-				if operation != "download" && s.cache != nil {
-					continue
-				}
-				if action.Header == nil {
-					action.Header = make(map[string]string)
-				}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, batchLogMaxBodySize+1))
+		if err != nil {
+			r.Body.Close()
+			level.Error(s.logger).Log("event", "batch", "request", r.URL, "err", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// the details of bodies too large to buffer aren't logged, and what
+		// wasn't read is passed on after what was
+		if len(body) > batchLogMaxBodySize {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			body = nil
+		} else {
+			r.Body.Close()
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
 
-				host, ok := r.Request.Context().Value(contextKeyOriginalHost).(*originalHost)
-				if !ok {
-					panic("lfscache error: original host information not set")
-				}
+		// malformed requests are left for the upstream to reject
+		var br batchRequest
+		json.Unmarshal(body, &br)
 
-				list := make([]string, 0, len(action.Header))
-				for header := range action.Header {
-					list = append(list, header)
-				}
+		keyvals := []interface{}{"event", "batch", "operation", br.Operation, "objects", len(br.Objects)}
+		if br.Ref != nil {
+			keyvals = append(keyvals, "ref", br.Ref.Name)
+		}
+		if version := clientVersion(r.Header.Get("User-Agent")); version != "" {
+			keyvals = append(keyvals, "client", version)
+		}
+		if repo := s.batchRepo(r.URL.Path); repo != "" {
+			keyvals = append(keyvals, "repo", repo)
+		}
+		level.Info(s.logger).Log(keyvals...)
 
-				scheme := "http"
-				if !host.http {
-					scheme = "https"
-				}
+		next.ServeHTTP(w, r)
+	})
+}
 
-				action.Header[UpstreamHeaderList] = strings.Join(list, ";")
-				action.Header[OriginalHrefHeader] = action.Href
-				action.Header[SizeHeader] = strconv.Itoa(int(object.Size))
-				action.Href = s.ObjectBatchActionURLRewriter(&url.URL{
-					Scheme: scheme,
-					Host:   host.host,
-					Path:   ContentCachePathPrefix + object.OID,
-				}).String()
-
-				mac := hmac.New(sha256.New, s.hmacKey[:])
-				mac.Write([]byte(action.Header[UpstreamHeaderList]))
-				mac.Write([]byte(action.Header[OriginalHrefHeader]))
-				mac.Write([]byte(action.Header[SizeHeader]))
-
-				action.Header[SignatureHeader] = hex.EncodeToString(mac.Sum(nil))
-			}
+// clientVersion returns the git-lfs version from a User-Agent such as
+// "git-lfs/3.4.0 (GitHub; linux amd64; go 1.21.0)", or "" if the client
+// isn't git-lfs.
+func clientVersion(userAgent string) string {
+	if !strings.HasPrefix(userAgent, "git-lfs/") {
+		return ""
+	}
+
+	version := strings.TrimPrefix(userAgent, "git-lfs/")
+	if i := strings.IndexAny(version, " ("); i >= 0 {
+		version = version[:i]
+	}
+
+	return version
+}
+
+// batchRepo returns the repository path of the upstream LFS server that a
+// batch request is for, such as org/repo.git.
+func (s *Server) batchRepo(requestPath string) string {
+	upstream := s.resolveUpstream(&url.URL{Path: strings.TrimLeft(requestPath, "/")})
+
+	repo := strings.TrimSuffix(upstream.Path, "/objects/batch")
+	repo = strings.TrimSuffix(repo, "/info/lfs")
+
+	return strings.Trim(repo, "/")
+}
+
+// limitBatchBody rejects batch requests with bodies larger than the maximum
+// batch body size, before they're proxied upstream.
+func (s *Server) limitBatchBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > s.maxBatchBody {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		// bodies without a content length are read in full, batch requests
+		// are small enough to buffer
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.maxBatchBody))
+		if err != nil {
+			level.Error(s.logger).Log("event", "proxying", "request", r.URL, "err", err)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
 		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rewriteBatch rewrites the actions of a batch response to be served by the
+// cache. req is the batch request, with original host information set.
+func (s *Server) rewriteBatch(req *http.Request, br *BatchResponse) {
+	// only support basic transfers
+	if br.Transfer != "" && br.Transfer != "basic" {
+		return
+	}
+
+	// modify batch request urls
+	for _, object := range br.Objects {
+		s.rewriteObject(req, object)
+	}
+}
+
+// rewritable returns whether a download action should be routed through the
+// cache. Objects below the minimum rewrite size aren't, nor are hrefs that
+// expire within the expiry margin, as the fetch might not start until after
+// they've expired. Clients download either directly from the upstream.
+func (s *Server) rewritable(size int64, action *BatchObjectActionResponse) bool {
+	if size < s.minRewriteSize {
+		return false
+	}
+
+	if s.expiryMargin > 0 {
+		now := time.Now()
+		if expires := action.expires(now); !expires.IsZero() && expires.Before(now.Add(s.expiryMargin)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rewriteObject rewrites the actions of a single batch response object,
+// returning the operations of the actions that were rewritten.
+func (s *Server) rewriteObject(req *http.Request, object *BatchObjectResponse) map[string]bool {
+	var rewritten map[string]bool
+	for operation, action := range object.Actions {
+		if operation != "download" && s.cache != nil {
+			continue
+		}
+		if operation == "download" && !s.rewritable(object.Size, action) {
+			continue
+		}
+
+		s.rewriteAction(req, object.OID, object.Size, action)
+		if rewritten == nil {
+			rewritten = make(map[string]bool)
+		}
+		rewritten[operation] = true
+	}
+
+	return rewritten
+}
+
+// rewriteAction rewrites an object action's href to point to the cache's
+// content endpoint, signing the headers required to fetch the original.
+func (s *Server) rewriteAction(req *http.Request, oid string, size int64, action *BatchObjectActionResponse) {
+	if action.Header == nil {
+		action.Header = make(map[string]string)
+	}
+
+	// capture additional client headers to be replayed on fetch
+	for _, header := range s.forwardHeaders {
+		if _, ok := action.Header[header]; ok {
+			continue
+		}
+		if value := req.Header.Get(header); value != "" {
+			action.Header[header] = value
+		}
+	}
+
+	host, ok := req.Context().Value(contextKeyOriginalHost).(*originalHost)
+	if !ok {
+		panic("lfscache error: original host information not set")
+	}
+
+	list := make([]string, 0, len(action.Header))
+	for header := range action.Header {
+		list = append(list, header)
+	}
+
+	action.Header[UpstreamHeaderList] = strings.Join(list, ";")
+	action.Header[OriginalHrefHeader] = action.Href
+	action.Header[SizeHeader] = strconv.Itoa(int(size))
+	action.Href = s.ObjectBatchActionURLRewriter(s.cacheURL(host, ContentCachePathPrefix+oid)).String()
+
+	action.Header[SignatureHeader] = SignHeadersWithHash(
+		s.hmacHash,
+		s.hmacKey,
+		action.Header[UpstreamHeaderList],
+		action.Header[OriginalHrefHeader],
+		action.Header[SizeHeader],
+	)
+}
+
+// cacheURL returns the URL clients request path of the cache at, for requests
+// made to host. The strip prefix is included in the path, and the canonical
+// host and public URL, if set, take the place of the request's host.
+func (s *Server) cacheURL(host *originalHost, path string) *url.URL {
+	scheme := "http"
+	if !host.http {
+		scheme = "https"
+	}
+
+	// hrefs are signed without their host, so an href rewritten under one
+	// of the cache's hostnames can be requested under any other
+	hostname := host.host
+	if s.canonicalHost != "" {
+		hostname = s.canonicalHost
+	}
+	if s.publicURL != nil {
+		scheme, hostname = s.publicURL.Scheme, s.publicURL.Host
+	}
+
+	return &url.URL{
+		Scheme: scheme,
+		Host:   hostname,
+		Path:   s.pathPrefix + path,
+	}
+}
+
+// SignHeaders returns the SignatureHeader value of a content request with the
+// given UpstreamHeaderList, OriginalHrefHeader and SizeHeader values, signed
+// with key using the default HMAC-SHA256. Services sharing a key with
+// lfscache instances (see WithHMACKey) can use it to mint content URLs, at
+// ContentCachePathPrefix followed by the OID, without a batch request.
+func SignHeaders(key []byte, headerList, href, size string) string {
+	return SignHeadersWithHash(sha256.New, key, headerList, href, size)
+}
+
+// SignHeadersWithHash is like SignHeaders, but for instances configured with
+// another hash using WithHMACHash.
+func SignHeadersWithHash(h func() hash.Hash, key []byte, headerList, href, size string) string {
+	return hex.EncodeToString(sign(h, key, headerList, href, size))
+}
+
+func sign(h func() hash.Hash, key []byte, headerList, href, size string) []byte {
+	mac := hmac.New(h, key)
+	mac.Write([]byte(headerList))
+	mac.Write([]byte(href))
+	mac.Write([]byte(size))
+
+	return mac.Sum(nil)
+}
 
-		return s.batchResponse(&br, compress, r)
+// decodeResponse decodes a JSON response body, returning whether it was gzip
+// compressed.
+func decodeResponse(r *http.Response, v interface{}) (compress bool, err error) {
+	body, compress, err := responseBody(r)
+	if err != nil {
+		return compress, err
+	}
+
+	return compress, json.NewDecoder(body).Decode(v)
+}
+
+// responseBody returns the response's body, decompressing it if it was gzip
+// compressed.
+func responseBody(r *http.Response) (body io.Reader, compress bool, err error) {
+	body = r.Body
+	if !r.Uncompressed && strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		compress = true
+		if body, err = gzip.NewReader(r.Body); err != nil {
+			return nil, compress, err
+		}
 	}
 
-	return proxy
+	return body, compress, nil
 }
 
-func (s *Server) batchResponse(br *BatchResponse, compress bool, r *http.Response) error {
+// encodeResponse replaces the response's body with v. Bodies that encode to
+// more than maxBuffer bytes (0 is unlimited) are streamed to the client as
+// they're encoded, without a Content-Length, rather than buffered in memory.
+func encodeResponse(v interface{}, compress bool, r *http.Response, maxBuffer int64) error {
 	var err error
 	if err = r.Body.Close(); err != nil {
 		return err
 	}
 
-	buf := new(bytes.Buffer)
+	buf := &cappedBuffer{max: maxBuffer}
+	err = encodeBody(buf, v, compress)
+	if err == errBufferCapExceeded {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(encodeBody(pw, v, compress))
+		}()
+
+		r.Body = pr
+		r.ContentLength = -1
+		r.Header.Del("Content-Length")
+
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r.Body = ioutil.NopCloser(&buf.buf)
+	r.ContentLength = int64(buf.buf.Len())
+	r.Header.Set("Content-Length", strconv.Itoa(buf.buf.Len()))
+
+	return nil
+}
 
-	// gzip compress if the original response did
-	w := nopCloser(buf)
+// encodeBody writes v to w as JSON, gzip compressed if the original response
+// was.
+func encodeBody(w io.Writer, v interface{}, compress bool) error {
+	wc := nopCloser(w)
 	if compress {
-		w = gzip.NewWriter(buf)
+		wc = gzip.NewWriter(w)
 	}
 
-	if err = json.NewEncoder(w).Encode(br); err != nil {
+	if err := json.NewEncoder(wc).Encode(v); err != nil {
 		return err
 	}
-	if err = w.Close(); err != nil {
-		return err
+
+	return wc.Close()
+}
+
+var errBufferCapExceeded = errors.New("buffer cap exceeded")
+
+// cappedBuffer is a bytes.Buffer that fails writes beyond max bytes.
+type cappedBuffer struct {
+	buf bytes.Buffer
+	max int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.max > 0 && int64(b.buf.Len()+len(p)) > b.max {
+		return 0, errBufferCapExceeded
 	}
 
-	r.Body = ioutil.NopCloser(buf)
-	r.ContentLength = int64(buf.Len())
-	r.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	return b.buf.Write(p)
+}
 
-	return nil
+type nocacheTarget struct {
+	url    *url.URL
+	header http.Header
 }
 
-func (s *Server) nocache() *httputil.ReverseProxy {
+func (s *Server) nocache() http.Handler {
 	director := func(req *http.Request) {
-		addr, _, header, err := s.parseHeaders(req)
+		target := req.Context().Value(contextKeyNoCacheTarget).(*nocacheTarget)
+
+		target.header.Set("User-Agent", s.upstreamUserAgent(req.Header.Get("User-Agent")))
+
+		// pass on the expectation, so that upload bodies are only sent once
+		// the upstream has accepted them
+		if expect := req.Header.Get("Expect"); expect != "" {
+			target.header.Set("Expect", expect)
+		}
+
+		req.Host = target.url.Host
+		req.URL = target.url
+		req.Header = target.header
+		stripHeaders(req.Header, s.stripRequestHeaders)
+	}
+
+	errorHandler := func(w http.ResponseWriter, r *http.Request, err error) {
+		level.Error(s.logger).Log("event", "proxying-no-cache", "request", r.URL, "err", err)
+		writeContentError(w, http.StatusBadGateway, path.Base(r.URL.Path), "proxying object from upstream failed")
+	}
+
+	proxy := &httputil.ReverseProxy{Director: director, Transport: s.client.Transport, ErrorHandler: errorHandler, ModifyResponse: s.modifyResponse(nil)}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// validate the signature before proxying, as serve does
+		addr, size, header, err := s.parseHeaders(r)
 		if err != nil {
+			s.rejectHeaders(w, r, "proxying-no-cache", err)
 			return
 		}
 
 		originalURL, err := url.Parse(addr)
 		if err != nil {
+			level.Error(s.logger).Log("event", "proxying-no-cache", "request", r.URL, "err", err)
+			writeContentError(w, http.StatusBadRequest, path.Base(r.URL.Path), "invalid upstream href")
 			return
 		}
 
-		req.Host = originalURL.Host
-		req.URL = originalURL
-		req.Header = header
-	}
-
-	errorHandler := func(w http.ResponseWriter, r *http.Request, err error) {
-		level.Error(s.logger).Log("event", "proxying-no-cache", "request", r.URL, "err", err)
-	}
+		if s.audit != nil && r.Method == http.MethodGet {
+			oid := path.Base(r.URL.Path)
+			hit := s.audit.record(s.KeyFunc(oid, r), int64(size))
+			level.Info(s.logger).Log("event", "audit", "oid", oid, "size", size, "would-hit", hit)
+		}
 
-	return &httputil.ReverseProxy{Director: director, ErrorHandler: errorHandler}
+		ctx := context.WithValue(r.Context(), contextKeyNoCacheTarget, &nocacheTarget{
+			url:    originalURL,
+			header: header,
+		})
+		proxy.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
 
 func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	oid := path.Base(r.URL.Path)
+	if s.shed(w, oid) {
+		return
+	}
+
 	url, size, header, err := s.parseHeaders(r)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		s.rejectHeaders(w, r, "serving", err)
 		return
 	}
 
 	begin := time.Now()
-	oid := path.Base(r.URL.Path)
-	cr, cw, source, err := s.cache.Get(oid)
+	key := s.KeyFunc(oid, r)
+	if failure, ok := s.failures.get(key); ok {
+		level.Error(s.logger).Log("event", "serving", "oid", oid, "source", "failed-fetch", "err", failure.err)
+
+		// retrying before the failure expires gets the same response
+		if failure.status == http.StatusServiceUnavailable {
+			setRetryAfter(w, time.Until(failure.expires))
+		}
+		writeContentError(w, failure.status, oid, fetchErrorMessage(failure.err))
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		s.serveHead(w, key, oid, size)
+		return
+	}
+
+	// the redirect can't carry the upstream headers, so only hrefs that
+	// don't need any are redirected
+	redirect := s.missRedirect && len(header) == 0
+
+	// over the buffer budget, misses are shed, and over the soft fetch limit
+	// they're proxied rather than fetched. Misses that are redirected are
+	// neither served through a buffer nor wait on their fetch, so are always
+	// fetched. An object on disk whose size doesn't match is quarantined and
+	// looked up again, as a miss.
+	var cr cache.ReadAtReadCloser
+	var cw io.WriteCloser
+	var source cache.Source
+	for attempt := 0; ; attempt++ {
+		overBudget := !redirect && s.overBufferBudget()
+		if overBudget || (!redirect && s.overSoftFetchLimit()) {
+			cr, source, err = s.cache.Lookup(key)
+			if err == cache.ErrKeyNotFound {
+				if overBudget {
+					s.shedBuffers(w, oid)
+				} else {
+					s.bypass(w, r, oid)
+				}
+				return
+			}
+		} else {
+			cr, cw, source, err = s.cache.Get(key)
+		}
+		if err != nil || source != cache.SourceDisk || attempt > 0 || s.diskSizeMatches(key, oid, cr, size) {
+			break
+		}
+	}
+	wait := time.Since(begin)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		level.Error(s.logger).Log("event", "serving", "oid", oid, "err", err)
+		message := "cache unavailable"
+		if err == cache.ErrTooManyReaders {
+			message = "too many requests for object"
+		}
+		setRetryAfter(w, s.retryAfter)
+		writeContentError(w, http.StatusServiceUnavailable, oid, message)
 		return
 	}
 
 	level.Info(s.logger).Log("event", "serving", "oid", oid, "source", source)
+	if s.sourceHeader {
+		w.Header().Set(SourceHeader, string(source))
+	}
+
+	// abort rather than end the response short if the object can't be read
+	// in full, such as when the fetch fails, so that clients don't mistake
+	// it for a complete response
+	reader := &errReaderAt{r: cr, size: int64(size)}
+
 	defer func() {
-		logger := log.With(s.logger, "event", "served", "oid", oid, "source", source, "took", time.Since(begin))
+		end := time.Now()
+
+		// the time waiting on the cache, until the first byte was read (from
+		// the upstream, for fresh and inflight objects) and streaming the
+		// rest to the client
+		logger := log.With(s.logger, "event", "served", "oid", oid, "source", source, "took", end.Sub(begin), "wait", wait)
+		if !reader.first.IsZero() {
+			logger = log.With(logger, "ttfb", reader.first.Sub(begin), "stream", end.Sub(reader.first))
+		}
 		if err != nil {
 			level.Error(logger).Log("err", err)
 		} else {
@@ -350,28 +1103,250 @@ func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	defer cr.Close()
+
 	if cw != nil {
-		go s.fetch(cw, oid, url, size, header)
+		header.Set("User-Agent", s.upstreamUserAgent(r.Header.Get("User-Agent")))
 	}
 
-	defer cr.Close()
-	http.ServeContent(w, r, "", time.Time{}, io.NewSectionReader(cr, 0, int64(size)))
+	if cw != nil && redirect {
+		s.inflight.Add(1)
+		go s.fetch(cw, key, oid, url, size, header, s.fetchPriority(r), nil)
+
+		level.Info(s.logger).Log("event", "redirecting", "oid", oid)
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+
+	if source != cache.SourceDisk {
+		defer s.reserveBuffer()()
+	}
+
+	if cw != nil {
+		ready := make(chan error, 1)
+		s.inflight.Add(1)
+		go s.fetch(cw, key, oid, url, size, header, s.fetchPriority(r), ready)
+
+		// wait for the upstream response before writing a status, so that
+		// an unreachable upstream is reported rather than sending a 200 and
+		// a truncated body
+		dequeue := s.enqueue()
+		select {
+		case err = <-ready:
+		case <-r.Context().Done():
+			err = r.Context().Err()
+		}
+		dequeue()
+		if err != nil {
+			status := fetchErrorStatus(err)
+			if status == http.StatusServiceUnavailable {
+				setRetryAfter(w, s.retryAfter)
+			}
+			writeContentError(w, status, oid, fetchErrorMessage(err))
+			return
+		}
+	}
+
+	// if the client disconnects, close the reader so that it stops waiting
+	// on data that is still being fetched. The fetch itself continues, as
+	// other clients may be reading it and the object is cached either way.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			cr.Close()
+		case <-done:
+		}
+	}()
+
+	defer func() {
+		if reader.err != nil {
+			err = reader.err
+			panic(http.ErrAbortHandler)
+		}
+	}()
+
+	content := io.NewSectionReader(reader, 0, int64(size))
+	if s.wireCompression {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding != "" && r.Header.Get("Range") == "" && compressible(content, int64(size)) {
+			err = serveCompressed(w, r, content, encoding)
+			return
+		}
+	}
+
+	// objects that aren't on disk are flushed to the client as they're
+	// fetched, so that the first bytes aren't held back waiting for reads and
+	// the response buffer to fill
+	var body io.ReadSeeker = content
+	if f, ok := w.(http.Flusher); ok && s.flushInflight && source != cache.SourceDisk {
+		w = &flushWriter{ResponseWriter: w, flusher: f}
+		body = &availableReader{r: reader, size: int64(size)}
+
+		// sniffing the content type would wait for its first 512 bytes
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	w.Header().Set("ETag", objectETag(oid))
+	http.ServeContent(w, r, "", time.Time{}, body)
+	err = r.Context().Err()
+}
+
+// serveHead answers a HEAD request for an object without opening or fetching
+// it, for clients probing an object's existence and size. Both hits and
+// misses are described by the signed size, which is what a GET would serve:
+// an object on disk of a different size is replaced by a fetch.
+func (s *Server) serveHead(w http.ResponseWriter, key, oid string, size int) {
+	source := cache.SourceDisk
+	fi, err := s.cache.Stat(key)
+	switch {
+	case err == cache.ErrKeyNotFound:
+		source = ""
+	case err != nil:
+		level.Error(s.logger).Log("event", "serving", "oid", oid, "method", http.MethodHead, "err", err)
+		setRetryAfter(w, s.retryAfter)
+		writeContentError(w, http.StatusServiceUnavailable, oid, "cache unavailable")
+		return
+	case fi.Size() != int64(size):
+		source = ""
+	}
+
+	level.Info(s.logger).Log("event", "serving", "oid", oid, "method", http.MethodHead, "source", source, "size", size)
+	if s.sourceHeader && source != "" {
+		w.Header().Set(SourceHeader, string(source))
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", objectETag(oid))
+	w.WriteHeader(http.StatusOK)
+}
+
+// objectETag returns the entity tag of an object's content. Objects are
+// addressed by their SHA-256 digest, so the OID identifies the content.
+func objectETag(oid string) string {
+	return `"` + oid + `"`
+}
+
+// diskSizeMatches returns whether the size of the object read from disk by r
+// is the declared size. If it isn't, r is closed and the object quarantined.
+func (s *Server) diskSizeMatches(key, oid string, r cache.ReadAtReadCloser, size int) bool {
+	f, ok := r.(interface{ Stat() (os.FileInfo, error) })
+	if !ok {
+		return true
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == int64(size) {
+		return true
+	}
+
+	mismatch := fmt.Sprintf("cached size %d doesn't match declared size %d", fi.Size(), size)
+	level.Warn(s.logger).Log("event", "serving", "oid", oid, "source", cache.SourceDisk, "err", mismatch)
+	r.Close()
+	if err := s.cache.Quarantine(key, fi); err != nil {
+		level.Error(s.logger).Log("event", "quarantine", "oid", oid, "err", err)
+	} else {
+		level.Error(s.logger).Log("event", "quarantined", "oid", oid, "size", fi.Size())
+		s.webhook.send(WebhookEvent{Event: WebhookEventEvicted, OID: oid, Size: fi.Size(), Source: string(cache.SourceDisk), Error: mismatch})
+	}
+
+	return false
+}
+
+// errReaderAt records the first error, other than io.EOF, returned by the
+// underlying io.ReaderAt. The read that reaches the end of the object is held
+// back until the object is known to be complete, so that an object that fails
+// verification, or that is fetched again after it, isn't served in full.
+type errReaderAt struct {
+	r     io.ReaderAt
+	size  int64
+	err   error
+	first time.Time
+}
+
+func (r *errReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(p, off)
+	return r.record(off, n, err)
+}
+
+// ReadAvailableAt reads from the underlying reader as it's fetched, recording
+// the first read and error like ReadAt. Readers that can't return partial
+// reads are read with ReadAt.
+func (r *errReaderAt) ReadAvailableAt(p []byte, off int64) (int, error) {
+	ar, ok := r.r.(availableReaderAt)
+	if !ok {
+		return r.ReadAt(p, off)
+	}
+
+	n, err := ar.ReadAvailableAt(p, off)
+	return r.record(off, n, err)
+}
+
+// record records the first read and error of a read of n bytes from off. A
+// read reaching the end of the object only returns once reading past the end
+// returns io.EOF, which readers of an inflight object only do once its fetch
+// has succeeded.
+func (r *errReaderAt) record(off int64, n int, err error) (int, error) {
+	if n > 0 && r.first.IsZero() {
+		r.first = time.Now()
+	}
+	if n > 0 && off+int64(n) >= r.size && (err == nil || err == io.EOF) {
+		if _, cerr := r.r.ReadAt(make([]byte, 1), r.size); cerr != io.EOF {
+			if cerr == nil {
+				cerr = fmt.Errorf("object is larger than %d bytes", r.size)
+			}
+			n, err = 0, cerr
+		}
+	}
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// upstreamUserAgent returns the User-Agent to use for upstream requests.
+func (s *Server) upstreamUserAgent(clientUserAgent string) string {
+	if s.userAgent != "" {
+		return s.userAgent
+	}
+
+	userAgent := "lfscache/" + s.version
+	if clientUserAgent != "" {
+		userAgent = clientUserAgent + " " + userAgent
+	}
+
+	return userAgent
 }
 
 func (s *Server) parseHeaders(r *http.Request) (url string, size int, header http.Header, err error) {
-	// check header is valid
+	// a missing header is a misconfigured client or stale URL, whereas a
+	// signature that doesn't match is a URL that's been tampered with or
+	// signed with a different key
+	if r.Header.Get(SignatureHeader) == "" {
+		return "", 0, nil, errMissingSignature
+	}
+	if r.Header.Get(OriginalHrefHeader) == "" {
+		return "", 0, nil, errMissingHref
+	}
+
 	signature, err := hex.DecodeString(r.Header.Get(SignatureHeader))
 	if err != nil {
-		return "", 0, nil, err
+		return "", 0, nil, errInvalidSignature
 	}
 
-	mac := hmac.New(sha256.New, s.hmacKey[:])
-	mac.Write([]byte(r.Header.Get(UpstreamHeaderList)))
-	mac.Write([]byte(r.Header.Get(OriginalHrefHeader)))
-	mac.Write([]byte(r.Header.Get(SizeHeader)))
-
-	if !hmac.Equal(mac.Sum(nil), signature) {
-		return "", 0, nil, errors.New("invalid signature")
+	mac := sign(
+		s.hmacHash,
+		s.hmacKey,
+		r.Header.Get(UpstreamHeaderList),
+		r.Header.Get(OriginalHrefHeader),
+		r.Header.Get(SizeHeader),
+	)
+	if !hmac.Equal(mac, signature) {
+		return "", 0, nil, errSignatureMismatch
 	}
 
 	header = make(http.Header)
@@ -383,24 +1358,172 @@ func (s *Server) parseHeaders(r *http.Request) (url string, size int, header htt
 	}
 
 	if size, err = strconv.Atoi(r.Header.Get(SizeHeader)); err != nil {
-		return "", 0, header, err
+		return "", 0, header, fmt.Errorf("invalid size: %v", err)
 	}
 
 	url = r.Header.Get(OriginalHrefHeader)
+	if !s.upstreamAllowed(url) {
+		return "", 0, nil, errUpstreamHostNotAllowed
+	}
 
 	return
 }
 
-func (s *Server) fetch(w io.Writer, oid, url string, size int, header http.Header) (err error) {
-	level.Info(s.logger).Log("event", "fetching", "oid", oid)
+// rejectHeaders logs and responds to a content request whose headers
+// parseHeaders rejected. Signature mismatches and disallowed upstream hosts
+// are logged as errors, as they may be attempts to tamper with a URL, other
+// errors as warnings.
+func (s *Server) rejectHeaders(w http.ResponseWriter, r *http.Request, event string, err error) {
+	status := http.StatusBadRequest
+	logger := level.Warn(s.logger)
+	switch err {
+	case errUpstreamHostNotAllowed:
+		status = http.StatusForbidden
+		logger = level.Error(s.logger)
+	case errSignatureMismatch:
+		logger = level.Error(s.logger)
+	}
+
+	logger.Log("event", event, "request", r.URL, "remote", r.RemoteAddr, "err", err)
+	writeContentError(w, status, path.Base(r.URL.Path), err.Error())
+}
+
+// mirrorHref returns the href of an object on the upstream mirror, if one is
+// configured. Hrefs under the upstream URL are rebased onto the mirror URL,
+// other hrefs have their scheme and host replaced with the mirror's.
+func (s *Server) mirrorHref(href string) (string, bool) {
+	if s.mirror == nil {
+		return "", false
+	}
+
+	if strings.HasPrefix(href, s.upstream.String()) {
+		return s.mirror.String() + strings.TrimPrefix(href, s.upstream.String()), true
+	}
+
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", false
+	}
+	u.Scheme = s.mirror.Scheme
+	u.Host = s.mirror.Host
+
+	return u.String(), true
+}
+
+// passthrough returns the handler for requests that aren't for a cached LFS
+// endpoint, which are proxied to the upstream as is unless passthrough is
+// disabled.
+func (s *Server) passthrough() http.Handler {
+	if s.noPassthrough {
+		return http.NotFoundHandler()
+	}
+
+	return s.proxy()
+}
+
+// projectRouter routes the batch and legacy object endpoints of any project
+// path, such as /org/repo.git/info/lfs/objects/batch, to their handlers, and
+// other requests to next.
+func projectRouter(batch, legacy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dir, _ := path.Split(r.URL.Path)
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/objects/batch"):
+			batch.ServeHTTP(w, r)
+		case strings.HasSuffix(dir, "/objects/"):
+			legacy.ServeHTTP(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// resolveUpstream returns the upstream URL for ref, a URL with a path
+// relative to the upstream. The upstream's path is treated as a directory
+// even without a suffixed separator, so that resolving doesn't replace its
+// last segment, and an empty path resolves to the upstream itself.
+func (s *Server) resolveUpstream(ref *url.URL) *url.URL {
+	if ref.Path == "" {
+		u := *s.upstream
+		u.RawQuery = ref.RawQuery
+		return &u
+	}
+
+	base := s.upstream
+	if !strings.HasSuffix(base.Path, "/") {
+		dir := *base
+		dir.Path += "/"
+		if dir.RawPath != "" {
+			dir.RawPath += "/"
+		}
+		base = &dir
+	}
+
+	return base.ResolveReference(ref)
+}
+
+// upstreamAllowed returns whether objects can be fetched from the href's host.
+// All hosts are allowed when no allowlist has been configured.
+func (s *Server) upstreamAllowed(href string) bool {
+	if s.allowedHosts == nil {
+		return true
+	}
+
+	u, err := url.Parse(href)
+	if err != nil {
+		return false
+	}
+
+	return s.allowedHosts[strings.ToLower(u.Host)] || s.allowedHosts[strings.ToLower(u.Hostname())]
+}
+
+// fetchPriority returns the scheduling priority for a fetch triggered by the
+// request.
+func (s *Server) fetchPriority(r *http.Request) int {
+	if !s.prioritize {
+		return 0
+	}
+
+	priority, err := strconv.Atoi(r.Header.Get(PriorityHeader))
+	if err != nil {
+		return s.defaultPriority
+	}
+
+	return priority
+}
+
+// fetch downloads an object from the upstream into w, the cache writer for
+// key. If ready isn't nil, it receives nil once the upstream has responded
+// successfully and the transfer starts, or the error if the fetch fails
+// before then.
+func (s *Server) fetch(w io.Writer, key, oid, url string, size int, header http.Header, priority int, ready chan<- error) (err error) {
+	defer s.inflight.Done()
+
+	atomic.AddInt64(&s.fetching, 1)
+	defer atomic.AddInt64(&s.fetching, -1)
+
+	started := func(err error) {
+		if ready != nil {
+			ready <- err
+			ready = nil
+		}
+	}
+
+	// without prioritization, queued fetches are served in order
+	queuedSize := 0
+	if s.prioritize {
+		queuedSize = size
+	}
 
-	hcw := &hashCountWriter{
-		h: sha256.New(),
-		w: w,
+	hcw := &hashCountWriter{w: w}
+	if !s.skipChecksum {
+		hcw.h = sha256.New()
 	}
 
 	begin := time.Now()
 	var beginTransfer time.Time
+	var etag string
 	defer func() {
 		rate := formatByteRate(uint64(hcw.n), time.Since(beginTransfer))
 
@@ -411,40 +1534,275 @@ func (s *Server) fetch(w io.Writer, oid, url string, size int, header http.Heade
 			level.Info(logger).Log()
 		}
 
-		err := s.cache.Done(oid, err)
+		event := WebhookEvent{Event: WebhookEventFetched, OID: oid, Size: int64(hcw.n), Source: string(cache.SourceFresh)}
 		if err != nil {
-			panic(err)
+			event.Event = WebhookEventFetchFailed
+			if err == errChecksumMismatch {
+				event.Event = WebhookEventChecksumMismatch
+			}
+			event.Error = err.Error()
+		}
+		s.webhook.send(event)
+		if err != nil {
+			s.failures.add(key, err)
+		}
+		started(err)
+
+		// a fetch that exceeded the maximum inflight duration has already
+		// been failed by the cache, and the key may be being fetched again
+		if crw, ok := w.(*cache.ConcurrentReadWriter); ok && crw.Closed() {
+			return
+		}
+		if derr := s.cache.DoneWithMetadata(key, err, fetchMetadata(url, etag)); derr != nil {
+			metricCacheWriteErrors.Add(1)
+			level.Error(s.logger).Log("event", "done", "oid", oid, "err", derr)
 		}
 	}()
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
+	// fetches are only abandoned if shutdown times out
+	if err = s.fetches.acquire(s.fetchCtx, priority, queuedSize); err != nil {
 		return err
 	}
+	defer s.fetches.release()
+
+	ctx, deadline := s.fetchContext(hcw, w)
+	defer deadline.stop()
+	defer func() {
+		if err != nil {
+			err = deadline.reason(err)
+		}
+	}()
 
-	req.Header = header
-	resp, err := s.client.Do(req)
+	// a kept partial is resumed by only requesting the remaining range. One
+	// that isn't smaller than the object can't be resumed, and is discarded.
+	var resumed int
+	if crw, ok := w.(*cache.ConcurrentReadWriter); ok {
+		if offset := crw.Offset(); offset < int64(size) {
+			resumed = int(offset)
+		} else if offset > 0 {
+			if err := crw.Rewind(nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	level.Info(s.logger).Log("event", "fetching", "oid", oid, "resume", resumed)
+
+	// large objects can be fetched as multiple ranges in parallel, the first
+	// range request also probes whether the upstream supports ranges
+	partSize := size
+	if _, ok := w.(*cache.ConcurrentReadWriter); ok && s.parallelFetch > 1 && size >= minParallelFetchSize && resumed == 0 {
+		partSize = (size + s.parallelFetch - 1) / s.parallelFetch
+	}
+
+	var byteRange string
+	switch {
+	case resumed > 0:
+		byteRange = fmt.Sprintf("bytes=%d-", resumed)
+	case partSize < size:
+		byteRange = httpRange(0, partSize)
+	}
+
+	// transport errors and truncated transfers are retryable, the data
+	// written so far can be kept and resumed. A fetch that was cancelled,
+	// such as by its deadline or shutdown, isn't retried from the mirror.
+	resp, err := s.get(ctx, url, header, byteRange)
+	if mirror, ok := s.mirrorHref(url); ok && ctx.Err() == nil && (err != nil || resp.StatusCode >= 500) {
+		if err == nil {
+			resp.Body.Close()
+			err = upstreamStatusError{resp.StatusCode}
+		}
+		level.Error(s.logger).Log("event", "fetching", "oid", oid, "err", err, "fallback", mirror)
+
+		url = mirror
+		resp, err = s.get(ctx, url, header, byteRange)
+	}
 	if err != nil {
-		return err
+		return cache.Retryable(err)
+	}
+
+	defer resp.Body.Close()
+	etag = resp.Header.Get("ETag")
+
+	if partSize < size && resp.StatusCode == http.StatusPartialContent {
+		started(nil)
+		beginTransfer = time.Now()
+		if err = s.fetchParts(ctx, hcw, w.(*cache.ConcurrentReadWriter), resp, url, header, size, partSize); err != nil {
+			return err
+		}
+
+		return s.verified(ctx, w, hcw, oid, url, size, header)
+	}
+
+	if resumed > 0 && resp.StatusCode == http.StatusPartialContent {
+		if err = s.resume(hcw, w.(*cache.ConcurrentReadWriter), resp, resumed, size); err != nil {
+			return err
+		}
+
+		started(nil)
+		beginTransfer = time.Now()
+		if _, err = io.Copy(hcw, resp.Body); err != nil {
+			return cache.Retryable(err)
+		}
+
+		return s.verified(ctx, w, hcw, oid, url, size, header)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("upstream server responded with %d status", resp.StatusCode)
+		return upstreamStatusError{resp.StatusCode}
 	}
 
-	defer resp.Body.Close()
+	// the upstream ignored the range and is sending the whole object, which
+	// is written over the partial from the start
+	if resumed > 0 {
+		hcw.w = &offsetWriter{w: w.(io.WriterAt)}
+	}
 
+	if resp.ContentLength >= 0 && resp.ContentLength != int64(size) {
+		return fmt.Errorf("upstream content length %d does not match expected size %d", resp.ContentLength, size)
+	}
+
+	started(nil)
 	beginTransfer = time.Now()
-	_, err = io.Copy(hcw, resp.Body)
-	if err == nil {
-		if oid != hex.EncodeToString(hcw.h.Sum(nil)) {
-			return fmt.Errorf("file checksum mismatch")
+	if _, err = io.Copy(hcw, resp.Body); err != nil {
+		return cache.Retryable(err)
+	}
+
+	return s.verified(ctx, w, hcw, oid, url, size, header)
+}
+
+// get requests an upstream object, optionally limited to a byte range.
+func (s *Server) get(ctx context.Context, url string, header http.Header, byteRange string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header = header.Clone()
+	stripHeaders(req.Header, s.stripRequestHeaders)
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+
+	return s.client.Do(req)
+}
+
+// fetchMetadata returns the details of the fetch that cached an object, to
+// be recorded in its metadata. The href's query and credentials aren't
+// recorded, as they're often the signature of a presigned URL.
+func fetchMetadata(href, etag string) cache.Metadata {
+	if u, err := url.Parse(href); err == nil {
+		u.User, u.RawQuery, u.Fragment = nil, "", ""
+		href = u.String()
+	}
+
+	return cache.Metadata{Upstream: href, ETag: etag}
+}
+
+// verify checks that the fetched content has the expected size and checksum.
+func (s *Server) verify(hcw *hashCountWriter, oid string, size int) error {
+	// catch truncated responses before the checksum is compared
+	if hcw.n < size {
+		return cache.Retryable(fmt.Errorf("upstream sent %d bytes, expected %d", hcw.n, size))
+	}
+	if hcw.n != size {
+		return fmt.Errorf("upstream sent %d bytes, expected %d", hcw.n, size)
+	}
+
+	if hcw.h != nil && oid != hex.EncodeToString(hcw.h.Sum(nil)) {
+		return errChecksumMismatch
+	}
+
+	return nil
+}
+
+// verified verifies the fetched content like verify. If its checksum doesn't
+// match, the whole object is fetched again up to the checksum retry limit, as
+// a corrupt download from a flaky upstream may be correct the next time.
+func (s *Server) verified(ctx context.Context, w io.Writer, hcw *hashCountWriter, oid, href string, size int, header http.Header) error {
+	err := s.verify(hcw, oid, size)
+	for attempt := 1; err == errChecksumMismatch && attempt <= s.checksumRetries; attempt++ {
+		metricChecksumRetries.Add(1)
+		level.Warn(s.logger).Log("event", "fetching", "oid", oid, "err", err, "retry", attempt)
+
+		if err = s.refetch(ctx, w, hcw, href, header); err == nil {
+			err = s.verify(hcw, oid, size)
 		}
 	}
 
 	return err
 }
 
+// refetch fetches the whole object again, writing it over the previous
+// attempt from the start, with hcw's count and hash reset. Readers of the
+// object that haven't read anything yet wait for it to be written again, and
+// those that have fail with errChecksumMismatch.
+func (s *Server) refetch(ctx context.Context, w io.Writer, hcw *hashCountWriter, href string, header http.Header) error {
+	crw, ok := w.(*cache.ConcurrentReadWriter)
+	if !ok {
+		return errChecksumMismatch
+	}
+
+	resp, err := s.get(ctx, href, header, "")
+	if err != nil {
+		return cache.Retryable(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return upstreamStatusError{resp.StatusCode}
+	}
+
+	if err = crw.Rewind(errChecksumMismatch); err != nil {
+		return err
+	}
+	hcw.n = 0
+	hcw.h.Reset()
+	hcw.w = crw
+
+	if _, err = io.Copy(hcw, resp.Body); err != nil {
+		return cache.Retryable(err)
+	}
+	return nil
+}
+
+// resume prepares hcw to append a 206 response to the resumed bytes of a kept
+// partial, seeding the hash with the data already written.
+func (s *Server) resume(hcw *hashCountWriter, crw *cache.ConcurrentReadWriter, resp *http.Response, resumed, size int) error {
+	if contentRange := resp.Header.Get("Content-Range"); !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-%d/", resumed, size-1)) {
+		return fmt.Errorf("upstream responded with range %q, expected from %d", contentRange, resumed)
+	}
+
+	if hcw.h != nil {
+		r := crw.Reader()
+		if r == nil {
+			return errors.New("partial closed before resuming")
+		}
+		defer r.Close()
+
+		if _, err := io.Copy(hcw.h, io.NewSectionReader(r, 0, int64(resumed))); err != nil {
+			return err
+		}
+	}
+
+	hcw.n = resumed
+
+	return nil
+}
+
+// offsetWriter writes sequentially to an io.WriterAt.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.w.WriteAt(p, ow.off)
+	ow.off += int64(n)
+	return n, err
+}
+
 type nc struct {
 	io.Writer
 }
@@ -458,15 +1816,37 @@ func nopCloser(w io.Writer) io.WriteCloser {
 }
 
 type hashCountWriter struct {
+	// progress counts the bytes written for readers in other goroutines, it
+	// is first so that it is 64-bit aligned for atomic access.
+	progress int64
+
 	n int
 	h hash.Hash
 	w io.Writer
 }
 
+// Write writes p to the underlying writer, counting and hashing only the bytes
+// that were written, so that a caller retrying the rest of p after a short
+// write never hashes bytes twice. A short write without an error is reported
+// as io.ErrShortWrite, as io.Writer requires.
 func (hcw *hashCountWriter) Write(p []byte) (n int, err error) {
 	n, err = hcw.w.Write(p)
+	if n < 0 || n > len(p) {
+		n = 0
+	}
+	if n < len(p) && err == nil {
+		err = io.ErrShortWrite
+	}
 	hcw.n += n
-	hcw.h.Write(p[:n])
+	atomic.AddInt64(&hcw.progress, int64(n))
+
+	// hcw wraps the cache writer, so errors are cache write failures
+	if err != nil {
+		metricCacheWriteErrors.Add(1)
+	}
+	if hcw.h != nil {
+		hcw.h.Write(p[:n])
+	}
 	return
 }
 
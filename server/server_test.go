@@ -1,20 +1,37 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/saracen/lfscache/cache"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-func server() (*httptest.Server, *Server, string, error) {
+func server(options ...Option) (*httptest.Server, *Server, string, error) {
 	var ts *httptest.Server
 	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
@@ -24,7 +41,7 @@ func server() (*httptest.Server, *Server, string, error) {
 				Objects: []*BatchObjectResponse{
 					{
 						OID:           "1111111",
-						Size:          123,
+						Size:          int64(len("upstream")),
 						Authenticated: true,
 						Actions: map[string]*BatchObjectActionResponse{
 							"download": {
@@ -47,11 +64,105 @@ func server() (*httptest.Server, *Server, string, error) {
 		return ts, nil, dir, err
 	}
 
-	s, err := New(log.NewNopLogger(), ts.URL, dir)
+	s, err := New(log.NewNopLogger(), ts.URL, dir, options...)
 
 	return ts, s, dir, err
 }
 
+func objectServer(content []byte, options ...Option) (*httptest.Server, *Server, string, error) {
+	return objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}, options...)
+}
+
+// objectServerWithDownload is like objectServer, but the object's download
+// is served by the given handler.
+func objectServerWithDownload(content []byte, handler http.HandlerFunc, options ...Option) (*httptest.Server, *Server, string, error) {
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/objects/batch":
+			json.NewEncoder(w).Encode(BatchResponse{
+				Transfer: "basic",
+				Objects: []*BatchObjectResponse{
+					{
+						OID:  oid,
+						Size: int64(len(content)),
+						Actions: map[string]*BatchObjectActionResponse{
+							"download": {
+								Href: ts.URL + "/download/" + oid,
+							},
+						},
+					},
+				},
+			})
+
+		case "/objects/" + oid:
+			json.NewEncoder(w).Encode(LegacyObjectResponse{
+				OID:  oid,
+				Size: int64(len(content)),
+				Links: map[string]*BatchObjectActionResponse{
+					"download": {
+						Href: ts.URL + "/download/" + oid,
+					},
+				},
+			})
+
+		case "/download/" + oid:
+			handler(w, r)
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return ts, nil, dir, err
+	}
+
+	s, err := New(log.NewNopLogger(), ts.URL, dir, options...)
+
+	return ts, s, dir, err
+}
+
+func batchAction(t *testing.T, s *Server) *BatchObjectActionResponse {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/objects/batch", nil)
+	s.Handle().ServeHTTP(w, req)
+
+	var br BatchResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&br))
+	require.Len(t, br.Objects, 1)
+	require.Contains(t, br.Objects[0].Actions, "download")
+
+	return br.Objects[0].Actions["download"]
+}
+
+func download(s *Server, action *BatchObjectActionResponse, method string, header http.Header) (w *httptest.ResponseRecorder) {
+	w = httptest.NewRecorder()
+	defer func() {
+		// aborted responses are left as written so far
+		if err := recover(); err != nil && err != http.ErrAbortHandler {
+			panic(err)
+		}
+	}()
+
+	req := httptest.NewRequest(method, action.Href, nil)
+	for key, val := range action.Header {
+		req.Header.Set(key, val)
+	}
+	for key := range header {
+		req.Header.Set(key, header.Get(key))
+	}
+	s.Handle().ServeHTTP(w, req)
+
+	return w
+}
+
 func TestProxy(t *testing.T) {
 	ts, s, dir, err := server()
 	defer os.RemoveAll(dir)
@@ -68,7 +179,9 @@ func TestProxy(t *testing.T) {
 }
 
 func TestBatch(t *testing.T) {
-	ts, s, dir, err := server()
+	// the upstream's object isn't its OID's content, so would fail
+	// verification and not be served
+	ts, s, dir, err := server(WithSkipChecksum())
 	defer os.RemoveAll(dir)
 	defer ts.Close()
 
@@ -96,3 +209,2516 @@ func TestBatch(t *testing.T) {
 	body, _ := ioutil.ReadAll(w.Body)
 	assert.Equal(t, body, []byte("upstream"))
 }
+
+func TestInfoPage(t *testing.T) {
+	ts, s, dir, err := server(WithVersion("1.2.3"), WithInfoPage())
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+
+	require.NoError(t, err)
+
+	{
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		s.Handle().ServeHTTP(w, req)
+
+		body, _ := ioutil.ReadAll(w.Body)
+		assert.Contains(t, string(body), "1.2.3")
+		assert.Contains(t, string(body), ts.URL)
+	}
+
+	{
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/anything", nil)
+		s.Handle().ServeHTTP(w, req)
+
+		body, _ := ioutil.ReadAll(w.Body)
+		assert.Equal(t, body, []byte("upstream"))
+	}
+}
+
+func TestInfoPageURL(t *testing.T) {
+	tests := map[string]struct {
+		options []Option
+		path    string
+		url     string
+	}{
+		"default":      {nil, "/", "http://example.com/"},
+		"strip prefix": {[]Option{WithStripPrefix("/git-lfs-cache/")}, "/git-lfs-cache/", "http://example.com/git-lfs-cache/"},
+		"public url":   {[]Option{WithPublicURL(&url.URL{Scheme: "https", Host: "lfs.example.org"})}, "/", "https://lfs.example.org/"},
+		"host only":    {[]Option{WithHostOnlyUpstream()}, "/", "http://example.com/ORG/REPO.git/info/lfs"},
+	}
+
+	for name, tc := range tests {
+		ts, s, dir, err := server(append(tc.options, WithInfoPage())...)
+		require.NoError(t, err, name)
+
+		w := httptest.NewRecorder()
+		s.Handle().ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		assert.Contains(t, w.Body.String(), "git config lfs.url "+tc.url+"</pre>", name)
+
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	var userAgent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		options  []Option
+		client   string
+		expected string
+	}{
+		{[]Option{WithVersion("1.0.0")}, "", "lfscache/1.0.0"},
+		{[]Option{WithVersion("1.0.0")}, "git-lfs/2.10.0", "git-lfs/2.10.0 lfscache/1.0.0"},
+		{[]Option{WithUserAgent("custom")}, "git-lfs/2.10.0", "custom"},
+	}
+
+	for _, tc := range tests {
+		s, err := NewNoCache(log.NewNopLogger(), ts.URL, tc.options...)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest("GET", "/anything", nil)
+		if tc.client != "" {
+			req.Header.Set("User-Agent", tc.client)
+		}
+		s.Handle().ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.Equal(t, tc.expected, userAgent)
+	}
+}
+
+func TestBatchForwardHeaders(t *testing.T) {
+	ts, s, dir, err := server(WithForwardHeaders("x-tenant", " Accept"))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+
+	var br BatchResponse
+	{
+		req := httptest.NewRequest("POST", ts.URL+"/objects/batch", nil)
+		req.Header.Set("X-Tenant", "acme")
+		s.Handle().ServeHTTP(w, req)
+
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&br))
+	}
+
+	require.Len(t, br.Objects, 1)
+	action := br.Objects[0].Actions["download"]
+	assert.Equal(t, "acme", action.Header["X-Tenant"])
+	assert.Contains(t, action.Header[UpstreamHeaderList], "X-Tenant")
+	assert.NotContains(t, action.Header, "Accept")
+}
+
+func TestServeRanges(t *testing.T) {
+	content := []byte("0123456789")
+
+	ts, s, dir, err := objectServer(content)
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+
+	require.NoError(t, err)
+	action := batchAction(t, s)
+
+	tests := []struct {
+		ranges       string
+		status       int
+		contentRange string
+		contentType  string
+		body         string
+	}{
+		{"", http.StatusOK, "", "", "0123456789"},
+		{"bytes=2-4", http.StatusPartialContent, "bytes 2-4/10", "", "234"},
+		{"bytes=-3", http.StatusPartialContent, "bytes 7-9/10", "", "789"},
+		{"bytes=10-", http.StatusRequestedRangeNotSatisfiable, "bytes */10", "", ""},
+		{"bytes=20-30", http.StatusRequestedRangeNotSatisfiable, "bytes */10", "", ""},
+		{"bytes=0-1,5-6", http.StatusPartialContent, "", "multipart/byteranges", ""},
+	}
+
+	for _, tc := range tests {
+		header := http.Header{}
+		if tc.ranges != "" {
+			header.Set("Range", tc.ranges)
+		}
+
+		w := download(s, action, "GET", header)
+
+		assert.Equal(t, tc.status, w.Code, tc.ranges)
+		assert.Equal(t, tc.contentRange, w.Header().Get("Content-Range"), tc.ranges)
+		if tc.contentType != "" {
+			assert.Contains(t, w.Header().Get("Content-Type"), tc.contentType, tc.ranges)
+		}
+		if tc.body != "" {
+			assert.Equal(t, tc.body, w.Body.String(), tc.ranges)
+		}
+	}
+}
+
+func TestServeUnsatisfiableRangeFresh(t *testing.T) {
+	ts, s, dir, err := objectServer([]byte("0123456789"))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+
+	require.NoError(t, err)
+	action := batchAction(t, s)
+
+	// an unsatisfiable range on an object not yet cached must not wait on
+	// data that will never arrive
+	w := download(s, action, "GET", http.Header{"Range": {"bytes=100-"}})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+	assert.Equal(t, "bytes */10", w.Header().Get("Content-Range"))
+}
+
+func TestLegacyDownload(t *testing.T) {
+	content := []byte("legacy content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	ts, s, dir, err := objectServer(content)
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+
+	require.NoError(t, err)
+
+	var or LegacyObjectResponse
+	{
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/objects/"+oid, nil)
+		s.Handle().ServeHTTP(w, req)
+
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&or))
+	}
+
+	require.Contains(t, or.Links, "download")
+	action := or.Links["download"]
+	assert.Contains(t, action.Href, ContentCachePathPrefix+oid)
+
+	w := download(s, action, "GET", nil)
+	assert.Equal(t, content, w.Body.Bytes())
+
+	// wait for the fetch to be promoted to the cache
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, "objects", oid[0:2], oid[2:4], oid))
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNoCacheSignature(t *testing.T) {
+	content := []byte("no cache content")
+
+	ts, _, dir, err := objectServer(content)
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	s, err := NewNoCache(log.NewNopLogger(), ts.URL)
+	require.NoError(t, err)
+	action := batchAction(t, s)
+
+	w := download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+
+	// tampered signature
+	w = download(s, action, "GET", http.Header{SignatureHeader: {"00"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, fmt.Sprintf(`{"message":"signature mismatch","oid":%q}`, path.Base(action.Href)), w.Body.String())
+
+	// malformed signature
+	w = download(s, action, "GET", http.Header{SignatureHeader: {"zz"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, fmt.Sprintf(`{"message":"invalid signature","oid":%q}`, path.Base(action.Href)), w.Body.String())
+
+	// missing href
+	href := action.Header[OriginalHrefHeader]
+	delete(action.Header, OriginalHrefHeader)
+	w = download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, fmt.Sprintf(`{"message":"missing href header","oid":%q}`, path.Base(action.Href)), w.Body.String())
+	action.Header[OriginalHrefHeader] = href
+
+	// missing signature
+	delete(action.Header, SignatureHeader)
+	w = download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, fmt.Sprintf(`{"message":"missing signature header","oid":%q}`, path.Base(action.Href)), w.Body.String())
+}
+
+func TestFetchSizeMismatch(t *testing.T) {
+	content := []byte("0123456789")
+
+	tests := map[string]http.HandlerFunc{
+		"content-length": func(w http.ResponseWriter, r *http.Request) {
+			w.Write(content[:5])
+		},
+		"truncated": func(w http.ResponseWriter, r *http.Request) {
+			w.(http.Flusher).Flush()
+			w.Write(content[:5])
+		},
+	}
+
+	for name, handler := range tests {
+		ts, s, dir, err := objectServerWithDownload(content, handler)
+		require.NoError(t, err)
+
+		download(s, batchAction(t, s), "GET", nil)
+
+		// the failed fetch must not be promoted to the cache
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, 0, s.cache.IndexStats().Objects, name)
+
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSkipChecksum(t *testing.T) {
+	content := []byte("0123456789")
+	corrupt := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("9876543210"))
+	}
+
+	for _, skip := range []bool{false, true} {
+		var options []Option
+		if skip {
+			options = append(options, WithSkipChecksum())
+		}
+
+		ts, s, dir, err := objectServerWithDownload(content, corrupt, options...)
+		require.NoError(t, err)
+
+		download(s, batchAction(t, s), "GET", nil)
+
+		time.Sleep(50 * time.Millisecond)
+		if skip {
+			assert.Equal(t, 1, s.cache.IndexStats().Objects)
+		} else {
+			assert.Equal(t, 0, s.cache.IndexStats().Objects)
+		}
+
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAuthCache(t *testing.T) {
+	var batches int32
+	var expiresIn int32 = 3600
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&batches, 1)
+		json.NewEncoder(w).Encode(BatchResponse{
+			Transfer: "basic",
+			Objects: []*BatchObjectResponse{
+				{
+					OID:  "1111111",
+					Size: 123,
+					Actions: map[string]*BatchObjectActionResponse{
+						"download": {
+							Href:      "https://foobar/download/1111111",
+							ExpiresIn: int(atomic.LoadInt32(&expiresIn)),
+						},
+					},
+				},
+			},
+		})
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(log.NewNopLogger(), ts.URL, dir, WithAuthCache(time.Minute))
+	require.NoError(t, err)
+
+	batch := func(authorization, body string) *BatchObjectActionResponse {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/objects/batch", strings.NewReader(body))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		s.Handle().ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var br BatchResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&br))
+		require.Len(t, br.Objects, 1)
+
+		return br.Objects[0].Actions["download"]
+	}
+
+	download := `{"operation":"download"}`
+	first := batch("Bearer a", download)
+	second := batch("Bearer a", download)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&batches))
+	assert.Equal(t, first.Href, second.Href)
+	assert.Equal(t, first.Header, second.Header)
+
+	// different credentials or request body
+	batch("Bearer b", download)
+	batch("Bearer a", `{"operation":"download","ref":{"name":"refs/heads/main"}}`)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&batches))
+
+	// different query string
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/objects/batch?private_token=b", strings.NewReader(download))
+	req.Header.Set("Authorization", "Bearer a")
+	s.Handle().ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&batches))
+
+	// credentials in other headers
+	for _, header := range []string{"Cookie", "Private-Token"} {
+		w = httptest.NewRecorder()
+		req = httptest.NewRequest("POST", "/objects/batch", strings.NewReader(download))
+		req.Header.Set("Authorization", "Bearer a")
+		req.Header.Set(header, "b")
+		s.Handle().ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	assert.Equal(t, int32(6), atomic.LoadInt32(&batches))
+
+	// requests with large bodies are not cached
+	large := download + strings.Repeat(" ", batchCacheMaxBodySize)
+	batch("Bearer a", large)
+	batch("Bearer a", large)
+	assert.Equal(t, int32(8), atomic.LoadInt32(&batches))
+
+	// unauthenticated requests are not cached
+	batch("", download)
+	batch("", download)
+	assert.Equal(t, int32(10), atomic.LoadInt32(&batches))
+
+	// responses with hrefs about to expire are not cached
+	atomic.StoreInt32(&expiresIn, 30)
+	batch("Bearer c", download)
+	batch("Bearer c", download)
+	assert.Equal(t, int32(12), atomic.LoadInt32(&batches))
+
+	// upload actions carry per-push authorization, and are never replayed
+	atomic.StoreInt32(&expiresIn, 3600)
+	batch("Bearer a", `{"operation":"upload"}`)
+	batch("Bearer a", `{"operation":"upload"}`)
+	assert.Equal(t, int32(14), atomic.LoadInt32(&batches))
+}
+
+func TestBatchCacheEntries(t *testing.T) {
+	bc := newBatchCache()
+
+	br := func() *BatchResponse {
+		return &BatchResponse{
+			Objects: []*BatchObjectResponse{
+				{
+					OID: "1111111",
+					Actions: map[string]*BatchObjectActionResponse{
+						"download": {Href: "https://foobar/download/1111111", ExpiresIn: 3600},
+					},
+				},
+			},
+		}
+	}
+
+	// the number of entries is bounded
+	for i := 0; i <= batchCacheMaxEntries; i++ {
+		bc.set(strconv.Itoa(i), time.Minute, br())
+	}
+	assert.Len(t, bc.entries, batchCacheMaxEntries)
+
+	// relative expiries are reduced by the age of the entry
+	last := strconv.Itoa(batchCacheMaxEntries)
+	entry := bc.entries[last]
+	entry.stored = entry.stored.Add(-1500 * time.Millisecond)
+	bc.entries[last] = entry
+	cached := bc.get(last)
+	require.NotNil(t, cached)
+	assert.Equal(t, 3598, cached.Objects[0].Actions["download"].ExpiresIn)
+}
+
+func TestBatchCache(t *testing.T) {
+	var batches int32
+	expiresAt := time.Now().Add(time.Hour)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&batches, 1)
+		json.NewEncoder(w).Encode(BatchResponse{
+			Transfer: "basic",
+			Objects: []*BatchObjectResponse{
+				{
+					OID:  "1111111",
+					Size: 123,
+					Actions: map[string]*BatchObjectActionResponse{
+						"download": {
+							Href:      "https://foobar/download/1111111",
+							ExpiresAt: expiresAt,
+						},
+					},
+				},
+			},
+		})
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(log.NewNopLogger(), ts.URL, dir, WithBatchCache(time.Minute), WithAuthCache(time.Second))
+	require.NoError(t, err)
+
+	batch := func(authorization string) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/objects/batch", strings.NewReader(`{"operation":"download"}`))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		s.Handle().ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var br BatchResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&br))
+		require.Len(t, br.Objects, 1)
+		assert.Contains(t, br.Objects[0].Actions["download"].Href, ContentCachePathPrefix)
+	}
+
+	batch("")
+	batch("")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&batches))
+
+	// authenticated requests use their own, shorter TTL
+	batch("Bearer a")
+	time.Sleep(1100 * time.Millisecond)
+	batch("Bearer a")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&batches))
+}
+
+func TestServeClientDisconnect(t *testing.T) {
+	content := make([]byte, 1<<20)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	release := make(chan struct{})
+	ts, s, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content[:len(content)/2])
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write(content[len(content)/2:])
+	})
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	action := batchAction(t, s)
+
+	served := make(chan struct{})
+	handler := s.Handle()
+	cs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+		close(served)
+	}))
+	defer cs.Close()
+
+	href, err := url.Parse(action.Href)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest("GET", cs.URL+href.Path, nil)
+	require.NoError(t, err)
+	for key, val := range action.Header {
+		req.Header.Set(key, val)
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	require.NoError(t, err)
+	_, err = io.ReadFull(resp.Body, make([]byte, 1024))
+	require.NoError(t, err)
+
+	// disconnect while the upstream is still stalled
+	cancel()
+	resp.Body.Close()
+
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("serve didn't return after client disconnected")
+	}
+
+	// the fetch completes and the object is cached
+	close(release)
+	oid := path.Base(href.Path)
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, "objects", oid[0:2], oid[2:4], oid))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestAllowedUpstreamHosts(t *testing.T) {
+	content := []byte("allowed content")
+
+	for host, code := range map[string]int{
+		"example.com": http.StatusForbidden,
+		"127.0.0.1":   http.StatusOK,
+	} {
+		ts, s, dir, err := objectServer(content, WithAllowedUpstreamHosts(host))
+		defer os.RemoveAll(dir)
+		defer ts.Close()
+		require.NoError(t, err)
+
+		w := download(s, batchAction(t, s), "GET", nil)
+		assert.Equal(t, code, w.Code, host)
+	}
+}
+
+func TestServeUpstreamFailure(t *testing.T) {
+	content := []byte("0123456789")
+	sum := sha256.Sum256(content)
+
+	tests := map[string]struct {
+		handler http.HandlerFunc
+		code    int
+	}{
+		"client-error": {func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}, http.StatusNotFound},
+		"server-error": {func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}, http.StatusBadGateway},
+		"content-length": {func(w http.ResponseWriter, r *http.Request) {
+			w.Write(content[:5])
+		}, http.StatusBadGateway},
+		"dropped-connection": {func(w http.ResponseWriter, r *http.Request) {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		}, http.StatusServiceUnavailable},
+	}
+
+	for name, tc := range tests {
+		ts, s, dir, err := objectServerWithDownload(content, tc.handler)
+		require.NoError(t, err)
+
+		// the error is reported before any content is written
+		w := download(s, batchAction(t, s), "GET", nil)
+		assert.Equal(t, tc.code, w.Code, name)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"), name)
+		assert.Equal(t, tc.code == http.StatusServiceUnavailable, w.Header().Get("Retry-After") != "", name)
+
+		var resp ContentErrorResponse
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp), name)
+		assert.Equal(t, hex.EncodeToString(sum[:]), resp.OID, name)
+		assert.NotEmpty(t, resp.Message, name)
+
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUpstreamClientCertificate(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(BatchResponse{})
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	for _, withCert := range []bool{false, true} {
+		var options []Option
+		if withCert {
+			options = append(options, WithUpstreamClientCertificate(ts.TLS.Certificates[0]))
+		}
+
+		s, err := NewNoCache(log.NewNopLogger(), ts.URL, options...)
+		require.NoError(t, err)
+
+		transport := s.client.Transport.(*http.Transport)
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+		w := httptest.NewRecorder()
+		s.Handle().ServeHTTP(w, httptest.NewRequest("POST", "/objects/batch", nil))
+		if withCert {
+			assert.Equal(t, http.StatusOK, w.Code)
+		} else {
+			assert.Equal(t, http.StatusBadGateway, w.Code)
+		}
+	}
+}
+
+func TestMaxBatchBodySize(t *testing.T) {
+	ts, s, dir, err := server(WithMaxBatchBodySize(16))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	for body, code := range map[string]int{
+		"{}":                       http.StatusOK,
+		`{"operation":"download"}`: http.StatusRequestEntityTooLarge,
+		strings.Repeat(" ", 1024):  http.StatusRequestEntityTooLarge,
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/objects/batch", strings.NewReader(body))
+		s.Handle().ServeHTTP(w, req)
+		assert.Equal(t, code, w.Code, body)
+	}
+
+	// bodies without a content length are limited while being read
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/objects/batch", ioutil.NopCloser(strings.NewReader(strings.Repeat(" ", 1024))))
+	req.ContentLength = -1
+	s.Handle().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
+
+type readTracker struct {
+	r    io.Reader
+	read int32
+}
+
+func (rt *readTracker) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&rt.read, 1)
+	return rt.r.Read(p)
+}
+
+func TestExpectContinue(t *testing.T) {
+	content := []byte("upload content")
+
+	var reject int32
+	var received []byte
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/objects/batch":
+			json.NewEncoder(w).Encode(BatchResponse{
+				Objects: []*BatchObjectResponse{
+					{
+						OID:  "1111111",
+						Size: int64(len(content)),
+						Actions: map[string]*BatchObjectActionResponse{
+							"upload": {Href: ts.URL + "/upload/1111111"},
+						},
+					},
+				},
+			})
+
+		default:
+			// reject without reading the body
+			if atomic.LoadInt32(&reject) == 1 {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			received, _ = ioutil.ReadAll(r.Body)
+		}
+	}))
+	defer ts.Close()
+
+	s, err := NewNoCache(log.NewNopLogger(), ts.URL)
+	require.NoError(t, err)
+	cs := httptest.NewServer(s.Handle())
+	defer cs.Close()
+
+	w := httptest.NewRecorder()
+	s.Handle().ServeHTTP(w, httptest.NewRequest("POST", "/objects/batch", nil))
+	var br BatchResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&br))
+	upload := br.Objects[0].Actions["upload"]
+	href, err := url.Parse(upload.Href)
+	require.NoError(t, err)
+
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	put := func(path string) (int, bool) {
+		body := &readTracker{r: bytes.NewReader(content)}
+		req, err := http.NewRequest("PUT", cs.URL+path, body)
+		require.NoError(t, err)
+		req.ContentLength = int64(len(content))
+		req.Header.Set("Expect", "100-continue")
+		for key, val := range upload.Header {
+			req.Header.Set(key, val)
+		}
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		return resp.StatusCode, atomic.LoadInt32(&body.read) == 1
+	}
+
+	// uploads through the content endpoint, and passed through the proxy
+	for _, path := range []string{href.Path, "/passthrough"} {
+		// rejected uploads are never sent
+		atomic.StoreInt32(&reject, 1)
+		code, sent := put(path)
+		assert.Equal(t, http.StatusForbidden, code, path)
+		assert.False(t, sent, path)
+
+		atomic.StoreInt32(&reject, 0)
+		received = nil
+		code, sent = put(path)
+		assert.Equal(t, http.StatusOK, code, path)
+		assert.True(t, sent, path)
+		assert.Equal(t, content, received, path)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	content := []byte("shutdown content")
+
+	for _, finish := range []bool{true, false} {
+		requested := make(chan struct{})
+		release := make(chan struct{})
+		ts, s, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.(http.Flusher).Flush()
+			close(requested)
+			select {
+			case <-release:
+				w.Write(content)
+			case <-r.Context().Done():
+			}
+		})
+		require.NoError(t, err)
+
+		go download(s, batchAction(t, s), "GET", nil)
+		<-requested
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		if finish {
+			close(release)
+			// inflight fetches finish and are cached
+			require.NoError(t, s.Shutdown(ctx))
+			assert.Equal(t, 1, s.cache.IndexStats().Objects)
+		} else {
+			// fetches that can't finish in time are abandoned
+			require.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+			require.Eventually(t, func() bool {
+				files, err := ioutil.ReadDir(filepath.Join(dir, cache.DirTemp))
+				return err == nil && len(files) == 0
+			}, 5*time.Second, 10*time.Millisecond)
+			assert.Equal(t, 0, s.cache.IndexStats().Objects)
+		}
+		cancel()
+
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestKeyFunc(t *testing.T) {
+	content := []byte("namespaced content")
+
+	ts, s, dir, err := objectServer(content)
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	s.KeyFunc = func(oid string, r *http.Request) string {
+		return "repo-" + oid
+	}
+
+	action := batchAction(t, s)
+	w := download(s, action, "GET", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+
+	key := "repo-" + path.Base(action.Href)
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, cache.DirObjects, cache.DefaultFilenamer(key)))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestFailedFetchTTL(t *testing.T) {
+	var requests int32
+	ts, s, dir, err := objectServerWithDownload([]byte("missing content"), func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}, WithFailedFetchTTL(time.Hour))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	action := batchAction(t, s)
+	for i := 0; i < 3; i++ {
+		w := download(s, action, "GET", nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+
+	// retries are answered without fetching again
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestStripPrefix(t *testing.T) {
+	content := []byte("prefixed content")
+
+	ts, s, dir, err := objectServer(content, WithStripPrefix("/git-lfs-cache/"))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	s.Handle().ServeHTTP(w, httptest.NewRequest("POST", "/git-lfs-cache/objects/batch", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var br BatchResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&br))
+	require.Len(t, br.Objects, 1)
+	action := br.Objects[0].Actions["download"]
+	assert.Contains(t, action.Href, "/git-lfs-cache"+ContentCachePathPrefix)
+
+	w = download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+
+	// unprefixed requests aren't routed
+	w = httptest.NewRecorder()
+	s.Handle().ServeHTTP(w, httptest.NewRequest("POST", "/objects/batch", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestMissRedirect(t *testing.T) {
+	content := []byte("redirected content")
+
+	ts, s, dir, err := objectServer(content, WithMissRedirect())
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	action := batchAction(t, s)
+
+	w := download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, action.Header[OriginalHrefHeader], w.Header().Get("Location"))
+
+	// the object is fetched in the background, and then served from disk
+	require.Eventually(t, func() bool {
+		return s.cache.IndexStats().Objects == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	w = download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+}
+
+func TestMissRedirectUnderPressure(t *testing.T) {
+	content := []byte("redirected content")
+
+	tests := map[string]Option{
+		"over buffer budget":    WithServeBufferBudget(1),
+		"over soft fetch limit": WithSoftFetchLimit(1),
+	}
+
+	for name, option := range tests {
+		ts, s, dir, err := objectServer(content, WithMissRedirect(), option)
+		require.NoError(t, err)
+		atomic.StoreInt64(&s.fetching, 1)
+
+		// misses are redirected and fetched, rather than shed or proxied
+		action := batchAction(t, s)
+		w := download(s, action, "GET", nil)
+		assert.Equal(t, http.StatusFound, w.Code, name)
+		assert.Equal(t, action.Header[OriginalHrefHeader], w.Header().Get("Location"), name)
+
+		s.inflight.Wait()
+		assert.Equal(t, int64(0), atomic.LoadInt64(&s.buffered), name)
+		cr, source, err := s.cache.Lookup(s.KeyFunc(path.Base(action.Href), nil))
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, cache.SourceDisk, source, name)
+			cr.Close()
+		}
+
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUpstreamMirror(t *testing.T) {
+	content := []byte("mirrored content")
+
+	var mirrored string
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored = r.URL.Path
+		w.Write(content)
+	}))
+	defer mirror.Close()
+
+	mirrorURL, err := url.Parse(mirror.URL + "/mirror")
+	require.NoError(t, err)
+
+	ts, s, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, WithUpstreamMirror(mirrorURL))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	action := batchAction(t, s)
+	w := download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+	assert.Equal(t, "/mirror/download/"+path.Base(action.Href), mirrored)
+}
+
+func TestUpstreamMirrorCancelled(t *testing.T) {
+	content := []byte("mirrored content")
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer mirror.Close()
+
+	mirrorURL, err := url.Parse(mirror.URL)
+	require.NoError(t, err)
+
+	// the upstream stalls until the fetch times out
+	ts, _, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	var logs syncBuffer
+	s, err := New(log.NewLogfmtLogger(&logs), ts.URL, dir, WithUpstreamMirror(mirrorURL), WithFetchTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+
+	// a cancelled fetch fails, rather than falling back to the mirror
+	w := download(s, batchAction(t, s), "GET", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	s.inflight.Wait()
+	assert.Contains(t, logs.String(), "fetch exceeded timeout")
+	assert.NotContains(t, logs.String(), "fallback=")
+}
+
+func TestServeAbortsShortFetch(t *testing.T) {
+	content := []byte("0123456789")
+
+	ts, s, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content[:5])
+		w.(http.Flusher).Flush()
+
+		// drop the connection before the rest is sent
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	})
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	action := batchAction(t, s)
+	cs := httptest.NewServer(s.Handle())
+	defer cs.Close()
+
+	href, err := url.Parse(action.Href)
+	require.NoError(t, err)
+	req, err := http.NewRequest("GET", cs.URL+href.Path, nil)
+	require.NoError(t, err)
+	for key, val := range action.Header {
+		req.Header.Set(key, val)
+	}
+
+	// the client sees the response fail, rather than complete short
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	assert.Error(t, err)
+}
+
+func TestAudit(t *testing.T) {
+	content := []byte("audited content")
+
+	ts, _, dir, err := objectServer(content)
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	s, err := NewNoCache(log.NewNopLogger(), ts.URL, WithAudit(0))
+	require.NoError(t, err)
+	action := batchAction(t, s)
+
+	for i := 0; i < 3; i++ {
+		w := download(s, action, "GET", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, content, w.Body.Bytes())
+	}
+
+	// the object is projected once, with subsequent requests as hits
+	assert.Len(t, s.audit.objects, 1)
+	assert.Equal(t, int64(len(content)), s.audit.bytes)
+	assert.Equal(t, int64(3), s.audit.requests)
+	assert.Equal(t, int64(2), s.audit.hits)
+}
+
+func TestMinRewriteSize(t *testing.T) {
+	content := []byte("small content")
+
+	for size, rewritten := range map[int64]bool{
+		int64(len(content)):     true,
+		int64(len(content)) + 1: false,
+	} {
+		ts, s, dir, err := objectServer(content, WithMinRewriteSize(size))
+		require.NoError(t, err)
+
+		action := batchAction(t, s)
+		assert.Equal(t, rewritten, strings.Contains(action.Href, ContentCachePathPrefix), size)
+		assert.Equal(t, rewritten, action.Header[SignatureHeader] != "", size)
+
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFetchDeadline(t *testing.T) {
+	tests := map[string]Option{
+		"timeout":  WithFetchTimeout(50 * time.Millisecond),
+		"min rate": WithMinFetchRate(1, 50*time.Millisecond),
+	}
+
+	for name, option := range tests {
+		t.Run(name, func(t *testing.T) {
+			// the upstream stalls until the fetch is abandoned
+			ts, s, dir, err := objectServerWithDownload([]byte("stalled content"), func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			}, option)
+			defer os.RemoveAll(dir)
+			defer ts.Close()
+			require.NoError(t, err)
+
+			action := batchAction(t, s)
+
+			done := make(chan *httptest.ResponseRecorder)
+			go func() {
+				done <- download(s, action, "GET", nil)
+			}()
+
+			// aborted fetches are transient, the client should retry
+			select {
+			case w := <-done:
+				assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+				assert.Equal(t, "5", w.Header().Get("Retry-After"))
+			case <-time.After(5 * time.Second):
+				t.Fatal("fetch was not aborted")
+			}
+		})
+	}
+}
+
+func TestHungFetchExpires(t *testing.T) {
+	content := []byte("hung content")
+
+	// the first fetch hangs until it's cancelled
+	var attempts int32
+	cancelled := make(chan struct{})
+	ts, s, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			<-r.Context().Done()
+			close(cancelled)
+			return
+		}
+		w.Write(content)
+	}, WithFetchConcurrency(1), WithCacheOptions(cache.WithMaxInflightDuration(50*time.Millisecond)))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	action := batchAction(t, s)
+	go download(s, action, "GET", nil)
+
+	// once the inflight duration is exceeded, the fetch is cancelled rather
+	// than left holding its fetch slot
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hung fetch was not cancelled")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hung fetch did not finish")
+	}
+
+	w := download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+}
+
+func TestBackgroundScrub(t *testing.T) {
+	content := []byte("scrubbed content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	ts, s, dir, err := objectServer(content, WithBackgroundScrub(10*time.Millisecond, 1))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	action := batchAction(t, s)
+	w := download(s, action, "GET", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// corrupt the cached object, the scrub quarantines it
+	filename := filepath.Join(dir, cache.DirObjects, cache.DefaultFilenamer(oid))
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filename)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, ioutil.WriteFile(filename, []byte("bit rot"), 0600))
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, cache.DirQuarantine, oid))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// and the object is fetched again
+	w = download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+}
+
+func TestMaxQueuedRequests(t *testing.T) {
+	content := []byte("queued content")
+
+	release := make(chan struct{})
+	ts, s, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write(content)
+	}, WithMaxQueuedRequests(1))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	action := batchAction(t, s)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- download(s, action, "GET", nil)
+	}()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&s.queued) == 1
+	}, 5*time.Second, time.Millisecond)
+
+	// the queue is full, so further requests are shed
+	w := download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "close", w.Header().Get("Connection"))
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// whilst the queued request completes
+	close(release)
+	w = <-done
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+	assert.Equal(t, int64(0), atomic.LoadInt64(&s.queued))
+}
+
+func TestResumePartial(t *testing.T) {
+	content := []byte("0123456789")
+
+	for name, ignoreRange := range map[string]bool{"range": false, "ignored-range": true} {
+		t.Run(name, func(t *testing.T) {
+			var requests int32
+			var resumedRange string
+			ts, s, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&requests, 1) == 1 {
+					// drop the connection part way through the first fetch
+					w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+					w.Write(content[:4])
+					w.(http.Flusher).Flush()
+					if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+						conn.Close()
+					}
+					return
+				}
+
+				resumedRange = r.Header.Get("Range")
+				if ignoreRange {
+					w.Write(content)
+					return
+				}
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes 4-9/%d", len(content)))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(content[4:])
+			}, WithCacheOptions(cache.WithKeepPartial(time.Hour)))
+			defer os.RemoveAll(dir)
+			defer ts.Close()
+			require.NoError(t, err)
+
+			action := batchAction(t, s)
+			download(s, action, "GET", nil)
+
+			// the partial is kept once the failed fetch is done
+			sum := sha256.Sum256(content)
+			require.Eventually(t, func() bool {
+				_, ok := s.cache.Partial(hex.EncodeToString(sum[:]))
+				return ok
+			}, 5*time.Second, time.Millisecond)
+
+			w := download(s, action, "GET", nil)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, content, w.Body.Bytes())
+			assert.Equal(t, "bytes=4-", resumedRange)
+
+			// the resumed object passed verification and was cached
+			require.Eventually(t, func() bool {
+				_, err := os.Stat(filepath.Join(dir, cache.DirObjects, cache.DefaultFilenamer(hex.EncodeToString(sum[:]))))
+				return err == nil
+			}, 5*time.Second, time.Millisecond)
+		})
+	}
+}
+
+func TestResumeOversizedPartial(t *testing.T) {
+	content := []byte("0123456789")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	var resumedRange string
+	ts, _, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+		resumedRange = r.Header.Get("Range")
+		w.Write(content)
+	})
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	// a partial left by a previous run that's larger than the object
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, cache.DirTemp, cache.DirPartials), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, cache.DirTemp, cache.DirPartials, oid+".1"), []byte("stale data, longer than the object"), 0600))
+
+	s, err := New(log.NewNopLogger(), ts.URL, dir, WithCacheOptions(cache.WithKeepPartial(time.Hour)))
+	require.NoError(t, err)
+
+	w := download(s, batchAction(t, s), "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+	assert.Empty(t, resumedRange)
+
+	// the object is fetched from the start, rather than after the stale data
+	s.inflight.Wait()
+	cached, err := ioutil.ReadFile(filepath.Join(dir, cache.DirObjects, cache.DefaultFilenamer(oid)))
+	require.NoError(t, err)
+	assert.Equal(t, content, cached)
+}
+
+func TestLockPassthrough(t *testing.T) {
+	type request struct {
+		method, path, query, body string
+	}
+
+	var received request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = request{r.Method, r.URL.Path, r.URL.RawQuery, string(body)}
+
+		// respond with the request body, formatting included, so that any
+		// re-encoding by the proxy is detected
+		w.Header().Set("Content-Type", "application/vnd.git-lfs+json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{ "echo" :` + strconv.Quote(string(body)) + ` }`))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// locks are scoped to the repository the upstream URL points at
+	s, err := New(log.NewNopLogger(), ts.URL+"/org/repo.git/info/lfs", dir)
+	require.NoError(t, err)
+
+	tests := []request{
+		{"POST", "/locks", "", `{"path":"foo/bar.zip","ref":{"name":"refs/heads/main"}}`},
+		{"GET", "/locks", "path=foo%2Fbar.zip&refspec=refs%2Fheads%2Fmain&cursor=abc&limit=10", ""},
+		{"POST", "/locks/verify", "", `{"ref": {"name": "refs/heads/main"}, "limit": 100}`},
+		{"POST", "/locks/some-id/unlock", "", `{"force":true,"ref":{"name":"refs/heads/main"}}`},
+	}
+
+	for _, tc := range tests {
+		target := tc.path
+		if tc.query != "" {
+			target += "?" + tc.query
+		}
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(tc.method, target, strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+		s.Handle().ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code, tc.path)
+		assert.Equal(t, request{tc.method, "/org/repo.git/info/lfs" + tc.path, tc.query, tc.body}, received, tc.path)
+		assert.Equal(t, `{ "echo" :`+strconv.Quote(tc.body)+` }`, w.Body.String(), tc.path)
+		assert.Equal(t, "application/vnd.git-lfs+json", w.Header().Get("Content-Type"), tc.path)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	content := []byte("warmed content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	var requests int32
+	var authorization string
+	ts, s, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		authorization = r.Header.Get("Authorization")
+		w.Write(content)
+	})
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	href := ts.URL + "/download/" + oid
+	header := http.Header{"Authorization": {"Bearer token"}}
+
+	// the object is cached by the time Fetch returns
+	require.NoError(t, s.Fetch(context.Background(), oid, href, int64(len(content)), header))
+	assert.Equal(t, "Bearer token", authorization)
+	assert.FileExists(t, filepath.Join(dir, cache.DirObjects, cache.DefaultFilenamer(oid)))
+
+	// and isn't fetched again
+	require.NoError(t, s.Fetch(context.Background(), oid, href, int64(len(content)), header))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	w := download(s, batchAction(t, s), "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+
+	// failures are returned
+	err = s.Fetch(context.Background(), "missing", ts.URL+"/download/missing", 1, nil)
+	assert.Equal(t, upstreamStatusError{http.StatusNotFound}, err)
+}
+
+func TestServeHeaders(t *testing.T) {
+	content := []byte("immutable content")
+
+	ts, s, dir, err := objectServer(content, WithServeHeaders(http.Header{
+		"Cache-Control": {"public, max-age=31536000"},
+	}))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	action := batchAction(t, s)
+
+	w := download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "public, max-age=31536000", w.Header().Get("Cache-Control"))
+
+	// errors mustn't be cached
+	w = download(s, action, "GET", http.Header{SignatureHeader: {"00"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, w.Header().Get("Cache-Control"))
+}
+
+func TestUpstreamPathSeparator(t *testing.T) {
+	var requested string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.RequestURI()
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		upstream string
+		options  []Option
+		requests map[string]string
+	}{
+		{"/depot.git/info/lfs", nil, map[string]string{
+			"/":              "/depot.git/info/lfs/",
+			"/objects/batch": "/depot.git/info/lfs/objects/batch",
+			"/locks?cursor=": "/depot.git/info/lfs/locks?cursor=",
+		}},
+		{"/depot.git/info/lfs", []Option{WithoutUpstreamPathSeparator()}, map[string]string{
+			"/":              "/depot.git/info/lfs",
+			"/objects/batch": "/depot.git/info/lfs/objects/batch",
+			"/locks?cursor=": "/depot.git/info/lfs/locks?cursor=",
+		}},
+		{"/depot/", []Option{WithoutUpstreamPathSeparator()}, map[string]string{
+			"/":              "/depot/",
+			"/objects/batch": "/depot/objects/batch",
+		}},
+		{"", []Option{WithoutUpstreamPathSeparator()}, map[string]string{
+			"/objects/batch": "/objects/batch",
+		}},
+	}
+
+	for _, tc := range tests {
+		s, err := NewNoCache(log.NewNopLogger(), ts.URL+tc.upstream, tc.options...)
+		require.NoError(t, err)
+
+		for path, expected := range tc.requests {
+			s.Handle().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", path, nil))
+			assert.Equal(t, expected, requested, tc.upstream+path)
+		}
+	}
+}
+
+func TestHostOnlyUpstream(t *testing.T) {
+	content := []byte("project content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/depot.git/info/lfs/objects/batch":
+			json.NewEncoder(w).Encode(BatchResponse{
+				Objects: []*BatchObjectResponse{{
+					OID:     oid,
+					Size:    int64(len(content)),
+					Actions: map[string]*BatchObjectActionResponse{"download": {Href: ts.URL + "/download/" + oid}},
+				}},
+			})
+		case "/depot.git/info/lfs/objects/" + oid:
+			json.NewEncoder(w).Encode(LegacyObjectResponse{
+				OID:   oid,
+				Size:  int64(len(content)),
+				Links: map[string]*BatchObjectActionResponse{"download": {Href: ts.URL + "/download/" + oid}},
+			})
+		case "/download/" + oid:
+			w.Write(content)
+		default:
+			w.Write([]byte("upstream " + r.URL.Path))
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the upstream's path is ignored
+	s, err := New(log.NewNopLogger(), ts.URL+"/ignored", dir, WithHostOnlyUpstream())
+	require.NoError(t, err)
+
+	// batch downloads of a project are routed through the cache
+	w := httptest.NewRecorder()
+	s.Handle().ServeHTTP(w, httptest.NewRequest("POST", "/depot.git/info/lfs/objects/batch", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var br BatchResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&br))
+	require.Len(t, br.Objects, 1)
+	action := br.Objects[0].Actions["download"]
+	assert.Contains(t, action.Href, ContentCachePathPrefix+oid)
+
+	w = download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+
+	// as are legacy downloads
+	w = httptest.NewRecorder()
+	s.Handle().ServeHTTP(w, httptest.NewRequest("GET", "/depot.git/info/lfs/objects/"+oid, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var or LegacyObjectResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&or))
+	assert.Contains(t, or.Links["download"].Href, ContentCachePathPrefix+oid)
+
+	// and other requests keep their full path
+	w = httptest.NewRecorder()
+	s.Handle().ServeHTTP(w, httptest.NewRequest("POST", "/depot.git/info/lfs/locks/verify", nil))
+	assert.Equal(t, "upstream /depot.git/info/lfs/locks/verify", w.Body.String())
+}
+
+func TestMaxBatchBufferSize(t *testing.T) {
+	const count = 2000
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		br := BatchResponse{Transfer: "basic"}
+		for i := 0; i < count; i++ {
+			oid := fmt.Sprintf("%064x", i)
+			br.Objects = append(br.Objects, &BatchObjectResponse{
+				OID:     oid,
+				Size:    int64(i),
+				Actions: map[string]*BatchObjectActionResponse{"download": {Href: "https://example.com/" + oid}},
+			})
+		}
+
+		gz := gzip.NewWriter(w)
+		w.Header().Set("Content-Encoding", "gzip")
+		json.NewEncoder(gz).Encode(br)
+		gz.Close()
+	}))
+	defer ts.Close()
+
+	for _, size := range []int64{0, 1024} {
+		dir, err := ioutil.TempDir("", "")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		s, err := New(log.NewNopLogger(), ts.URL, dir, WithMaxBatchBufferSize(size))
+		require.NoError(t, err)
+
+		cs := httptest.NewServer(s.Handle())
+		defer cs.Close()
+
+		req, err := http.NewRequest("POST", cs.URL+"/objects/batch", nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		// large responses are streamed, without a content length
+		assert.Equal(t, size == 0, resp.ContentLength > 0, size)
+
+		gz, err := gzip.NewReader(resp.Body)
+		require.NoError(t, err)
+
+		var br BatchResponse
+		require.NoError(t, json.NewDecoder(gz).Decode(&br))
+		require.Len(t, br.Objects, count)
+		for _, object := range br.Objects {
+			assert.Contains(t, object.Actions["download"].Href, ContentCachePathPrefix+object.OID)
+		}
+	}
+}
+
+func TestStreamBatch(t *testing.T) {
+	tests := map[string]struct {
+		body      string
+		status    int
+		rewritten bool
+	}{
+		"basic": {
+			body:      `{"transfer":"basic","objects":[{"oid":"%[1]s","size":8,"actions":{"download":{"href":"%[2]s"}}}],"hash_algo":"sha256"}`,
+			status:    http.StatusOK,
+			rewritten: true,
+		},
+		"transfer omitted": {
+			body:      `{"objects":[{"oid":"%[1]s","size":8,"actions":{"download":{"href":"%[2]s"}}}]}`,
+			status:    http.StatusOK,
+			rewritten: true,
+		},
+		"non-basic transfer": {
+			body:   `{"transfer":"custom","objects":[{"oid":"%[1]s","size":8,"actions":{"download":{"href":"%[2]s"}}}]}`,
+			status: http.StatusOK,
+		},
+		"non-basic transfer after objects": {
+			body:   `{"objects":[{"oid":"%[1]s","size":8,"actions":{"download":{"href":"%[2]s"}}}],"transfer":"custom"}`,
+			status: http.StatusBadGateway,
+		},
+		"malformed": {
+			body:   `{"objects":[{"oid":"%[1]s"`,
+			status: http.StatusBadGateway,
+		},
+	}
+
+	const oid = "0000000000000000000000000000000000000000000000000000000000000000"
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, tc.body, oid, "https://example.com/"+oid)
+			}))
+			defer ts.Close()
+
+			dir, err := ioutil.TempDir("", "")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			s, err := New(log.NewNopLogger(), ts.URL, dir)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			s.Handle().ServeHTTP(w, httptest.NewRequest("POST", ts.URL+"/objects/batch", nil))
+			require.Equal(t, tc.status, w.Code)
+			if tc.status != http.StatusOK {
+				return
+			}
+
+			var br map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &br))
+
+			// fields other than objects are passed through unmodified
+			if strings.Contains(tc.body, "hash_algo") {
+				assert.Equal(t, "sha256", br["hash_algo"])
+			}
+
+			href := br["objects"].([]interface{})[0].(map[string]interface{})["actions"].(map[string]interface{})["download"].(map[string]interface{})["href"]
+			assert.Equal(t, tc.rewritten, strings.Contains(href.(string), ContentCachePathPrefix+oid), href)
+		})
+	}
+}
+
+func TestHMACHash(t *testing.T) {
+	key := []byte("shared")
+
+	ts, s, dir, err := server(WithHMACKey(key), WithHMACHash(sha512.New))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	action := batchAction(t, s)
+	assert.Len(t, action.Header[SignatureHeader], sha512.Size*2)
+
+	w := download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// an instance sharing the key, but not the hash, rejects the signature
+	other, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(other)
+
+	s, err = New(log.NewNopLogger(), ts.URL, other, WithHMACKey(key))
+	require.NoError(t, err)
+
+	w = download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestSourceHeader(t *testing.T) {
+	content := []byte("source header")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	ts, s, dir, err := objectServer(content, WithSourceHeader())
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	action := batchAction(t, s)
+
+	w := download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, string(cache.SourceFresh), w.Header().Get(SourceHeader))
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, cache.DirObjects, cache.DefaultFilenamer(oid)))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	w = download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, string(cache.SourceDisk), w.Header().Get(SourceHeader))
+
+	// the header is only set when enabled
+	ts, s, dir, err = server()
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	w = download(s, batchAction(t, s), "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(SourceHeader))
+}
+
+func TestRewriteExpiryMargin(t *testing.T) {
+	tests := map[string]struct {
+		action    BatchObjectActionResponse
+		rewritten bool
+	}{
+		"no expiry":              {BatchObjectActionResponse{}, true},
+		"expires in later":       {BatchObjectActionResponse{ExpiresIn: 3600}, true},
+		"expires in soon":        {BatchObjectActionResponse{ExpiresIn: 30}, false},
+		"expires at later":       {BatchObjectActionResponse{ExpiresAt: time.Now().Add(time.Hour)}, true},
+		"expires at soon":        {BatchObjectActionResponse{ExpiresAt: time.Now().Add(30 * time.Second)}, false},
+		"expires at in the past": {BatchObjectActionResponse{ExpiresAt: time.Now().Add(-time.Hour)}, false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				action := tc.action
+				action.Href = "https://example.com/object"
+
+				json.NewEncoder(w).Encode(BatchResponse{
+					Objects: []*BatchObjectResponse{
+						{OID: "oid", Size: 1, Actions: map[string]*BatchObjectActionResponse{"download": &action}},
+					},
+				})
+			}))
+			defer ts.Close()
+
+			dir, err := ioutil.TempDir("", "")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			s, err := New(log.NewNopLogger(), ts.URL, dir, WithRewriteExpiryMargin(time.Minute))
+			require.NoError(t, err)
+
+			action := batchAction(t, s)
+			assert.Equal(t, tc.rewritten, strings.Contains(action.Href, ContentCachePathPrefix))
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	const origin = "https://tool.example.com"
+
+	ts, s, dir, err := server(WithCORS([]string{" https://other.example.com", origin}, time.Minute))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	// preflight requests are answered for the cache's endpoints
+	for _, path := range []string{"/objects/batch", ContentCachePathPrefix + "oid"} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("OPTIONS", path, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "authorization, x-lfs-signature")
+		s.Handle().ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code, path)
+		assert.Equal(t, origin, w.Header().Get("Access-Control-Allow-Origin"), path)
+		assert.Equal(t, "authorization, x-lfs-signature", w.Header().Get("Access-Control-Allow-Headers"), path)
+		assert.Equal(t, "60", w.Header().Get("Access-Control-Max-Age"), path)
+	}
+
+	// actual responses carry the headers, successful or not
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/objects/batch", nil)
+	req.Header.Set("Origin", origin)
+	s.Handle().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, origin, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, w.Header().Get("Access-Control-Expose-Headers"), "Content-Range")
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", ContentCachePathPrefix+"oid", nil)
+	req.Header.Set("Origin", origin)
+	s.Handle().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, origin, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// other origins and the blind upstream proxy don't
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/objects/batch", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	s.Handle().ServeHTTP(w, req)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/anything", nil)
+	req.Header.Set("Origin", origin)
+	s.Handle().ServeHTTP(w, req)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestWithoutPassthrough(t *testing.T) {
+	ts, s, dir, err := objectServer([]byte("passthrough"), WithoutPassthrough(), WithInfoPage())
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	// the cache's endpoints still work
+	action := batchAction(t, s)
+	w := download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "passthrough", w.Body.String())
+
+	w = httptest.NewRecorder()
+	s.Handle().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// everything else isn't proxied, the upstream's 404s have no body
+	for _, tc := range []struct{ method, path string }{
+		{"POST", "/locks"},
+		{"GET", "/anything"},
+		{"POST", "/objects/"},
+	} {
+		w := httptest.NewRecorder()
+		s.Handle().ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		assert.Equal(t, http.StatusNotFound, w.Code, tc.path)
+		assert.Equal(t, "404 page not found\n", w.Body.String(), tc.path)
+	}
+}
+
+func TestLogBatch(t *testing.T) {
+	var received string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = string(body)
+		json.NewEncoder(w).Encode(BatchResponse{})
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var logs syncBuffer
+	s, err := New(log.NewLogfmtLogger(&logs), ts.URL+"/org/repo.git/info/lfs", dir)
+	require.NoError(t, err)
+
+	body := `{"operation":"download","objects":[{"oid":"a","size":1},{"oid":"b","size":2}],"ref":{"name":"refs/heads/main"}}`
+	req := httptest.NewRequest("POST", "/objects/batch", strings.NewReader(body))
+	req.Header.Set("User-Agent", "git-lfs/3.4.0 (GitHub; linux amd64; go 1.21.0)")
+	s.Handle().ServeHTTP(httptest.NewRecorder(), req)
+
+	// the body is still proxied in full
+	assert.Equal(t, body, received)
+	assert.Contains(t, logs.String(), "event=batch operation=download objects=2 ref=refs/heads/main client=3.4.0 repo=org/repo.git")
+
+	// a body too large to buffer is proxied in full, without its details
+	body = `{"operation":"download","objects":[],"padding":"` + strings.Repeat("a", batchLogMaxBodySize) + `"}`
+	req = httptest.NewRequest("POST", "/objects/batch", strings.NewReader(body))
+	s.Handle().ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, body, received)
+	assert.Contains(t, logs.String(), "event=batch operation= objects=0 repo=org/repo.git")
+}
+
+func TestClientVersion(t *testing.T) {
+	for userAgent, version := range map[string]string{
+		"git-lfs/3.4.0 (GitHub; linux amd64; go 1.21.0)": "3.4.0",
+		"git-lfs/2.13.3": "2.13.3",
+		"curl/7.68.0":    "",
+		"":               "",
+	} {
+		assert.Equal(t, version, clientVersion(userAgent), userAgent)
+	}
+}
+
+func TestSoftFetchLimit(t *testing.T) {
+	content := []byte("soft fetch limit")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	ts, s, dir, err := objectServer(content, WithSoftFetchLimit(1), WithSourceHeader())
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	action := batchAction(t, s)
+	filename := filepath.Join(dir, cache.DirObjects, cache.DefaultFilenamer(oid))
+
+	// at the limit, misses are proxied without being cached
+	atomic.StoreInt64(&s.fetching, 1)
+	w := download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+	assert.Empty(t, w.Header().Get(SourceHeader))
+	s.inflight.Wait()
+	_, err = os.Stat(filename)
+	assert.True(t, os.IsNotExist(err))
+
+	// below it, they're cached again
+	atomic.StoreInt64(&s.fetching, 0)
+	w = download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, string(cache.SourceFresh), w.Header().Get(SourceHeader))
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filename)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	s.inflight.Wait()
+
+	// and cache hits are served from the cache regardless
+	atomic.StoreInt64(&s.fetching, 1)
+	w = download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, string(cache.SourceDisk), w.Header().Get(SourceHeader))
+}
+
+func TestSignHeaders(t *testing.T) {
+	key := []byte("shared")
+	content := []byte("minted content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	ts, s, dir, err := objectServer(content, WithHMACKey(key))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	// a content request minted without a batch request
+	href, size := ts.URL+"/download/"+oid, strconv.Itoa(len(content))
+	action := &BatchObjectActionResponse{
+		Href: ContentCachePathPrefix + oid,
+		Header: map[string]string{
+			UpstreamHeaderList: "",
+			OriginalHrefHeader: href,
+			SizeHeader:         size,
+			SignatureHeader:    SignHeaders(key, "", href, size),
+		},
+	}
+
+	w := download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+
+	// which matches the signature of the batch endpoint's rewritten action
+	batch := batchAction(t, s)
+	assert.Equal(t, batch.Header[SignatureHeader], SignHeaders(key, batch.Header[UpstreamHeaderList], batch.Header[OriginalHrefHeader], batch.Header[SizeHeader]))
+}
+
+func TestServedTiming(t *testing.T) {
+	ts, _, dir, err := objectServer([]byte("served timing"))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	var logs syncBuffer
+	s, err := New(log.NewLogfmtLogger(&logs), ts.URL, dir)
+	require.NoError(t, err)
+
+	w := download(s, batchAction(t, s), "GET", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	s.inflight.Wait()
+
+	served := ""
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "event=served") {
+			served = line
+		}
+	}
+	for _, field := range []string{"took=", "wait=", "ttfb=", "stream="} {
+		assert.Contains(t, served, field)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that's safe to write to from the server's
+// goroutines while a test reads it.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buf.String()
+}
+
+func TestBatchObjectShape(t *testing.T) {
+	var object BatchObjectResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"oid":"1111111","size":1,"error":{"code":404,"message":"Object does not exist"}}`), &object))
+
+	buf, err := json.Marshal(&object)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"oid":"1111111","size":1,"error":{"code":404,"message":"Object does not exist"}}`, string(buf))
+
+	buf, err = json.Marshal(&BatchObjectActionResponse{Href: "https://example.com"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"href":"https://example.com"}`, string(buf))
+
+	expiresAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	buf, err = json.Marshal(&BatchObjectActionResponse{Href: "https://example.com", ExpiresAt: expiresAt})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"href":"https://example.com","expires_at":"2020-01-02T03:04:05Z"}`, string(buf))
+}
+
+func TestVerbatimBatchObjects(t *testing.T) {
+	const (
+		missing  = `{"oid":"1111111", "size":1, "error":{"code":404, "message":"Object does not exist"}}`
+		download = `{"oid":"2222222","x-extra":true,"size":8,"actions":{"upload":{ "href":"https://example.com/upload" },"download":{"href":"https://example.com/download"}}}`
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"transfer":"basic","objects":[%s,%s]}`, missing, download)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(log.NewNopLogger(), ts.URL, dir, WithVerbatimBatchObjects())
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	s.Handle().ServeHTTP(w, httptest.NewRequest("POST", ts.URL+"/objects/batch", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// the object that isn't rewritten is copied byte for byte
+	body := w.Body.String()
+	assert.Contains(t, body, missing)
+
+	// the rewritten object keeps its field order, unknown fields and the
+	// actions that aren't rewritten
+	assert.Regexp(t, `\{"oid":"2222222","x-extra":true,"size":8,"actions":\{"upload":\{ "href":"https://example.com/upload" \},"download":\{"href":"http://[^/]+/_lfs_cache/2222222","header":\{`, body)
+
+	var br BatchResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &br))
+	require.Len(t, br.Objects, 2)
+	assert.Equal(t, 404, br.Objects[0].Error.Code)
+}
+
+func TestDiskSizeMismatch(t *testing.T) {
+	content := []byte("disk size mismatch")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	ts, s, dir, err := objectServer(content, WithSourceHeader())
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	action := batchAction(t, s)
+
+	w := download(s, action, "GET", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	filename := filepath.Join(dir, cache.DirObjects, cache.DefaultFilenamer(oid))
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filename)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	s.inflight.Wait()
+
+	// the truncated object is quarantined and fetched again
+	require.NoError(t, os.Truncate(filename, 4))
+
+	w = download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, string(cache.SourceFresh), w.Header().Get(SourceHeader))
+	assert.Equal(t, content, w.Body.Bytes())
+
+	quarantined, err := ioutil.ReadFile(filepath.Join(dir, cache.DirQuarantine, oid))
+	require.NoError(t, err)
+	assert.Equal(t, content[:4], quarantined)
+}
+
+func TestStripHeaders(t *testing.T) {
+	content := []byte("strip headers")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	var batchHeader, fetchHeader http.Header
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/objects/batch":
+			batchHeader = r.Header.Clone()
+			w.Header().Set("X-Internal", "secret")
+			w.Header().Set("X-Public", "public")
+			json.NewEncoder(w).Encode(BatchResponse{
+				Objects: []*BatchObjectResponse{{
+					OID:     oid,
+					Size:    int64(len(content)),
+					Actions: map[string]*BatchObjectActionResponse{"download": {Href: ts.URL + "/download/" + oid}},
+				}},
+			})
+
+		default:
+			fetchHeader = r.Header.Clone()
+			w.Write(content)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(log.NewNopLogger(), ts.URL, dir,
+		WithForwardHeaders("X-Route"),
+		WithStripRequestHeaders("cookie", " x-route"),
+		WithStripResponseHeaders("X-Internal"),
+	)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/objects/batch", nil)
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-Route", "internal")
+	req.Header.Set("Accept", "application/vnd.git-lfs+json")
+	s.Handle().ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Empty(t, batchHeader.Get("Cookie"))
+	assert.Empty(t, batchHeader.Get("X-Route"))
+	assert.Equal(t, "application/vnd.git-lfs+json", batchHeader.Get("Accept"))
+	assert.Empty(t, w.Header().Get("X-Internal"))
+	assert.Equal(t, "public", w.Header().Get("X-Public"))
+
+	var br BatchResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&br))
+	require.Len(t, br.Objects, 1)
+
+	// the forwarded header is captured, but stripped from the fetch
+	w = download(s, br.Objects[0].Actions["download"], "GET", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	s.inflight.Wait()
+	assert.Empty(t, fetchHeader.Get("X-Route"))
+}
+
+func TestFetchMetadata(t *testing.T) {
+	content := []byte("metadata")
+	ts, s, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(content)
+	})
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	w := download(s, batchAction(t, s), "GET", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	s.inflight.Wait()
+
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	md, err := s.cache.Metadata(oid)
+	require.NoError(t, err)
+	assert.Equal(t, ts.URL+"/download/"+oid, md.Upstream)
+	assert.Equal(t, `"v1"`, md.ETag)
+	assert.Equal(t, int64(len(content)), md.Size)
+	assert.False(t, md.FetchedAt.IsZero())
+}
+
+func TestServeHead(t *testing.T) {
+	content := []byte("head request")
+	var downloads int32
+	ts, s, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		w.Write(content)
+	}, WithSourceHeader())
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+	action := batchAction(t, s)
+
+	// a miss is answered from the signed size, without fetching the object
+	w := download(s, action, "HEAD", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, strconv.Itoa(len(content)), w.Header().Get("Content-Length"))
+	assert.Equal(t, `"`+oid+`"`, w.Header().Get("ETag"))
+	assert.Empty(t, w.Header().Get(SourceHeader))
+	assert.Empty(t, w.Body.Bytes())
+	s.inflight.Wait()
+	assert.Equal(t, int32(0), atomic.LoadInt32(&downloads))
+	assert.Equal(t, 0, s.cache.IndexStats().Objects)
+
+	w = download(s, action, "GET", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"`+oid+`"`, w.Header().Get("ETag"))
+	s.inflight.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&downloads))
+
+	// a hit is answered without reading the object
+	w = download(s, action, "HEAD", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, strconv.Itoa(len(content)), w.Header().Get("Content-Length"))
+	assert.Equal(t, `"`+oid+`"`, w.Header().Get("ETag"))
+	assert.Equal(t, string(cache.SourceDisk), w.Header().Get(SourceHeader))
+	assert.Empty(t, w.Body.Bytes())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&downloads))
+}
+
+// shortWriter writes at most max bytes per call, returning err once it has
+// written limit bytes.
+type shortWriter struct {
+	buf   bytes.Buffer
+	max   int
+	limit int
+	err   error
+}
+
+func (sw *shortWriter) Write(p []byte) (int, error) {
+	if sw.err != nil && sw.buf.Len() >= sw.limit {
+		return 0, sw.err
+	}
+	if len(p) > sw.max {
+		p = p[:sw.max]
+	}
+	return sw.buf.Write(p)
+}
+
+func TestHashCountWriterShortWrites(t *testing.T) {
+	content := []byte("the quick brown fox jumps over the lazy dog")
+	sum := sha256.Sum256(content)
+
+	// retrying the rest after each short write hashes the full content once
+	sw := &shortWriter{max: 5}
+	hcw := &hashCountWriter{w: sw, h: sha256.New()}
+	for p := content; len(p) > 0; {
+		n, err := hcw.Write(p)
+		if n < len(p) {
+			require.Equal(t, io.ErrShortWrite, err)
+		}
+		p = p[n:]
+	}
+	assert.Equal(t, content, sw.buf.Bytes())
+	assert.Equal(t, len(content), hcw.n)
+	assert.Equal(t, int64(len(content)), atomic.LoadInt64(&hcw.progress))
+	assert.Equal(t, sum[:], hcw.h.Sum(nil))
+
+	// io.Copy stops at a short write, the hash and count cover only what was
+	// written
+	sw = &shortWriter{max: 5}
+	hcw = &hashCountWriter{w: sw, h: sha256.New()}
+	_, err := io.Copy(hcw, bytes.NewReader(content))
+	assert.Equal(t, io.ErrShortWrite, err)
+	written := sha256.Sum256(sw.buf.Bytes())
+	assert.Equal(t, sw.buf.Len(), hcw.n)
+	assert.Equal(t, written[:], hcw.h.Sum(nil))
+
+	// a short write followed by an error leaves the hash and count matching
+	// the bytes written
+	sw = &shortWriter{max: 5, limit: 10, err: fmt.Errorf("disk full")}
+	hcw = &hashCountWriter{w: sw, h: sha256.New()}
+	for p := content; len(p) > 0; {
+		n, err := hcw.Write(p)
+		p = p[n:]
+		if err != nil && err != io.ErrShortWrite {
+			assert.EqualError(t, err, "disk full")
+			break
+		}
+	}
+	written = sha256.Sum256(content[:10])
+	assert.Equal(t, content[:10], sw.buf.Bytes())
+	assert.Equal(t, 10, hcw.n)
+	assert.Equal(t, written[:], hcw.h.Sum(nil))
+}
+
+func TestFlushInflight(t *testing.T) {
+	content := make([]byte, 1<<20)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	for _, flush := range []bool{false, true} {
+		release := make(chan struct{})
+		var options []Option
+		if flush {
+			options = append(options, WithFlushInflight())
+		}
+		ts, s, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content[:100])
+			w.(http.Flusher).Flush()
+			<-release
+			w.Write(content[100:])
+		}, options...)
+		require.NoError(t, err)
+
+		action := batchAction(t, s)
+		cs := httptest.NewServer(s.Handle())
+
+		href, err := url.Parse(action.Href)
+		require.NoError(t, err)
+		req, err := http.NewRequest("GET", cs.URL+href.Path, nil)
+		require.NoError(t, err)
+		for key, val := range action.Header {
+			req.Header.Set(key, val)
+		}
+
+		// the first bytes fetched only reach the client before the rest of
+		// the object when flushing, without it even the headers are held
+		// back in the response buffer
+		var resp *http.Response
+		first := make(chan []byte, 1)
+		go func() {
+			p := make([]byte, 100)
+			if resp, err = http.DefaultClient.Do(req); err == nil {
+				io.ReadFull(resp.Body, p)
+			}
+			first <- p
+		}()
+		select {
+		case p := <-first:
+			assert.True(t, flush, "first bytes served without flushing")
+			assert.Equal(t, content[:100], p)
+		case <-time.After(200 * time.Millisecond):
+			assert.False(t, flush, "first bytes not flushed")
+		}
+
+		close(release)
+		if !flush {
+			assert.Equal(t, content[:100], <-first)
+		}
+		require.NoError(t, err)
+		rest, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, content[100:], rest)
+		resp.Body.Close()
+
+		s.inflight.Wait()
+		cs.Close()
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestServeBufferBudget(t *testing.T) {
+	content := []byte("buffer budget")
+
+	release := make(chan struct{})
+	ts, s, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write(content)
+	}, WithServeBufferBudget(serveBufferSize), WithSourceHeader())
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	action := batchAction(t, s)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- download(s, action, "GET", nil)
+	}()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&s.buffered) == serveBufferSize
+	}, 5*time.Second, time.Millisecond)
+
+	// inflight objects are still served over the budget
+	inflight := make(chan *httptest.ResponseRecorder)
+	go func() {
+		inflight <- download(s, action, "GET", nil)
+	}()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&s.buffered) == 2*serveBufferSize
+	}, 5*time.Second, time.Millisecond)
+
+	// whilst objects that aren't cached are shed
+	other := *action
+	other.Href = strings.Replace(action.Href, path.Base(action.Href), strings.Repeat("0", 64), 1)
+	w := download(s, &other, "GET", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "close", w.Header().Get("Connection"))
+	assert.Contains(t, w.Body.String(), "server overloaded")
+
+	close(release)
+	for _, c := range []chan *httptest.ResponseRecorder{done, inflight} {
+		w = <-c
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, content, w.Body.Bytes())
+	}
+	assert.Equal(t, int64(0), atomic.LoadInt64(&s.buffered))
+
+	// objects on disk don't count towards the budget
+	s.inflight.Wait()
+	w = download(s, action, "GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, string(cache.SourceDisk), w.Header().Get(SourceHeader))
+}
+
+func TestMultipleHostnames(t *testing.T) {
+	content := []byte("multiple hostnames")
+
+	batch := func(s *Server, host string) *BatchObjectActionResponse {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/objects/batch", nil)
+		req.Host = host
+		s.Handle().ServeHTTP(w, req)
+
+		var br BatchResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&br))
+		require.Len(t, br.Objects, 1)
+		require.Contains(t, br.Objects[0].Actions, "download")
+
+		return br.Objects[0].Actions["download"]
+	}
+
+	public, err := url.Parse("https://cache.example.com")
+	require.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		options []Option
+		scheme  string
+		host    string
+	}{
+		"request-host":   {nil, "http", "internal.example.com"},
+		"canonical-host": {[]Option{WithCanonicalHost("cache.example.com:8080")}, "http", "cache.example.com:8080"},
+		"public-url":     {[]Option{WithPublicURL(public)}, "https", "cache.example.com"},
+		"public-url-precedence": {
+			[]Option{WithCanonicalHost("other.example.com"), WithPublicURL(public)}, "https", "cache.example.com",
+		},
+	} {
+		ts, s, dir, err := objectServer(content, tc.options...)
+		require.NoError(t, err)
+
+		action := batch(s, "internal.example.com")
+		href, err := url.Parse(action.Href)
+		require.NoError(t, err)
+		assert.Equal(t, tc.scheme, href.Scheme, name)
+		assert.Equal(t, tc.host, href.Host, name)
+
+		// an href rewritten under one hostname is served under any other
+		for _, host := range []string{"internal.example.com", "legacy.example.com"} {
+			href.Host = host
+			w := download(s, &BatchObjectActionResponse{Href: href.String(), Header: action.Header}, "GET", nil)
+			assert.Equal(t, http.StatusOK, w.Code, name)
+			assert.Equal(t, content, w.Body.Bytes(), name)
+		}
+
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestChecksumRetries(t *testing.T) {
+	content := []byte("0123456789")
+	corrupt := []byte("9876543210")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	tests := map[string]struct {
+		corrupt  int32
+		retries  int
+		cached   bool
+		attempts int32
+	}{
+		"disabled":  {1, 0, false, 1},
+		"recovered": {2, 2, true, 3},
+		"exhausted": {3, 1, false, 2},
+	}
+
+	for name, tc := range tests {
+		var attempts int32
+		ts, s, dir, err := objectServerWithDownload(content, func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&attempts, 1) <= tc.corrupt {
+				w.Write(corrupt)
+				return
+			}
+			w.Write(content)
+		}, WithChecksumRetries(tc.retries))
+		require.NoError(t, err)
+
+		// the client that triggered the fetch is either served the object
+		// once it's been refetched, or aborted short having read corrupt
+		// data, but never sent corrupt data in full or mixed with the refetch
+		body := download(s, batchAction(t, s), "GET", nil).Body.Bytes()
+		if !tc.cached || !bytes.Equal(content, body) {
+			assert.Less(t, len(body), len(content), name)
+			assert.True(t, bytes.HasPrefix(corrupt, body), name)
+		}
+		s.inflight.Wait()
+
+		assert.Equal(t, tc.attempts, atomic.LoadInt32(&attempts), name)
+		cached, err := ioutil.ReadFile(filepath.Join(dir, cache.DirObjects, cache.DefaultFilenamer(oid)))
+		if tc.cached {
+			assert.NoError(t, err, name)
+			assert.Equal(t, content, cached, name)
+		} else {
+			assert.True(t, os.IsNotExist(err), name)
+		}
+
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
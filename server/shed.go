@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// enqueue records a request waiting for its fetch to start, returning a func
+// to call once it has stopped waiting.
+func (s *Server) enqueue() func() {
+	atomic.AddInt64(&s.queued, 1)
+	metricQueuedRequests.Add(1)
+
+	return func() {
+		atomic.AddInt64(&s.queued, -1)
+		metricQueuedRequests.Add(-1)
+	}
+}
+
+// shed rejects a request if the number of requests waiting on fetches has
+// reached the limit, returning whether it did, so that clients reconnect
+// rather than piling more requests onto an overloaded instance. Requests
+// already being served are unaffected.
+func (s *Server) shed(w http.ResponseWriter, oid string) bool {
+	if s.maxQueued <= 0 || atomic.LoadInt64(&s.queued) < s.maxQueued {
+		return false
+	}
+
+	metricShedRequests.Add(1)
+	level.Error(s.logger).Log("event", "shedding", "oid", oid, "queued", atomic.LoadInt64(&s.queued))
+
+	overloaded(w, s.retryAfter, oid)
+	return true
+}
+
+// overloaded responds to a shed request. The connection is closed, so that
+// clients holding keep-alive connections reconnect, possibly to another
+// instance.
+func overloaded(w http.ResponseWriter, retryAfter time.Duration, oid string) {
+	w.Header().Set("Connection", "close")
+	setRetryAfter(w, retryAfter)
+	writeContentError(w, http.StatusServiceUnavailable, oid, "server overloaded")
+}
+
+// serveBufferSize is the estimated memory used to serve an object that isn't
+// on disk, the size of the buffer http.ServeContent copies it with.
+const serveBufferSize = 32 << 10
+
+// reserveBuffer records the memory used serving an object that isn't on
+// disk, returning a func to call once it has been served.
+func (s *Server) reserveBuffer() func() {
+	atomic.AddInt64(&s.buffered, serveBufferSize)
+	metricServeBufferBytes.Add(serveBufferSize)
+
+	return func() {
+		atomic.AddInt64(&s.buffered, -serveBufferSize)
+		metricServeBufferBytes.Add(-serveBufferSize)
+	}
+}
+
+// overBufferBudget returns whether serving another object that isn't on disk
+// would exceed the buffer budget.
+func (s *Server) overBufferBudget() bool {
+	return s.bufferBudget > 0 && atomic.LoadInt64(&s.buffered)+serveBufferSize > s.bufferBudget
+}
+
+// shedBuffers rejects a request for an object that isn't cached, as serving
+// it would exceed the buffer budget. The budget bounds the memory used by
+// many simultaneous pulls of cold objects, each streamed through its own
+// buffer. Objects on disk and inflight are still served.
+func (s *Server) shedBuffers(w http.ResponseWriter, oid string) {
+	metricShedRequests.Add(1)
+	level.Error(s.logger).Log("event", "shedding", "oid", oid, "buffered", atomic.LoadInt64(&s.buffered))
+
+	overloaded(w, s.retryAfter, oid)
+}
+
+// overSoftFetchLimit returns whether the number of fetches inflight has
+// reached the soft fetch limit.
+func (s *Server) overSoftFetchLimit() bool {
+	return s.softFetchLimit > 0 && atomic.LoadInt64(&s.fetching) >= s.softFetchLimit
+}
+
+// bypass proxies a content request's object from the upstream without
+// caching it, so that the client isn't delayed whilst too many fetches are
+// inflight.
+func (s *Server) bypass(w http.ResponseWriter, r *http.Request, oid string) {
+	metricBypassedRequests.Add(1)
+	level.Info(s.logger).Log("event", "bypassing", "oid", oid, "fetching", atomic.LoadInt64(&s.fetching))
+
+	s.bypassProxy.ServeHTTP(w, r)
+}
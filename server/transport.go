@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// hostTransport routes requests to per host transports, falling back to a
+// default transport for other hosts.
+type hostTransport struct {
+	transport *http.Transport
+	hosts     map[string]*http.Transport
+}
+
+// newHostTransport returns a transport using clones of the default transport
+// with the response header timeouts of the given hosts overridden.
+func newHostTransport(transport *http.Transport, headerTimeouts map[string]time.Duration) *hostTransport {
+	ht := &hostTransport{
+		transport: transport,
+		hosts:     make(map[string]*http.Transport),
+	}
+
+	for host, timeout := range headerTimeouts {
+		t := transport.Clone()
+		t.ResponseHeaderTimeout = timeout
+		ht.hosts[host] = t
+	}
+
+	return ht
+}
+
+func (ht *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t, ok := ht.hosts[strings.ToLower(req.URL.Host)]; ok {
+		return t.RoundTrip(req)
+	}
+	if t, ok := ht.hosts[strings.ToLower(req.URL.Hostname())]; ok {
+		return t.RoundTrip(req)
+	}
+
+	return ht.transport.RoundTrip(req)
+}
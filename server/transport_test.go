@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamResponseHeaderTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		hosts map[string]time.Duration
+		code  int
+	}{
+		"default":       {nil, http.StatusBadGateway},
+		"host-override": {map[string]time.Duration{u.Hostname(): time.Second}, http.StatusOK},
+		"host-port":     {map[string]time.Duration{u.Host: time.Second}, http.StatusOK},
+		"other-host":    {map[string]time.Duration{"example.com": time.Second}, http.StatusBadGateway},
+	}
+
+	for name, tc := range tests {
+		s, err := NewNoCache(log.NewNopLogger(), ts.URL, WithUpstreamResponseHeaderTimeout(50*time.Millisecond, tc.hosts))
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		s.Handle().ServeHTTP(w, httptest.NewRequest("GET", "/info", nil))
+		assert.Equal(t, tc.code, w.Code, name)
+	}
+}
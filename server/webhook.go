@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Webhook event types.
+const (
+	WebhookEventFetched          = "fetched"
+	WebhookEventFetchFailed      = "fetch-failed"
+	WebhookEventChecksumMismatch = "checksum-mismatch"
+	WebhookEventEvicted          = "evicted"
+)
+
+// webhookQueueSize is the number of events buffered before new events are
+// dropped.
+const webhookQueueSize = 1024
+
+// WebhookEvent is the payload posted to the webhook URL.
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	OID       string    `json:"oid"`
+	Size      int64     `json:"size"`
+	Source    string    `json:"source,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// webhook delivers events on a best-effort basis. Events are queued and
+// posted by a single worker so that a slow endpoint never blocks callers.
+type webhook struct {
+	logger log.Logger
+	url    string
+	client *http.Client
+	queue  chan WebhookEvent
+}
+
+func newWebhook(logger log.Logger, url string) *webhook {
+	wh := &webhook{
+		logger: logger,
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan WebhookEvent, webhookQueueSize),
+	}
+
+	go wh.run()
+
+	return wh
+}
+
+// send queues an event for delivery, dropping it if the queue is full.
+func (wh *webhook) send(event WebhookEvent) {
+	if wh == nil {
+		return
+	}
+
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+
+	select {
+	case wh.queue <- event:
+	default:
+		level.Error(wh.logger).Log("event", "webhook", "oid", event.OID, "err", "queue full, event dropped")
+	}
+}
+
+func (wh *webhook) run() {
+	for event := range wh.queue {
+		if err := wh.post(event); err != nil {
+			level.Error(wh.logger).Log("event", "webhook", "oid", event.OID, "err", err)
+		}
+	}
+}
+
+func (wh *webhook) post(event WebhookEvent) error {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	resp, err := wh.client.Post(wh.url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %d status code", resp.StatusCode)
+	}
+
+	return nil
+}
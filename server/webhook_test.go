@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/saracen/lfscache/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhook(t *testing.T) {
+	events := make(chan WebhookEvent, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err == nil {
+			events <- event
+		}
+	}))
+	defer hook.Close()
+
+	content := []byte("webhook content")
+	sum := sha256.Sum256(content)
+
+	ts, s, dir, err := objectServer(content, WithWebhook(hook.URL))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	download(s, batchAction(t, s), "GET", nil)
+
+	select {
+	case event := <-events:
+		assert.Equal(t, WebhookEventFetched, event.Event)
+		assert.Equal(t, hex.EncodeToString(sum[:]), event.OID)
+		assert.Equal(t, int64(len(content)), event.Size)
+		assert.False(t, event.Timestamp.IsZero())
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook event")
+	}
+}
+
+func TestWebhookChecksumMismatch(t *testing.T) {
+	events := make(chan WebhookEvent, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err == nil {
+			events <- event
+		}
+	}))
+	defer hook.Close()
+
+	// serve same sized, but different, content
+	ts, s, dir, err := objectServerWithDownload([]byte("webhook content"), func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("WEBHOOK CONTENT"))
+	}, WithWebhook(hook.URL))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	download(s, batchAction(t, s), "GET", nil)
+
+	select {
+	case event := <-events:
+		assert.Equal(t, WebhookEventChecksumMismatch, event.Event)
+		assert.Equal(t, errChecksumMismatch.Error(), event.Error)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook event")
+	}
+}
+
+func TestWebhookEvicted(t *testing.T) {
+	events := make(chan WebhookEvent, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err == nil {
+			events <- event
+		}
+	}))
+	defer hook.Close()
+
+	content := []byte("webhook content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	ts, s, dir, err := objectServer(content, WithWebhook(hook.URL))
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	require.NoError(t, err)
+
+	action := batchAction(t, s)
+	download(s, action, "GET", nil)
+	s.inflight.Wait()
+
+	select {
+	case event := <-events:
+		assert.Equal(t, WebhookEventFetched, event.Event)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook event")
+	}
+
+	// a truncated object is evicted from the cache
+	filename := filepath.Join(dir, cache.DirObjects, cache.DefaultFilenamer(oid))
+	require.NoError(t, os.Truncate(filename, 4))
+	download(s, action, "GET", nil)
+
+	select {
+	case event := <-events:
+		assert.Equal(t, WebhookEventEvicted, event.Event)
+		assert.Equal(t, oid, event.OID)
+		assert.Equal(t, int64(4), event.Size)
+		assert.Equal(t, string(cache.SourceDisk), event.Source)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook event")
+	}
+}